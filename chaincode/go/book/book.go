@@ -5,18 +5,31 @@ import (
 	"fmt"
 	"encoding/json"
 	"time"
+	"sort"
 	"strconv"
 
 	"github.com/hyperledger/fabric/core/chaincode/shim"
 	pb "github.com/hyperledger/fabric/protos/peer"
 	"github.com/Altoros/nsd-commercial-paper-common"
+	"github.com/Altoros/nsd-commercial-paper-common/identity"
 )
 
 var logger = shim.NewLogger("BookChaincode")
 
 const bookIndex = `Book`
 const redeemIndex = `Redeem`
-const mainOrgIndex = `MainOrg`
+
+// trailing argument of move allowing partial settlement of instruction
+const partialSettlementArg = "partial"
+
+// indexes of values versioned by nsd schemas, see migrate
+var schemaIndexes = append([]string{bookIndex, redeemIndex, nsd.InstructionIndex, nsd.InstructionKeyIndex},
+	nsd.CommonSchemaIndexes...)
+
+func init() {
+	nsd.RegisterSchema(nsd.Schema{Index: bookIndex, Version: 1, Upgrades: map[int]nsd.Upgrade{0: nsd.Unversioned}})
+	nsd.RegisterSchema(nsd.Schema{Index: redeemIndex, Version: 1, Upgrades: map[int]nsd.Upgrade{0: nsd.Unversioned}})
+}
 
 type RedeemInstruction struct {
 	Transferer      nsd.Balance `json:"transferer"`
@@ -66,27 +79,34 @@ func (t *BookChaincode) Init(stub shim.ChaincodeStubInterface) pb.Response  {
 		Quantity string `json:"quantity"`
 	}
 
+	// main organization is kept by "security" chaincode
 	type bookInit struct {
-		MainOrganization string          `json:"mainOrg"`
-		InitEntries      []bookInitEntry `json:"initEntries"`
+		InitEntries []bookInitEntry    `json:"initEntries"`
+		Balances    []nsd.Organization `json:"balances"`
+	}
+
+	// optional configuration of cross-chaincode calls follows, see config.json
+	config := ""
+	if len(args) > 1 {
+		config = args[1]
+	}
+	if rs := nsd.InitConfig(stub, config); rs.Status != shim.OK {
+		return rs
 	}
 
 	var initInfo bookInit
 	if err := json.Unmarshal([]byte(args[0]), &initInfo); err == nil {
-		if initInfo.MainOrganization == "" {
-			return pb.Response{Status: 400, Message: "Unable to execute Init without main organization been specified."}
-		}
-
-		if err := stub.PutState(mainOrgIndex, []byte(initInfo.MainOrganization)); err != nil {
-			return pb.Response{Status: 500, Message: "Persistence failure."}
-		}
-
 		for _, entry := range initInfo.InitEntries {
 			if rs := t.put(stub, []string{entry.Account, entry.Division, entry.Security, entry.Quantity});
 			   rs.Status >= 400 {
 				return rs
 			}
 		}
+
+		// book keeps the balance registry of the depository, the same way as "instruction" chaincode
+		if err := nsd.RegisterBalances(stub, initInfo.Balances); err != nil {
+			return pb.Response{Status: 500, Message: "Persistence failure."}
+		}
 	} else {
 		return pb.Response{Status: 400, Message: "JSON unmarshalling error."}
 	}
@@ -99,40 +119,82 @@ func (t *BookChaincode) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
 
 	function, args := stub.GetFunctionAndParameters()
 
-	if function == "put" {
-		return t.put(stub, args)
+	if rs := authorizeRole(stub, function); rs.Status != shim.OK {
+		return rs
+	}
+
+	governed := nsd.Governed{"put": t.put, "redeem": t.redeem,
+		"addBalances": t.addBalances, "removeBalances": t.removeBalances}
+	if rs, ok := governed.Invoke(stub, function, args); ok {
+		return rs
+	}
+	if rs, ok := t.balanceRegistry().Invoke(stub, function, args); ok {
+		return rs
 	}
+
 	if function == "move" {
 		return t.move(stub, args)
 	}
+	if function == "settleBatch" {
+		return t.settleBatch(stub, args)
+	}
 	if function == "rollback" {
 		return t.rollback(stub, args)
 	}
 	if function == "check" {
 		return t.check(stub, args)
 	}
+	if function == "settlement" {
+		return t.settlement(stub, args)
+	}
 	if function == "query" {
 		return t.query(stub, args)
 	}
 	if function == "history" {
 		return t.history(stub, args)
 	}
-	if function == "redeem" {
-		return t.redeem(stub, args)
-	}
 	if function == "redeemHistory" {
 		return t.getRedeemHistory(stub, args)
 	}
 	if function == "mainOrg" {
 		return t.getMainOrg(stub, args)
 	}
+	if function == "config" {
+		return nsd.QueryConfig(stub)
+	}
+	if function == "organization" {
+		return nsd.QueryOrganization(stub, args)
+	}
+	if function == "pendingMigration" {
+		return nsd.PendingMigration(stub, args, schemaIndexes...)
+	}
+	if function == "migrate" {
+		return nsd.Migrate(stub, args, schemaIndexes...)
+	}
+	if function == "schemaStatus" {
+		return nsd.SchemaStatus(stub, schemaIndexes...)
+	}
 
 	err := fmt.Sprintf("Unknown function, check the first argument, must be one of: " +
-		"put, move, check, query, history, rollback, mainOrg, redeem, redeemHistory. But got: %v", function)
+		"move, settleBatch, check, settlement, query, history, rollback, mainOrg, config, redeemHistory, pendingMigration, migrate, schemaStatus, " +
+		"propose (put, redeem, addBalances, removeBalances), approve, pending, proposalHistory, " +
+		"acceptBalanceChange, rejectBalanceChange, balanceChanges, organization. " +
+		"But got: %v", function)
 	logger.Error(err)
 	return shim.Error(err)
 }
 
+// functions changing the book are available to operators only, others are read only and open to auditors as well
+var operatorFunctions = map[string]bool{"move": true, "settleBatch": true, "rollback": true, "propose": true, "approve": true,
+	"migrate": true, "acceptBalanceChange": true, "rejectBalanceChange": true}
+
+func authorizeRole(stub shim.ChaincodeStubInterface, function string) pb.Response {
+	if !operatorFunctions[function] {
+		return shim.Success(nil)
+	}
+	return nsd.AuthorizeRole(stub, "call "+function, identity.RoleOperator)
+}
+
 func (t *BookChaincode) put(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 	// account, division, security, quantity
 	if len(args) != 4 {
@@ -154,7 +216,7 @@ func (t *BookChaincode) put(stub shim.ChaincodeStubInterface, args []string) pb.
 		return shim.Error(err.Error())
 	}
 
-	value, err := json.Marshal(BookValue{Quantity: quantity})
+	value, err := nsd.MarshalValue(bookIndex, BookValue{Quantity: quantity})
 	if err != nil {
 		return shim.Error(err.Error())
 	}
@@ -197,7 +259,7 @@ func (t *BookChaincode) check(stub shim.ChaincodeStubInterface, args []string) p
 	}
 
 	var value BookValue
-	err = json.Unmarshal(bytes, &value)
+	err = nsd.UnmarshalValue(bookIndex, bytes, &value)
 	if err != nil {
 		return shim.Error(err.Error())
 	}
@@ -209,87 +271,343 @@ func (t *BookChaincode) check(stub shim.ChaincodeStubInterface, args []string) p
 	return shim.Success(nil)
 }
 
-func moveSecurity(stub shim.ChaincodeStubInterface, accountFrom, divisionFrom, security string,
-				  quantity int, accountTo, divisionTo string) pb.Response {
-	keyFrom, err := stub.CreateCompositeKey(bookIndex, []string{accountFrom, divisionFrom, security})
+// positions keeps positions of the book changed within transaction: the peer reads the state as it was
+// before the transaction, so several moves of the same position have to see the previous ones
+type positions struct {
+	stub   shim.ChaincodeStubInterface
+	values map[string]*BookValue
+	keys   []string
+}
+
+func newPositions(stub shim.ChaincodeStubInterface) *positions {
+	return &positions{stub: stub, values: map[string]*BookValue{}}
+}
+
+// get reads position, nil if there is none
+func (this *positions) get(account, division, security string) (string, *BookValue, error) {
+	key, err := this.stub.CreateCompositeKey(bookIndex, []string{account, division, security})
 	if err != nil {
-		return shim.Error(err.Error())
+		return "", nil, err
 	}
 
-	bytes, err := stub.GetState(keyFrom)
-	if err != nil {
-		return shim.Error(err.Error())
+	if value, ok := this.values[key]; ok {
+		return key, value, nil
 	}
 
-	if bytes == nil {
-		return pb.Response{Status:404, Message: "cannot find position"}
+	bytes, err := this.stub.GetState(key)
+	if err != nil || bytes == nil {
+		return key, nil, err
+	}
+
+	var value BookValue
+	if err := nsd.UnmarshalValue(bookIndex, bytes, &value); err != nil {
+		return key, nil, err
 	}
+	this.values[key] = &value
+	this.keys = append(this.keys, key)
+	return key, &value, nil
+}
 
-	var valueFrom BookValue
-	err = json.Unmarshal(bytes, &valueFrom)
+// add changes quantity of position by delta, a position missing is created
+func (this *positions) add(account, division, security string, delta int) pb.Response {
+	key, value, err := this.get(account, division, security)
 	if err != nil {
 		return shim.Error(err.Error())
 	}
 
-	if valueFrom.Quantity < quantity {
+	if value == nil {
+		if delta < 0 {
+			return pb.Response{Status:404, Message: "cannot find position"}
+		}
+		value = &BookValue{}
+		this.values[key] = value
+		this.keys = append(this.keys, key)
+	}
+
+	if value.Quantity + delta < 0 {
 		return pb.Response{Status:409, Message: "cannot move quantity less than current balance"}
 	}
+	value.Quantity += delta
 
-	valueFrom.Quantity = valueFrom.Quantity - quantity
+	return shim.Success(nil)
+}
 
-	newBytes, err := json.Marshal(valueFrom)
-	if err != nil {
+// move moves quantity of security from one position to another
+func (this *positions) move(accountFrom, divisionFrom, security string,
+				  quantity int, accountTo, divisionTo string) pb.Response {
+	if _, value, err := this.get(accountFrom, divisionFrom, security); err != nil {
 		return shim.Error(err.Error())
+	} else if value == nil {
+		return pb.Response{Status:404, Message: "cannot find position"}
+	}
+
+	if response := this.add(accountFrom, divisionFrom, security, -quantity); response.GetStatus() != shim.OK {
+		return response
+	}
+	return this.add(accountTo, divisionTo, security, quantity)
+}
+
+// put writes positions changed in the ledger
+func (this *positions) put() pb.Response {
+	for _, key := range this.keys {
+		bytes, err := nsd.MarshalValue(bookIndex, *this.values[key])
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		if err := this.stub.PutState(key, bytes); err != nil {
+			return shim.Error(err.Error())
+		}
 	}
+	return shim.Success(nil)
+}
 
-	err = stub.PutState(keyFrom, newBytes)
+func moveSecurity(stub shim.ChaincodeStubInterface, accountFrom, divisionFrom, security string,
+				  quantity int, accountTo, divisionTo string) pb.Response {
+	p := newPositions(stub)
+	if response := p.move(accountFrom, divisionFrom, security, quantity, accountTo, divisionTo);
+	   response.GetStatus() != shim.OK {
+		return response
+	}
+	return p.put()
+}
+
+// settle moves securities of instruction from the transferer to the receiver and money of DVP instruction back
+func settle(p *positions, instruction nsd.Instruction) pb.Response {
+	// Security transaction
+	accountFrom := instruction.Key.Transferer.Account
+	divisionFrom := instruction.Key.Transferer.Division
+	security := instruction.Key.Security
+	quantity, err := wholeUnits(instruction.Key.Quantity)
 	if err != nil {
-		return shim.Error(err.Error())
+		return pb.Response{Status: 400, Message: "Quantity " + err.Error() + "."}
+	}
+	accountTo := instruction.Key.Receiver.Account
+	divisionTo := instruction.Key.Receiver.Division
+
+	if response := p.move(accountFrom, divisionFrom, security, quantity, accountTo, divisionTo);
+	   response.GetStatus() != shim.OK {
+		return response
+	}
+
+	if instruction.Key.Type == nsd.InstructionTypeDVP {
+		// Money transaction
+		accountFrom = instruction.Key.ReceiverRequisites.Account
+		// divisionFrom = instruction.Key.ReceiverRequisites.Bic
+		divisionFrom = ""
+		security = instruction.Key.PaymentCurrency
+		if quantity, err = paymentUnits(instruction.Key.PaymentAmount); err != nil {
+			return pb.Response{Status: 400, Message: "Payment amount " + err.Error() + "."}
+		}
+		accountTo = instruction.Key.TransfererRequisites.Account
+		// divisionTo = instruction.Key.TransfererRequisites.Bic
+		divisionTo = ""
+
+		if response := p.move(accountFrom, divisionFrom, security, quantity, accountTo, divisionTo);
+			response.GetStatus() != shim.OK {
+			return response
+		}
+	}
+
+	return shim.Success(nil)
+}
+
+// checkSettlementDate refuses to settle instruction before the settlement date instruction chaincode records,
+// that of instruction matched before dates were recorded is found by the calendar of "security" chaincode
+func checkSettlementDate(stub shim.ChaincodeStubInterface, recorded nsd.Instruction) pb.Response {
+	settlementDate := recorded.Value.SettlementDate
+	if settlementDate == "" {
+		calendar, err := nsd.GetCalendar(stub)
+		if err != nil {
+			return pb.Response{Status: 500, Message: "Unable to get calendar: " + err.Error()}
+		}
+		if settlementDate, err = calendar.SettlementDate(recorded.Key); err != nil {
+			return pb.Response{Status: 400, Message: err.Error()}
+		}
 	}
 
-	keyTo, err := stub.CreateCompositeKey(bookIndex, []string{accountTo, divisionTo, security})
+	txTimestamp, err := stub.GetTxTimestamp()
 	if err != nil {
 		return shim.Error(err.Error())
 	}
+	if time.Unix(txTimestamp.Seconds, int64(txTimestamp.Nanos)).UTC().Format("2006-01-02") < settlementDate {
+		return pb.Response{Status: 406, Message: "Cannot settle before settlement date " + settlementDate + "."}
+	}
+	return shim.Success(nil)
+}
+
+// statuses instructions are settled in: matched by both parties, possibly signed and downloaded since
+var settledStatuses = map[string]bool{
+	nsd.InstructionMatched:    true,
+	nsd.InstructionSigned:     true,
+	nsd.InstructionDownloaded: true,
+}
 
-	bytes, err = stub.GetState(keyTo)
+// invokeInstructionChannels queries instruction chaincode on instruction channels of configuration in turn
+// until one of them has what is asked, 404 is returned if none has
+func invokeInstructionChannels(stub shim.ChaincodeStubInterface, args ...string) pb.Response {
+	config, err := nsd.GetConfig(stub)
 	if err != nil {
-		return shim.Error(err.Error())
+		return pb.Response{Status: 500, Message: "Unable to get configuration: " + err.Error()}
+	}
+	// no channels are configured until organizations are registered, nothing is found then
+	for _, channel := range config.InstructionChannels {
+		rs := nsd.InvokeInstruction(stub, channel, args...)
+		if rs.Status == 404 {
+			continue
+		}
+		if rs.Status >= 400 {
+			return pb.Response{Status: 400,
+				Message: "Unable to invoke \"instruction\" on " + channel + ": " + rs.Message}
+		}
+		return rs
 	}
+	return pb.Response{Status: 404, Message: "Not found on instruction channels."}
+}
 
-	if bytes == nil {
-		newBytes, err = json.Marshal(BookValue{Quantity: quantity})
+// recordedInstruction reads instruction as instruction chaincode records it, the book settles only instructions
+// its parties have agreed on there
+func recordedInstruction(stub shim.ChaincodeStubInterface, instruction nsd.Instruction) (nsd.Instruction, pb.Response) {
+	recorded := nsd.Instruction{}
+
+	compositeKey, err := instruction.ToCompositeKey(stub)
+	if err != nil {
+		return recorded, shim.Error(err.Error())
+	}
+
+	rs := invokeInstructionChannels(stub, "queryById", nsd.InstructionId(compositeKey))
+	if rs.Status == 404 {
+		// DVP instructions stored before the private part was moved out of the key keep their keys and ids
+		legacyId, err := instruction.LegacyId(stub)
 		if err != nil {
-			return shim.Error(err.Error())
+			return recorded, shim.Error(err.Error())
 		}
-	} else {
-		var valueTo BookValue
-		err = json.Unmarshal(bytes, &valueTo)
-		if err != nil {
-			return shim.Error(err.Error())
+		if legacyId != "" {
+			rs = invokeInstructionChannels(stub, "queryById", legacyId)
 		}
+	}
+	if rs.Status == 404 {
+		return recorded, pb.Response{Status: 404,
+			Message: "Instruction " + instruction.Key.Reference + " is not found on instruction channels."}
+	}
+	if rs.Status != shim.OK {
+		return recorded, rs
+	}
+
+	if err := json.Unmarshal(rs.Payload, &recorded); err != nil {
+		return recorded, shim.Error("Cannot unmarshal response: " + err.Error())
+	}
+	return recorded, shim.Success(nil)
+}
 
-		valueTo.Quantity = valueTo.Quantity + quantity
+// checkRecorded checks instruction is matched by its parties in instruction chaincode and is not linked to a group,
+// which settles only as a whole, and returns it as recorded there
+func checkRecorded(stub shim.ChaincodeStubInterface, instruction nsd.Instruction) (nsd.Instruction, pb.Response) {
+	recorded, rs := recordedInstruction(stub, instruction)
+	if rs.Status != shim.OK {
+		return recorded, rs
+	}
+	if recorded.Value.LinkGroup != "" {
+		return recorded, pb.Response{Status: 409, Message: "Instruction " + instruction.Key.Reference +
+			" is linked to group " + recorded.Value.LinkGroup + ", it settles only with the group."}
+	}
+	if !settledStatuses[recorded.Value.Status] {
+		return recorded, pb.Response{Status: 406, Message: "Instruction " + instruction.Key.Reference + " is " +
+			recorded.Value.Status + ", not matched."}
+	}
+	return recorded, shim.Success(nil)
+}
 
-		newBytes, err = json.Marshal(valueTo)
+// wholeUnits parses quantity of instruction, the book keeps securities in whole units
+func wholeUnits(value string) (int, error) {
+	units, err := strconv.Atoi(value)
+	if err != nil || units <= 0 {
+		return 0, fmt.Errorf("%q is not a positive integer", value)
+	}
+	return units, nil
+}
+
+// paymentUnits parses payment amount of DVP instruction, the book keeps money in minor units of the currency,
+// see nsd.AmountPrecision
+func paymentUnits(value string) (int, error) {
+	amount, err := nsd.ParseAmount(value)
+	if err != nil || amount <= 0 {
+		return 0, fmt.Errorf("%q is not a positive decimal with at most %d fractional digits", value,
+			nsd.AmountPrecision)
+	}
+	return int(amount), nil
+}
+
+// checkGroup checks instructions given to settle link group are all of its instructions as instruction chaincode
+// records them and every one of them is matched
+func checkGroup(stub shim.ChaincodeStubInterface, group string, instructions []nsd.Instruction) pb.Response {
+	rs := invokeInstructionChannels(stub, "groupStatus", group)
+	if rs.Status == 404 {
+		return pb.Response{Status: 404, Message: "Group is not found on instruction channels."}
+	}
+	if rs.Status != shim.OK {
+		return rs
+	}
+
+	var recorded struct {
+		Instructions []struct {
+			Id     string `json:"id"`
+			Status string `json:"status"`
+		} `json:"instructions"`
+	}
+	if err := json.Unmarshal(rs.Payload, &recorded); err != nil {
+		return shim.Error("Cannot unmarshal response: " + err.Error())
+	}
+	members := map[string]string{}
+	for _, member := range recorded.Instructions {
+		members[member.Id] = member.Status
+	}
+
+	given := map[string]bool{}
+	for _, instruction := range instructions {
+		compositeKey, err := instruction.ToCompositeKey(stub)
 		if err != nil {
 			return shim.Error(err.Error())
 		}
-	}
+		id := nsd.InstructionId(compositeKey)
 
-	err = stub.PutState(keyTo, newBytes)
-	if err != nil {
-		return shim.Error(err.Error())
+		status, ok := members[id]
+		if !ok {
+			return pb.Response{Status: 400, Message: "Instruction " + instruction.Key.Reference + " is not in the group."}
+		}
+		if !settledStatuses[status] {
+			return pb.Response{Status: 406, Message: "Instruction " + instruction.Key.Reference + " of the group is " +
+				status + "."}
+		}
+		given[id] = true
+	}
+	if len(given) != len(members) {
+		return pb.Response{Status: 400, Message: "Every instruction of the group must be given."}
 	}
-
 	return shim.Success(nil)
 }
 
+// move settles instruction given by its arguments, or instructions of link group given by group id
+// and JSON array of their arguments; arguments of instruction followed by "partial" allow to settle
+// the quantity available if the transferer lacks the whole one, both parties must have allowed that
+// in instruction chaincode
 func (t *BookChaincode) move(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) == 2 {
+		return t.moveGroup(stub, args[0], args[1])
+	}
+
+	partial := len(args) > 0 && args[len(args)-1] == partialSettlementArg
+	if partial {
+		args = args[:len(args)-1]
+	}
+
 	instruction := nsd.Instruction{}
 	if err := instruction.FillFromArgs(args); err != nil {
 		return pb.Response{Status: 400, Message: "Wrong arguments."}
 	}
+	if err := instruction.FillFromTransient(stub, 0); err != nil {
+		return pb.Response{Status: 400, Message: err.Error()}
+	}
 
 	// check stored list for this instructions has been executed already
 	if instruction.ExistsIn(stub) {
@@ -300,42 +618,175 @@ func (t *BookChaincode) move(stub shim.ChaincodeStubInterface, args []string) pb
 		if instruction.Value.Status == nsd.InstructionExecuted {
 			return pb.Response{Status: 202, Message: "Already executed."}
 		}
+		if instruction.Value.Status == nsd.InstructionPartiallyExecuted {
+			return pb.Response{Status: 202, Message: "Already executed partially, remainder is " +
+				instruction.Value.Remainder + "."}
+		}
 	}
 
-	// Security transaction
-	accountFrom := instruction.Key.Transferer.Account
-	divisionFrom := instruction.Key.Transferer.Division
-	security := instruction.Key.Security
-	quantity, _ := strconv.Atoi(instruction.Key.Quantity)
-	accountTo := instruction.Key.Receiver.Account
-	divisionTo := instruction.Key.Receiver.Division
+	recorded, response := checkRecorded(stub, instruction)
+	if response.GetStatus() != shim.OK {
+		return response
+	}
+	if partial && !recorded.Value.AllowsPartialSettlement() {
+		return pb.Response{Status: 403, Message: "Partial settlement is not allowed by both parties."}
+	}
+	if response := checkSettlementDate(stub, recorded); response.GetStatus() != shim.OK {
+		return response
+	}
 
-	if response := moveSecurity(stub, accountFrom, divisionFrom, security, quantity, accountTo, divisionTo);
-	   response.GetStatus() != shim.OK {
+	p := newPositions(stub)
+	if response := settle(p, instruction); response.GetStatus() == 409 && partial {
+		return t.movePartially(stub, instruction, response)
+	} else if response.GetStatus() != shim.OK {
+		return response
+	}
+	if response := p.put(); response.GetStatus() != shim.OK {
 		return response
 	}
 
-	if instruction.Key.Type == nsd.InstructionTypeDVP {
-		// Money transaction
-		accountFrom = instruction.Key.ReceiverRequisites.Account
-		// divisionFrom = instruction.Key.ReceiverRequisites.Bic
-		divisionFrom = ""
-		security = instruction.Key.PaymentCurrency
-		quantity, _ = strconv.Atoi(instruction.Key.PaymentAmount)
-		accountTo = instruction.Key.TransfererRequisites.Account
-		// divisionTo = instruction.Key.TransfererRequisites.Bic
-		divisionTo = ""
+	if instruction != (nsd.Instruction{}) {
+		instruction.Value.Status = nsd.InstructionExecuted
 
-		if response := moveSecurity(stub, accountFrom, divisionFrom, security, quantity, accountTo, divisionTo);
-			response.GetStatus() != shim.OK {
-			return response
+		// save to the ledger list of executed instructions
+		if err := instruction.UpsertIn(stub); err != nil {
+			return pb.Response{Status: 500, Message: "Persistence failure."}
+		}
+
+		if err := instruction.EmitState(stub); err != nil {
+			return pb.Response{Status: 500, Message: "Event emission failure."}
 		}
 	}
 
-	if instruction != (nsd.Instruction{}) {
+	return shim.Success(nil)
+}
+
+// movePartially settles the quantity of securities the transferer has with payment amount pro rata:
+// the instruction becomes partially executed and the rest of it is stored as its matched remainder,
+// id of which is returned. The response of failed settlement is returned if the transferer has nothing to move.
+func (t *BookChaincode) movePartially(stub shim.ChaincodeStubInterface, instruction nsd.Instruction,
+	failure pb.Response) pb.Response {
+
+	p := newPositions(stub)
+	_, position, err := p.get(instruction.Key.Transferer.Account, instruction.Key.Transferer.Division,
+		instruction.Key.Security)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	quantity, err := wholeUnits(instruction.Key.Quantity)
+	if err != nil {
+		return pb.Response{Status: 400, Message: "Quantity " + err.Error() + "."}
+	}
+	// money of DVP instruction may be what is lacking
+	if position == nil || position.Quantity <= 0 || position.Quantity >= quantity {
+		return failure
+	}
+
+	remainder, settledAmount, err := instruction.Remainder(position.Quantity)
+	if err != nil {
+		return pb.Response{Status: 400, Message: err.Error()}
+	}
+
+	settled := instruction
+	settled.Key.Quantity = strconv.Itoa(position.Quantity)
+	settled.Key.PaymentAmount = settledAmount
+	if response := settle(p, settled); response.GetStatus() != shim.OK {
+		return response
+	}
+	if response := p.put(); response.GetStatus() != shim.OK {
+		return response
+	}
+
+	compositeKey, err := instruction.ToCompositeKey(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	instruction.Id = nsd.InstructionId(compositeKey)
+
+	remainder.Value = instruction.Value
+	remainder.Value.Status = nsd.InstructionMatched
+	remainder.Value.Parent = instruction.Id
+	if err := remainder.UpsertIn(stub); err != nil {
+		return pb.Response{Status: 500, Message: "Persistence failure."}
+	}
+
+	instruction.Value.Status = nsd.InstructionPartiallyExecuted
+	instruction.Value.SettledQuantity = settled.Key.Quantity
+	instruction.Value.SettledAmount = settledAmount
+	instruction.Value.Remainder = remainder.Id
+	if err := instruction.UpsertIn(stub); err != nil {
+		return pb.Response{Status: 500, Message: "Persistence failure."}
+	}
+
+	if err := instruction.EmitState(stub); err != nil {
+		return pb.Response{Status: 500, Message: "Event emission failure."}
+	}
+
+	return shim.Success([]byte(remainder.Id))
+}
+
+// moveGroup settles all instructions of link group in one transaction or none of them,
+// those must be all of the instructions of the group instruction chaincode records and all matched
+func (t *BookChaincode) moveGroup(stub shim.ChaincodeStubInterface, group string, instructionsJSON string) pb.Response {
+	var instructionsArgs [][]string
+	if err := json.Unmarshal([]byte(instructionsJSON), &instructionsArgs); err != nil || len(instructionsArgs) == 0 {
+		return pb.Response{Status: 400, Message: "JSON unmarshalling error."}
+	}
+
+	instructions := []nsd.Instruction{}
+	executed := 0
+	for i, args := range instructionsArgs {
+		instruction := nsd.Instruction{}
+		if err := instruction.FillFromArgs(args); err != nil {
+			return pb.Response{Status: 400, Message: "Wrong arguments."}
+		}
+		if err := instruction.FillFromTransient(stub, i); err != nil {
+			return pb.Response{Status: 400, Message: err.Error()}
+		}
+
+		if instruction.ExistsIn(stub) {
+			if err := instruction.LoadFrom(stub); err != nil {
+				return pb.Response{Status: 500, Message: "Instruction cannot be loaded."}
+			}
+			if instruction.Value.Status == nsd.InstructionExecuted {
+				executed++
+			}
+		}
+		instructions = append(instructions, instruction)
+	}
+
+	if executed == len(instructions) {
+		return pb.Response{Status: 202, Message: "Already executed."}
+	}
+	if executed != 0 {
+		return pb.Response{Status: 409, Message: "Group is executed partially."}
+	}
+	if response := checkGroup(stub, group, instructions); response.GetStatus() != shim.OK {
+		return response
+	}
+
+	p := newPositions(stub)
+	for _, instruction := range instructions {
+		recorded, response := recordedInstruction(stub, instruction)
+		if response.GetStatus() == shim.OK {
+			response = checkSettlementDate(stub, recorded)
+		}
+		if response.GetStatus() == shim.OK {
+			response = settle(p, instruction)
+		}
+		if response.GetStatus() != shim.OK {
+			return pb.Response{Status: response.Status,
+				Message: "Instruction " + instruction.Key.Reference + " of the group: " + response.Message}
+		}
+	}
+	if response := p.put(); response.GetStatus() != shim.OK {
+		return response
+	}
+
+	for _, instruction := range instructions {
 		instruction.Value.Status = nsd.InstructionExecuted
+		instruction.Value.LinkGroup = group
 
-		// save to the ledger list of executed instructions
 		if err := instruction.UpsertIn(stub); err != nil {
 			return pb.Response{Status: 500, Message: "Persistence failure."}
 		}
@@ -348,11 +799,174 @@ func (t *BookChaincode) move(stub shim.ChaincodeStubInterface, args []string) pb
 	return shim.Success(nil)
 }
 
+// settleBatch settles instructions given by JSON array of their arguments with multilateral netting:
+// only net movements of securities and money of each balance are applied, balances must cover the net ones.
+// Instructions must be matched in instruction chaincode and not linked to a group.
+// Every instruction is executed in the batch with id of the transaction, returned along with the net movements.
+func (t *BookChaincode) settleBatch(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return pb.Response{Status: 400, Message: "Incorrect number of arguments. Expecting instructions as JSON array"}
+	}
+
+	var instructionsArgs [][]string
+	if err := json.Unmarshal([]byte(args[0]), &instructionsArgs); err != nil || len(instructionsArgs) == 0 {
+		return pb.Response{Status: 400, Message: "JSON unmarshalling error."}
+	}
+
+	type movement struct {
+		Account  string `json:"account"`
+		Division string `json:"division"`
+		Security string `json:"security"`
+		Quantity int    `json:"quantity"`
+	}
+	net := map[movement]int{}
+	add := func(account, division, security string, quantity int) {
+		net[movement{Account: account, Division: division, Security: security}] += quantity
+	}
+
+	instructions := []nsd.Instruction{}
+	given := map[string]bool{}
+	for i, instructionArgs := range instructionsArgs {
+		instruction := nsd.Instruction{}
+		if err := instruction.FillFromArgs(instructionArgs); err != nil {
+			return pb.Response{Status: 400, Message: "Wrong arguments."}
+		}
+		if err := instruction.FillFromTransient(stub, i); err != nil {
+			return pb.Response{Status: 400, Message: err.Error()}
+		}
+
+		key, err := instruction.ToCompositeKey(stub)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if given[key] {
+			return pb.Response{Status: 400, Message: "Instruction " + instruction.Key.Reference + " is given twice."}
+		}
+		given[key] = true
+
+		if instruction.ExistsIn(stub) {
+			if err := instruction.LoadFrom(stub); err != nil {
+				return pb.Response{Status: 500, Message: "Instruction cannot be loaded."}
+			}
+			if instruction.Value.Status == nsd.InstructionExecuted ||
+				instruction.Value.Status == nsd.InstructionPartiallyExecuted {
+				return pb.Response{Status: 409, Message: "Instruction " + instruction.Key.Reference + " is executed already."}
+			}
+		}
+		recorded, response := checkRecorded(stub, instruction)
+		if response.GetStatus() != shim.OK {
+			return response
+		}
+		if response := checkSettlementDate(stub, recorded); response.GetStatus() != shim.OK {
+			return pb.Response{Status: response.Status,
+				Message: "Instruction " + instruction.Key.Reference + ": " + response.Message}
+		}
+
+		quantity, err := wholeUnits(instruction.Key.Quantity)
+		if err != nil {
+			return pb.Response{Status: 400, Message: "Instruction " + instruction.Key.Reference + ": quantity " +
+				err.Error() + "."}
+		}
+		add(instruction.Key.Transferer.Account, instruction.Key.Transferer.Division, instruction.Key.Security, -quantity)
+		add(instruction.Key.Receiver.Account, instruction.Key.Receiver.Division, instruction.Key.Security, quantity)
+
+		if instruction.Key.Type == nsd.InstructionTypeDVP {
+			amount, err := paymentUnits(instruction.Key.PaymentAmount)
+			if err != nil {
+				return pb.Response{Status: 400, Message: "Instruction " + instruction.Key.Reference +
+					": payment amount " + err.Error() + "."}
+			}
+			add(instruction.Key.ReceiverRequisites.Account, "", instruction.Key.PaymentCurrency, -amount)
+			add(instruction.Key.TransfererRequisites.Account, "", instruction.Key.PaymentCurrency, amount)
+		}
+
+		instructions = append(instructions, instruction)
+	}
+
+	movements := []movement{}
+	for m, quantity := range net {
+		if quantity != 0 {
+			m.Quantity = quantity
+			movements = append(movements, m)
+		}
+	}
+	sort.Slice(movements, func(i, j int) bool {
+		a, b := movements[i], movements[j]
+		if a.Account != b.Account {
+			return a.Account < b.Account
+		}
+		if a.Division != b.Division {
+			return a.Division < b.Division
+		}
+		return a.Security < b.Security
+	})
+
+	p := newPositions(stub)
+	for _, m := range movements {
+		if response := p.add(m.Account, m.Division, m.Security, m.Quantity); response.GetStatus() != shim.OK {
+			return pb.Response{Status: response.Status, Message: "Net position of " + m.Account + " " + m.Division +
+				" in " + m.Security + " is not covered: " + response.Message}
+		}
+	}
+	if response := p.put(); response.GetStatus() != shim.OK {
+		return response
+	}
+
+	batch := stub.GetTxID()
+	for _, instruction := range instructions {
+		instruction.Value.Status = nsd.InstructionExecuted
+		instruction.Value.SettlementBatch = batch
+
+		if err := instruction.UpsertIn(stub); err != nil {
+			return pb.Response{Status: 500, Message: "Persistence failure."}
+		}
+
+		if err := instruction.EmitState(stub); err != nil {
+			return pb.Response{Status: 500, Message: "Event emission failure."}
+		}
+	}
+
+	type settlement struct {
+		Batch     string     `json:"batch"`
+		Movements []movement `json:"movements"`
+	}
+	data, err := json.Marshal(settlement{Batch: batch, Movements: movements})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(data)
+}
+
+// settlement returns instruction by id as the book has settled it: executed in full, in a batch or partially
+// with the settled quantity and amount, instruction chaincode records partial settlement from it
+func (t *BookChaincode) settlement(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return pb.Response{Status: 400, Message: "Incorrect number of arguments. Expecting instruction id"}
+	}
+
+	instruction := nsd.Instruction{}
+	if _, err := instruction.FillFromIdOrArgs(stub, args); err != nil {
+		return pb.Response{Status: 404, Message: "Instruction is not settled."}
+	}
+	if err := instruction.LoadFrom(stub); err != nil || instruction.Value.Status == "" {
+		return pb.Response{Status: 404, Message: "Instruction is not settled."}
+	}
+
+	data, err := json.Marshal(instruction)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(data)
+}
+
 func (t *BookChaincode) rollback(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 	instruction := nsd.Instruction{}
 	if err := instruction.FillFromArgs(args); err != nil {
 		return pb.Response{Status: 400, Message: "Wrong arguments."}
 	}
+	if err := instruction.FillFromTransient(stub, 0); err != nil {
+		return pb.Response{Status: 400, Message: err.Error()}
+	}
 
 	// check stored list for this instructions has been rolled back already
 	if instruction.ExistsIn(stub) {
@@ -369,7 +983,10 @@ func (t *BookChaincode) rollback(stub shim.ChaincodeStubInterface, args []string
 	accountFrom := instruction.Key.Receiver.Account
 	divisionFrom := instruction.Key.Receiver.Division
 	security := instruction.Key.Security
-	quantity, _ := strconv.Atoi(instruction.Key.Quantity)
+	quantity, err := wholeUnits(instruction.Key.Quantity)
+	if err != nil {
+		return pb.Response{Status: 400, Message: "Quantity " + err.Error() + "."}
+	}
 	accountTo := instruction.Key.Transferer.Account
 	divisionTo := instruction.Key.Transferer.Division
 
@@ -384,7 +1001,9 @@ func (t *BookChaincode) rollback(stub shim.ChaincodeStubInterface, args []string
 		// divisionFrom = instruction.Key.TransfererRequisites.Bic
 		divisionFrom = ""
 		security = instruction.Key.PaymentCurrency
-		quantity, _ = strconv.Atoi(instruction.Key.PaymentAmount)
+		if quantity, err = paymentUnits(instruction.Key.PaymentAmount); err != nil {
+			return pb.Response{Status: 400, Message: "Payment amount " + err.Error() + "."}
+		}
 		accountTo = instruction.Key.ReceiverRequisites.Account
 		// divisionTo = instruction.Key.ReceiverRequisites.Bic
 		divisionTo = ""
@@ -436,7 +1055,7 @@ func (t *BookChaincode) getRedeemHistory(stub shim.ChaincodeStubInterface, args
 		}
 
 		instruction := Results{Security: compositeKeyParts[0]}
-		if err := json.Unmarshal(response.GetValue(), &instruction.Instructions); err != nil {
+		if err := nsd.UnmarshalValue(redeemIndex, response.GetValue(), &instruction.Instructions); err != nil {
 			return shim.Error(err.Error())
 		}
 
@@ -476,7 +1095,7 @@ func (t *BookChaincode) find(stub shim.ChaincodeStubInterface, filterBySecurity
 		}
 
 		var value BookValue
-		err = json.Unmarshal(responseRange.Value, &value)
+		err = nsd.UnmarshalValue(bookIndex, responseRange.Value, &value)
 		if err != nil {
 			return []Book{}, fmt.Errorf("Cannot unmarsal response: %v", err)
 		}
@@ -501,7 +1120,22 @@ func (t *BookChaincode) find(stub shim.ChaincodeStubInterface, filterBySecurity
 
 
 func (t *BookChaincode) query(stub shim.ChaincodeStubInterface, args []string) pb.Response {
-	books, err := t.findAll(stub)
+	// optional filter by security
+	if len(args) > 1 {
+		return pb.Response{Status:400, Message: "Incorrect number of arguments. " +
+			"Expecting none or security"}
+	}
+
+	filterBySecurity := ""
+	if len(args) == 1 {
+		filterBySecurity = args[0]
+	}
+
+	books, err := t.find(stub, filterBySecurity)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
 	result, err := json.Marshal(books)
 	if err != nil {
 		return shim.Error(err.Error())
@@ -545,7 +1179,7 @@ func (t *BookChaincode) history(stub shim.ChaincodeStubInterface, args []string)
 			entry.Timestamp = time.Unix(ts.Seconds, int64(ts.Nanos)).String()
 		}
 
-		err = json.Unmarshal(response.GetValue(), &entry.Value)
+		err = nsd.UnmarshalValue(bookIndex, response.GetValue(), &entry.Value)
 		if err != nil {
 			return shim.Error(err.Error())
 		}
@@ -578,7 +1212,7 @@ func (t *BookChaincode) redeem(stub shim.ChaincodeStubInterface, args []string)
 
 	var redeemBalance nsd.Balance
 
-	if response := stub.InvokeChaincode("security", [][]byte{[]byte("find"), []byte(securityId)}, "common"); response.Status != shim.OK {
+	if response := nsd.InvokeSecurity(stub, "find", securityId); response.Status != shim.OK {
 		return shim.Error("Cannot load information about security from another channel. " + response.Message)
 	} else {
 		var securityValue SecurityValue
@@ -607,7 +1241,7 @@ func (t *BookChaincode) redeem(stub shim.ChaincodeStubInterface, args []string)
 	if bytes, err := stub.GetState(keyTo); err != nil {
 		return shim.Error(err.Error())
 	} else if bytes != nil {
-		if err = json.Unmarshal(bytes, &valueTo); err != nil {
+		if err = nsd.UnmarshalValue(bookIndex, bytes, &valueTo); err != nil {
 			return shim.Error(err.Error())
 		}
 	}
@@ -629,7 +1263,7 @@ func (t *BookChaincode) redeem(stub shim.ChaincodeStubInterface, args []string)
 		}
 
 		var valueFrom BookValue
-		err = json.Unmarshal(bytes, &valueFrom)
+		err = nsd.UnmarshalValue(bookIndex, bytes, &valueFrom)
 		if err != nil {
 			return shim.Error(err.Error())
 		}
@@ -640,7 +1274,7 @@ func (t *BookChaincode) redeem(stub shim.ChaincodeStubInterface, args []string)
 
 		valueFrom.Quantity = valueFrom.Quantity - source.Quantity
 
-		newBytes, err := json.Marshal(valueFrom)
+		newBytes, err := nsd.MarshalValue(bookIndex, valueFrom)
 		if err != nil {
 			return shim.Error(err.Error())
 		}
@@ -667,7 +1301,7 @@ func (t *BookChaincode) redeem(stub shim.ChaincodeStubInterface, args []string)
 		history = append(history, instruction)
 	}
 
-	newBytes, err := json.Marshal(valueTo)
+	newBytes, err := nsd.MarshalValue(bookIndex, valueTo)
 	if err != nil {
 		return shim.Error(err.Error())
 	}
@@ -677,7 +1311,7 @@ func (t *BookChaincode) redeem(stub shim.ChaincodeStubInterface, args []string)
 		return shim.Error(err.Error())
 	}
 
-	redeemHistoryBytes, err := json.Marshal(history)
+	redeemHistoryBytes, err := nsd.MarshalValue(redeemIndex, history)
 	if err != nil {
 		return shim.Error(err.Error())
 	}
@@ -688,12 +1322,63 @@ func (t *BookChaincode) redeem(stub shim.ChaincodeStubInterface, args []string)
 
 	return shim.Success(nil)
 }
-func (t *BookChaincode) getMainOrg(stub shim.ChaincodeStubInterface, args []string) pb.Response {
-	if mainOrg, err := stub.GetState(mainOrgIndex); err != nil {
-		return pb.Response{Status: 500, Message: "Persistence failure."}
-	} else {
-		return shim.Success(mainOrg)
+// balances are changed with consent of organizations gaining or losing them
+func (t *BookChaincode) balanceRegistry() nsd.BalanceRegistry {
+	return nsd.BalanceRegistry{CheckRemoval: t.checkBalanceRemoval}
+}
+
+// checkBalanceRemoval refuses removal of a balance holding securities
+func (t *BookChaincode) checkBalanceRemoval(stub shim.ChaincodeStubInterface, balance nsd.Balance) pb.Response {
+	books, err := t.findAll(stub)
+	if err != nil {
+		return shim.Error(err.Error())
 	}
+
+	for _, book := range books {
+		if book.Balance == balance && book.Quantity != 0 {
+			return pb.Response{Status: 409, Message: "Balance " + balance.Account + "/" + balance.Division +
+				" holds " + book.Security + "."}
+		}
+	}
+	return shim.Success(nil)
+}
+
+func (t *BookChaincode) addBalances(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if rs := nsd.AuthorizeMainOrg(stub, "register balances"); rs.Status != shim.OK {
+		return rs
+	}
+
+	if len(args) < 1 {
+		return pb.Response{Status: 400, Message: "Incorrect number of arguments."}
+	}
+
+	var organizations []nsd.Organization
+	if err := json.Unmarshal([]byte(args[0]), &organizations); err != nil || len(organizations) == 0 {
+		return pb.Response{Status: 400, Message: "JSON unmarshalling error."}
+	}
+
+	return t.balanceRegistry().ProposeBalanceChange(stub, nsd.BalanceChangeAdd, organizations)
+}
+
+func (t *BookChaincode) removeBalances(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if rs := nsd.AuthorizeMainOrg(stub, "unregister balances"); rs.Status != shim.OK {
+		return rs
+	}
+
+	if len(args) < 1 {
+		return pb.Response{Status: 400, Message: "Incorrect number of arguments."}
+	}
+
+	var organizations []nsd.Organization
+	if err := json.Unmarshal([]byte(args[0]), &organizations); err != nil || len(organizations) == 0 {
+		return pb.Response{Status: 400, Message: "JSON unmarshalling error."}
+	}
+
+	return t.balanceRegistry().ProposeBalanceChange(stub, nsd.BalanceChangeRemove, organizations)
+}
+
+func (t *BookChaincode) getMainOrg(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	return nsd.QueryMainOrg(stub)
 }
 
 func main() {
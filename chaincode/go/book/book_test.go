@@ -3,7 +3,13 @@ package main
 import (
 	"fmt"
 	"testing"
+	"time"
+	"encoding/json"
 	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+	"github.com/Altoros/nsd-commercial-paper-common"
+	"github.com/Altoros/nsd-commercial-paper-common/identity"
+	"github.com/Altoros/nsd-commercial-paper-common/testutils"
 	//"github.com/Altoros/nsd-commercial-paper/chaincode/go/security"
 )
 
@@ -27,7 +33,7 @@ func TestBook_Init(t *testing.T) {
 	scc := new(BookChaincode)
 	stub := shim.NewMockStub("bookChaincode", scc)
 
-	checkInit(t, stub, [][]byte{[]byte("init"), []byte("{\"mainOrg\":\"nsd.nsd.ru\", \"initEntries\":[{\"account\":\"AC0689654902\",\"division\":\"87680000045800005\",\"security\":\"RU000ABC0001\",\"quantity\":\"100\"},{\"account\":\"AC0689654902\",\"division\":\"87680000045800005\",\"security\":\"RU000ABC0002\",\"quantity\":\"42\"}]}")})
+	checkInit(t, stub, [][]byte{[]byte("init"), []byte("{\"initEntries\":[{\"account\":\"AC0689654902\",\"division\":\"87680000045800005\",\"security\":\"RU000ABC0001\",\"quantity\":\"100\"},{\"account\":\"AC0689654902\",\"division\":\"87680000045800005\",\"security\":\"RU000ABC0002\",\"quantity\":\"42\"}]}")})
 
 	//Correct transaction
 	checkState(t, stub, 200, [][]byte{[]byte("check"), []byte("AC0689654902"), []byte("87680000045800005"), []byte("RU000ABC0001"), []byte("90")})
@@ -39,6 +45,295 @@ func TestBook_Init(t *testing.T) {
 	checkState(t, stub, 409, [][]byte{[]byte("check"), []byte("AC0689654902"), []byte("87680000045800005"), []byte("RU000ABC0001"), []byte("200")})
 }
 
+func TestBook_Roles(t *testing.T) {
+	stub := testutils.NewTestStub("book", new(BookChaincode))
+	stub.SetMainOrganization("nsd.nsd.ru")
+	stub.SetCaller("nsd.nsd.ru")
+	stub.MockInit("1", [][]byte{[]byte("init"), []byte("{\"initEntries\":[]}"),
+		[]byte(`{"legacyRoles": false}`)})
+
+	putArgs := [][]byte{[]byte("put"), []byte("AC0689654902"), []byte("87680000045800005"), []byte("RU000ABC0001"), []byte("100")}
+	checkArgs := [][]byte{[]byte("check"), []byte("AC0689654902"), []byte("87680000045800005"), []byte("RU000ABC0001"), []byte("90")}
+
+	// auditor can read only
+	stub.SetCallerRole(identity.RoleAuditor)
+	if res := stub.MockApprovedInvoke(putArgs); res.Status != 403 {
+		fmt.Println("Auditor has changed the book: ", res.Status)
+		t.FailNow()
+	}
+
+	stub.SetCallerRole(identity.RoleOperator)
+	if res := stub.MockApprovedInvoke(putArgs); res.Status != shim.OK {
+		fmt.Println("Operator cannot change the book: ", res.Message)
+		t.FailNow()
+	}
+
+	stub.SetCallerRole(identity.RoleAuditor)
+	if res := stub.MockInvoke("1", checkArgs); res.Status != shim.OK {
+		fmt.Println("Auditor cannot check the book: ", res.Message)
+		t.FailNow()
+	}
+
+	// certificates without role attribute are denied when the configuration does not allow them everything
+	stub.SetCallerRole("")
+	if res := stub.MockApprovedInvoke(putArgs); res.Status != 403 {
+		fmt.Println("Certificate without roles has changed the book: ", res.Status)
+		t.FailNow()
+	}
+	if res := stub.MockInit("1", [][]byte{[]byte("init"), []byte("{\"initEntries\":[]}"),
+		[]byte(`{"legacyRoles": true}`)}); res.Status != shim.OK {
+		fmt.Println("Cannot allow legacy certificates: ", res.Message)
+		t.FailNow()
+	}
+	if res := stub.MockApprovedInvoke(putArgs); res.Status != shim.OK {
+		fmt.Println("Legacy certificate cannot change the book: ", res.Message)
+		t.FailNow()
+	}
+	stub.SetCallerRole(identity.RoleAuditor)
+	if res := stub.MockApprovedInvoke(putArgs); res.Status != 403 {
+		fmt.Println("Auditor has changed the book with legacy certificates allowed: ", res.Status)
+		t.FailNow()
+	}
+	// which they are unless configured otherwise, as certificates generated by cryptogen carry no attributes
+	stub = testutils.NewTestStub("book", new(BookChaincode))
+	stub.SetMainOrganization("nsd.nsd.ru")
+	stub.SetCaller("nsd.nsd.ru")
+	stub.SetCallerRole("")
+	stub.MockInit("1", [][]byte{[]byte("init"), []byte("{\"initEntries\":[]}")})
+	if res := stub.MockApprovedInvoke(putArgs); res.Status != shim.OK {
+		fmt.Println("Legacy certificate cannot change the book by default: ", res.Message)
+		t.FailNow()
+	}
+}
+
+func TestBook_Organizations(t *testing.T) {
+	stub := testutils.NewTestStub("book", new(BookChaincode))
+	stub.SetMainOrganization("nsd.nsd.ru")
+	stub.SetCaller("nsd")
+	stub.MockInit("1", [][]byte{[]byte("init"), []byte(`{"initEntries":[]}`)})
+
+	// main organization is registered by MSP ID qualified with the domain
+	putArgs := [][]byte{[]byte("put"), []byte("AC0689654902"), []byte("87680000045800005"), []byte("RU000ABC0001"), []byte("100")}
+	if res := stub.MockApprovedInvoke(putArgs); res.Status != shim.OK {
+		fmt.Println("Main organization cannot change the book: ", res.Message)
+		t.FailNow()
+	}
+
+	// names merely starting with the MSP ID belong to others
+	stub.SetCaller("nsd.nsd")
+	if res := stub.MockApprovedInvoke(putArgs); res.Status != 403 {
+		fmt.Println("Other organization has changed the book: ", res.Status)
+		t.FailNow()
+	}
+	stub.SetCaller("nsd")
+	stub.SetMainOrganization("nsd.nsd.ru.other")
+	if res := stub.MockApprovedInvoke(putArgs); res.Status != 403 {
+		fmt.Println("Organization has changed the book on behalf of another one: ", res.Status)
+		t.FailNow()
+	}
+}
+
+func checkInvoke(t *testing.T, stub *testutils.TestStub, expectedStatus int32, args [][]byte) {
+	res := stub.MockInvoke("1", args)
+	if res.Status != expectedStatus {
+		fmt.Println("Wrong status. Current value: ", res.Status, ", Expected value: ", expectedStatus, ".", res.Message)
+		t.FailNow()
+	}
+}
+
+func checkProposals(t *testing.T, stub *testutils.TestStub, function string) []nsd.Proposal {
+	res := stub.MockInvoke("1", [][]byte{[]byte(function)})
+	var proposals []nsd.Proposal
+	if err := json.Unmarshal(res.Payload, &proposals); res.Status != shim.OK || err != nil {
+		fmt.Println("Cannot query proposals: ", res.Message, err)
+		t.FailNow()
+	}
+	return proposals
+}
+
+// instructionLedger stands for instruction chaincode on an instruction channel, it answers the book
+// with instructions as their parties have recorded them
+type instructionLedger struct {
+	instructions []nsd.Instruction
+}
+
+// record adds instruction given by arguments of move with its status and link group
+func (this *instructionLedger) record(args []string, status, group string, private ...nsd.InstructionPrivate) {
+	instruction := nsd.Instruction{}
+	instruction.FillFromArgs(args)
+	for _, p := range private {
+		instruction.FillPrivate(p)
+	}
+	instruction.Value.Status = status
+	instruction.Value.LinkGroup = group
+	this.instructions = append(this.instructions, instruction)
+}
+
+func (this *instructionLedger) Init(stub shim.ChaincodeStubInterface) pb.Response {
+	return shim.Success(nil)
+}
+
+func (this *instructionLedger) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
+	function, args := stub.GetFunctionAndParameters()
+
+	type memberStatus struct {
+		Id     string `json:"id"`
+		Status string `json:"status"`
+	}
+	members := []memberStatus{}
+	for _, instruction := range this.instructions {
+		compositeKey, err := instruction.ToCompositeKey(stub)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		instruction.Id = nsd.InstructionId(compositeKey)
+
+		if function == "queryById" && instruction.Id == args[0] {
+			data, _ := json.Marshal(instruction)
+			return shim.Success(data)
+		}
+		if function == "groupStatus" && instruction.Value.LinkGroup == args[0] {
+			members = append(members, memberStatus{Id: instruction.Id, Status: instruction.Value.Status})
+		}
+	}
+	if len(members) == 0 {
+		return pb.Response{Status: 404, Message: "Not found."}
+	}
+	data, _ := json.Marshal(map[string]interface{}{"group": args[0], "instructions": members})
+	return shim.Success(data)
+}
+
+// addInstructionLedger registers instruction chaincode the book finds on its instruction channels
+func addInstructionLedger(stub *testutils.TestStub) *instructionLedger {
+	ledger := &instructionLedger{}
+	stub.AddPeerChaincode("instruction", "org1-org2", ledger)
+	return ledger
+}
+
+// instructionChannels is configuration of book checking instructions with addInstructionLedger
+const instructionChannels = `{"instructionChannels": ["org1-org2"]}`
+
+// division and security of instructions made by fopArgs
+const testDivision, testSecurity = "87680000045800005", "RU000ABC0001"
+
+func byteArgs(args ...string) [][]byte {
+	result := [][]byte{}
+	for _, arg := range args {
+		result = append(result, []byte(arg))
+	}
+	return result
+}
+
+// bookEntries makes init argument of book with positions given by account, division, security and quantity each
+func bookEntries(positions ...[4]string) string {
+	entries := []map[string]string{}
+	for _, position := range positions {
+		entries = append(entries, map[string]string{"account": position[0], "division": position[1],
+			"security": position[2], "quantity": position[3]})
+	}
+	data, _ := json.Marshal(map[string]interface{}{"initEntries": entries})
+	return string(data)
+}
+
+// newBook returns book of the main organization initialized with entries and configuration if given
+func newBook(t *testing.T, entries string, config ...string) *testutils.TestStub {
+	stub := testutils.NewTestStub("book", new(BookChaincode))
+	stub.SetMainOrganization("nsd.nsd.ru")
+	stub.SetCaller("nsd.nsd.ru")
+	if res := stub.MockInit("1", byteArgs(append([]string{"init", entries}, config...)...)); res.Status != shim.OK {
+		fmt.Println("Init failed", res.Message)
+		t.FailNow()
+	}
+	return stub
+}
+
+// fopArgs are arguments of FOP instruction moving testSecurity between balances of testDivision
+func fopArgs(from, to, quantity, reference string) []string {
+	return []string{from, testDivision, to, testDivision, testSecurity, quantity, reference,
+		"2018-03-29", "2018-03-29", "fop"}
+}
+
+// checkPosition checks account holds at least quantity of testSecurity in testDivision
+func checkPosition(account, quantity string) [][]byte {
+	return byteArgs("check", account, testDivision, testSecurity, quantity)
+}
+
+func TestBook_MakerChecker(t *testing.T) {
+	stub := testutils.NewTestStub("book", new(BookChaincode))
+	stub.SetMainOrganization("nsd.nsd.ru")
+	stub.SetCaller("nsd.nsd.ru")
+	stub.MockInit("1", [][]byte{[]byte("init"), []byte("{\"initEntries\":[]}")})
+
+	putArgs := [][]byte{[]byte("put"), []byte("AC0689654902"), []byte("87680000045800005"), []byte("RU000ABC0001"), []byte("100")}
+	proposeArgs := [][]byte{[]byte("propose"), []byte("put"),
+		[]byte(`["AC0689654902", "87680000045800005", "RU000ABC0001", "100"]`)}
+	checkArgs := [][]byte{[]byte("check"), []byte("AC0689654902"), []byte("87680000045800005"), []byte("RU000ABC0001"), []byte("90")}
+
+	checkInvoke(t, stub, 403, putArgs)
+	checkInvoke(t, stub, 400, [][]byte{[]byte("propose"), []byte("check"), []byte(`[]`)})
+
+	stub.SetCaller("org1")
+	checkInvoke(t, stub, 403, proposeArgs)
+
+	stub.SetCaller("nsd.nsd.ru")
+	stub.SetCallerName("maker")
+	res := stub.MockInvoke("tx1", proposeArgs)
+	if res.Status != shim.OK || string(res.Payload) != "tx1" {
+		fmt.Println("Cannot propose: ", res.Message)
+		t.FailNow()
+	}
+	if proposals := checkProposals(t, stub, "pending"); len(proposals) != 1 || proposals[0].Proposer != "maker" ||
+		proposals[0].Status != nsd.ProposalPending || len(proposals[0].Args) != 4 {
+		fmt.Println("Wrong pending proposals: ", proposals)
+		t.FailNow()
+	}
+
+	// proposal takes no effect until approved by another identity
+	checkInvoke(t, stub, 404, checkArgs)
+	checkInvoke(t, stub, 403, [][]byte{[]byte("approve"), []byte("tx1")})
+
+	stub.SetCallerName("checker")
+	checkInvoke(t, stub, 404, [][]byte{[]byte("approve"), []byte("tx2")})
+	checkInvoke(t, stub, 200, [][]byte{[]byte("approve"), []byte("tx1")})
+	checkInvoke(t, stub, 200, checkArgs)
+	checkInvoke(t, stub, 409, [][]byte{[]byte("approve"), []byte("tx1")})
+
+	// expired proposal cannot be approved
+	stub.SetCallerName("maker")
+	expiry := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	checkInvoke(t, stub, 400, append(proposeArgs, []byte("2018-01-01T00:00:00Z")))
+	checkInvoke(t, stub, 200, append(proposeArgs, []byte(expiry)))
+
+	stub.SetCallerName("checker")
+	stub.SetTxTime(time.Now().Add(2 * time.Hour))
+	checkInvoke(t, stub, 409, [][]byte{[]byte("approve"), []byte("1")})
+	if proposals := checkProposals(t, stub, "pending"); len(proposals) != 0 {
+		fmt.Println("Expired proposal is pending: ", proposals)
+		t.FailNow()
+	}
+
+	proposals := map[string]nsd.Proposal{}
+	for _, proposal := range checkProposals(t, stub, "proposalHistory") {
+		proposals[proposal.Id] = proposal
+	}
+	if len(proposals) != 2 || proposals["tx1"].Status != nsd.ProposalApproved || proposals["tx1"].Approver != "checker" ||
+		proposals["1"].Status != nsd.ProposalExpired {
+		fmt.Println("Wrong proposal history: ", proposals)
+		t.FailNow()
+	}
+
+	// proposal of a function no longer governed after an upgrade is refused
+	stub.SetTxTime(time.Time{})
+	retired := nsd.Proposal{Id: "tx3", Function: "retired", Args: []string{}, Organization: "nsd.nsd.ru",
+		Proposer: "maker", Status: nsd.ProposalPending, Expires: expiry}
+	stub.MockTransactionStart("retired")
+	key, _ := stub.CreateCompositeKey(nsd.ProposalIndex, []string{retired.Id})
+	value, _ := nsd.MarshalValue(nsd.ProposalIndex, retired)
+	stub.PutState(key, value)
+	stub.MockTransactionEnd("retired")
+	checkInvoke(t, stub, 409, [][]byte{[]byte("approve"), []byte("tx3")})
+}
+
 //TODO: uncomment when package for security changed to  "security"
 //func TestRedeem(t *testing.T) {
 //	sccSecurity := new(security.SecurityChaincode)
@@ -61,4 +356,437 @@ func TestBook_Init(t *testing.T) {
 //	checkState(t, stub, 409, [][]byte{[]byte("check"), []byte("BBB689654902"), []byte("87680000045800005"), []byte("RU000ABC0001"), []byte("90")})
 //	//Second redeem is impossible
 //	checkState(t, stub, 400, [][]byte{[]byte("redeem"), []byte("RU000ABC0001")})
-//}
\ No newline at end of file
+//}
+func TestBook_Balances(t *testing.T) {
+	stub := testutils.NewTestStub("book", new(BookChaincode))
+	stub.SetMainOrganization("nsd.nsd.ru")
+	stub.SetCaller("nsd.nsd.ru")
+	stub.MockInit("1", [][]byte{[]byte("init"), []byte(`{"initEntries":[
+		{"account":"MZ0987654321","division":"19000000000000000","security":"RU000ABC0001","quantity":"100"}],
+		"balances": [{"organization": "org1", "deponent": "DE000001",
+			"balances": [{"account": "MZ0987654321", "division": "19000000000000000"}],
+			"deponents": {"DE000002": [{"account": "MZ0987654321", "division": "22000000000000000"}]}}]}`)})
+
+	organization := func(account, division string) nsd.Organization {
+		res := stub.MockInvoke("1", [][]byte{[]byte("organization"), []byte(account), []byte(division)})
+		var organization nsd.Organization
+		if err := json.Unmarshal(res.Payload, &organization); res.Status != shim.OK || err != nil {
+			fmt.Println("Cannot query organization: ", res.Message, err)
+			t.FailNow()
+		}
+		return organization
+	}
+	if owner := organization("MZ0987654321", "19000000000000000"); owner.Name != "org1" || owner.Deponent != "DE000001" {
+		fmt.Println("Wrong owner of registered balance: ", owner)
+		t.FailNow()
+	}
+	if owner := organization("MZ0987654321", "22000000000000000"); owner.Name != "org1" || owner.Deponent != "DE000002" {
+		fmt.Println("Wrong deponent of balance held under another code: ", owner)
+		t.FailNow()
+	}
+	if owner := organization("30109810000000000000", "044525505"); owner.Name != "" {
+		fmt.Println("Unregistered balance has owner: ", owner)
+		t.FailNow()
+	}
+	checkInvoke(t, stub, 400, [][]byte{[]byte("organization"), []byte("30109810000000000000")})
+
+	// balances are registered with consent of their organization
+	balances := `[{"organization": "org2", "balances": [{"account": "30109810000000000000", "division": "044525505"}]}]`
+	if res := stub.MockAcceptedBalanceChange(stub.MockApprovedInvoke([][]byte{[]byte("addBalances"), []byte(balances)}));
+		res.Status != shim.OK {
+		fmt.Println("Cannot add balances: ", res.Message)
+		t.FailNow()
+	}
+	if owner := organization("30109810000000000000", "044525505"); owner.Name != "org2" {
+		fmt.Println("Added balance is not registered: ", owner)
+		t.FailNow()
+	}
+
+	stub.SetCaller("org2")
+	checkInvoke(t, stub, 403, [][]byte{[]byte("removeBalances"), []byte(balances)})
+
+	// balance holding securities cannot be removed
+	stub.SetCaller("nsd.nsd.ru")
+	res := stub.MockApprovedInvoke([][]byte{[]byte("removeBalances"),
+		[]byte(`[{"organization": "org1", "balances": [{"account": "MZ0987654321", "division": "19000000000000000"}]}]`)})
+	if res.Status != 409 {
+		fmt.Println("Balance holding securities removed: ", res.Status, res.Message)
+		t.FailNow()
+	}
+}
+
+func TestBook_Migrate(t *testing.T) {
+	stub := testutils.NewTestStub("book", new(BookChaincode))
+	stub.SetMainOrganization("nsd.nsd.ru")
+	stub.SetCaller("nsd.nsd.ru")
+	stub.MockInit("1", [][]byte{[]byte("init"), []byte(`{"initEntries":[
+		{"account":"MZ0987654321","division":"19000000000000000","security":"RU000ABC0001","quantity":"100"}],
+		"balances": [{"organization": "org1", "deponent": "DE000001",
+			"balances": [{"account": "MZ0987654321", "division": "19000000000000000"}],
+			"deponents": {"DE000002": [{"account": "MZ0987654321", "division": "22000000000000000"}]}}]}`)})
+	stub.SetCallerName("maker")
+	checkInvoke(t, stub, 200, [][]byte{[]byte("propose"), []byte("put"),
+		[]byte(`["AC0689654902", "87680000045800005", "RU000ABC0001", "100"]`)})
+
+	// values stored before versioning are not in envelope, plain text ones are not JSON strings
+	unversion := func(index string) int {
+		it, _ := stub.GetStateByPartialCompositeKey(index, []string{})
+		values := map[string][]byte{}
+		for it.HasNext() {
+			response, _ := it.Next()
+			var data json.RawMessage
+			if err := nsd.UnmarshalValue(index, response.Value, &data); err != nil {
+				fmt.Println("Cannot read value of ", index, ": ", err)
+				t.FailNow()
+			}
+			var text string
+			if json.Unmarshal(data, &text) == nil {
+				data = json.RawMessage(text)
+			}
+			values[response.Key] = data
+		}
+		it.Close()
+
+		stub.MockTransactionStart("legacy")
+		for key, value := range values {
+			stub.PutState(key, value)
+		}
+		stub.MockTransactionEnd("legacy")
+		return len(values)
+	}
+	legacy := 0
+	for _, index := range []string{bookIndex, nsd.ProposalIndex, nsd.OrganizationIndex, nsd.AuthenticationIndex,
+		nsd.BalanceDeponentIndex} {
+		legacy += unversion(index)
+	}
+
+	check := func() {
+		checkInvoke(t, stub, 200, [][]byte{[]byte("check"), []byte("MZ0987654321"), []byte("19000000000000000"),
+			[]byte("RU000ABC0001"), []byte("90")})
+		if proposals := checkProposals(t, stub, "pending"); len(proposals) != 1 || len(proposals[0].Args) != 4 {
+			fmt.Println("Wrong pending proposals: ", proposals)
+			t.FailNow()
+		}
+		res := stub.MockInvoke("1", [][]byte{[]byte("organization"), []byte("MZ0987654321"),
+			[]byte("22000000000000000")})
+		var owner nsd.Organization
+		if err := json.Unmarshal(res.Payload, &owner); err != nil || owner.Name != "org1" || owner.Deponent != "DE000002" {
+			fmt.Println("Wrong owner of balance: ", owner, res.Message)
+			t.FailNow()
+		}
+	}
+	// values are read in any version
+	check()
+
+	stub.SetCaller("org1")
+	if _, res := stub.MockMigration(2); res.Status != 403 {
+		fmt.Println("Migration is allowed to another organization: ", res.Status)
+		t.FailNow()
+	}
+
+	stub.SetCaller("nsd.nsd.ru")
+	if migrated, res := stub.MockMigration(2); res.Status != shim.OK || migrated != legacy {
+		fmt.Println("Unexpected migration: ", migrated, res.Message)
+		t.FailNow()
+	}
+
+	res := stub.MockInvoke("1", [][]byte{[]byte("schemaStatus")})
+	var status []struct {
+		Index   string         `json:"index"`
+		Records map[string]int `json:"records"`
+	}
+	if err := json.Unmarshal(res.Payload, &status); err != nil || len(status) != len(schemaIndexes) {
+		fmt.Println("Unexpected schema status: ", string(res.Payload))
+		t.FailNow()
+	}
+	for _, s := range status {
+		for version := range s.Records {
+			if version != "1" {
+				fmt.Println("Values of ", s.Index, " are not migrated: ", s.Records)
+				t.FailNow()
+			}
+		}
+	}
+	check()
+}
+
+func TestBook_MoveGroup(t *testing.T) {
+	entries := bookEntries([4]string{"AC0689654902", testDivision, testSecurity, "100"})
+	stub := newBook(t, entries)
+
+	moveGroup := func(group string, instructions ...[]string) [][]byte {
+		data, _ := json.Marshal(instructions)
+		return byteArgs("move", group, string(data))
+	}
+
+	ledger := addInstructionLedger(stub)
+	ledger.record(fopArgs("AC0689654902", "AC0000000001", "60", "REF1"), nsd.InstructionMatched, "group1")
+	ledger.record(fopArgs("AC0000000001", "AC0000000002", "20", "REF2"), nsd.InstructionSigned, "group1")
+	ledger.record(fopArgs("AC0689654902", "AC0000000001", "60", "REF3"), nsd.InstructionMatched, "group2")
+	ledger.record(fopArgs("AC0689654902", "AC0000000001", "50", "REF4"), nsd.InstructionMatched, "group2")
+	ledger.record(fopArgs("AC0689654902", "AC0000000002", "10", "REF5"), nsd.InstructionMatched, "group3")
+	ledger.record(fopArgs("AC0689654902", "AC0000000002", "10", "REF6"), nsd.InstructionInitiated, "group3")
+
+	// groups are settled as instruction chaincode records them, none is found until instruction channels are configured
+	group := moveGroup("group1", fopArgs("AC0689654902", "AC0000000001", "60", "REF1"),
+		fopArgs("AC0000000001", "AC0000000002", "20", "REF2"))
+	checkInvoke(t, stub, 404, group)
+	stub.MockInit("1", byteArgs("init", entries, instructionChannels))
+
+	// every instruction of the group is to be given and matched
+	checkInvoke(t, stub, 404, moveGroup("group4", fopArgs("AC0689654902", "AC0000000001", "60", "REF1")))
+	checkInvoke(t, stub, 400, moveGroup("group1", fopArgs("AC0689654902", "AC0000000001", "60", "REF1")))
+	checkInvoke(t, stub, 400, moveGroup("group1", fopArgs("AC0689654902", "AC0000000001", "60", "REF1"),
+		fopArgs("AC0689654902", "AC0000000001", "60", "REF3")))
+	checkInvoke(t, stub, 406, moveGroup("group3", fopArgs("AC0689654902", "AC0000000002", "10", "REF5"),
+		fopArgs("AC0689654902", "AC0000000002", "10", "REF6")))
+
+	// instruction of the group does not settle alone
+	checkInvoke(t, stub, 409, byteArgs(append([]string{"move"}, fopArgs("AC0689654902", "AC0000000001", "60", "REF1")...)...))
+
+	// the second instruction fails, so the first one is not settled either
+	checkInvoke(t, stub, 409, moveGroup("group2", fopArgs("AC0689654902", "AC0000000001", "60", "REF3"),
+		fopArgs("AC0689654902", "AC0000000001", "50", "REF4")))
+	checkInvoke(t, stub, 404, checkPosition("AC0000000001", "1"))
+
+	// the second instruction moves securities received by the first one
+	checkInvoke(t, stub, shim.OK, group)
+	checkInvoke(t, stub, shim.OK, checkPosition("AC0689654902", "40"))
+	checkInvoke(t, stub, 409, checkPosition("AC0689654902", "41"))
+	checkInvoke(t, stub, shim.OK, checkPosition("AC0000000001", "40"))
+	checkInvoke(t, stub, 409, checkPosition("AC0000000001", "41"))
+	checkInvoke(t, stub, shim.OK, checkPosition("AC0000000002", "20"))
+
+	checkInvoke(t, stub, 202, group)
+	checkInvoke(t, stub, 409, moveGroup("group1", fopArgs("AC0689654902", "AC0000000001", "60", "REF1"),
+		fopArgs("AC0689654902", "AC0000000002", "10", "REF3")))
+}
+
+func TestBook_SettleBatch(t *testing.T) {
+	stub := newBook(t, bookEntries([4]string{"AC0689654902", testDivision, testSecurity, "100"},
+		[4]string{"AC0000000001", testDivision, "RU000ABC0002", "10"},
+		[4]string{"RC0000000001", "", "RUB", "20000"}), instructionChannels)
+
+	settleBatch := func(instructions ...[]string) [][]byte {
+		data, _ := json.Marshal(instructions)
+		return byteArgs("settleBatch", string(data))
+	}
+
+	ledger := addInstructionLedger(stub)
+	ledger.record(fopArgs("AC0000000001", "AC0689654902", "150", "REF1"), nsd.InstructionMatched, "")
+	ledger.record(fopArgs("AC0000000001", "AC0689654902", "80", "REF1"), nsd.InstructionMatched, "")
+	ledger.record(fopArgs("AC0689654902", "AC0000000001", "100", "REF2"), nsd.InstructionDownloaded, "")
+	ledger.record(fopArgs("AC0689654902", "AC0000000001", "10", "REF3"), nsd.InstructionMatched, "group1")
+	ledger.record(fopArgs("AC0689654902", "AC0000000001", "10", "REF4"), nsd.InstructionInitiated, "")
+	ledger.record(fopArgs("AC0689654902", "AC0000000001", "0", "REF5"), nsd.InstructionMatched, "")
+	dvp := append(fopArgs("AC0689654902", "AC0000000001", "10", "REF7"), "RUB")
+	dvp[9] = nsd.InstructionTypeDVP
+	private := nsd.InstructionPrivate{TransfererRequisites: nsd.Requisites{Account: "TR0000000001", Bic: "044525505"},
+		ReceiverRequisites: nsd.Requisites{Account: "RC0000000001", Bic: "044525505"}, PaymentAmount: "100.5",
+		Salt: "0123456789abcdef"}
+	ledger.record(dvp, nsd.InstructionMatched, "", private)
+
+	// instruction of link group settles only with the group
+	checkInvoke(t, stub, 409, settleBatch(fopArgs("AC0000000001", "AC0689654902", "80", "REF1"),
+		fopArgs("AC0689654902", "AC0000000001", "10", "REF3")))
+	// instructions are settled only once their parties have matched them
+	checkInvoke(t, stub, 404, settleBatch(fopArgs("AC0000000001", "AC0689654902", "80", "REF1"),
+		fopArgs("AC0689654902", "AC0000000001", "10", "REF6")))
+	checkInvoke(t, stub, 406, settleBatch(fopArgs("AC0000000001", "AC0689654902", "80", "REF1"),
+		fopArgs("AC0689654902", "AC0000000001", "10", "REF4")))
+	// quantities are whole units of the book
+	checkInvoke(t, stub, 400, settleBatch(fopArgs("AC0000000001", "AC0689654902", "80", "REF1"),
+		fopArgs("AC0689654902", "AC0000000001", "0", "REF5")))
+
+	// net position of the second balance is not covered
+	checkInvoke(t, stub, 404, settleBatch(fopArgs("AC0000000001", "AC0689654902", "150", "REF1"),
+		fopArgs("AC0689654902", "AC0000000001", "100", "REF2")))
+	checkInvoke(t, stub, 400, settleBatch(fopArgs("AC0689654902", "AC0000000001", "100", "REF2"),
+		fopArgs("AC0689654902", "AC0000000001", "100", "REF2")))
+
+	// the second balance delivers before it receives, only 20 move in net
+	res := stub.MockInvoke("2", settleBatch(fopArgs("AC0000000001", "AC0689654902", "80", "REF1"),
+		fopArgs("AC0689654902", "AC0000000001", "100", "REF2")))
+	var settlement struct {
+		Batch     string `json:"batch"`
+		Movements []struct {
+			Account  string `json:"account"`
+			Quantity int    `json:"quantity"`
+		} `json:"movements"`
+	}
+	if err := json.Unmarshal(res.Payload, &settlement); res.Status != shim.OK || err != nil ||
+		len(settlement.Movements) != 2 || settlement.Movements[0].Account != "AC0000000001" ||
+		settlement.Movements[0].Quantity != 20 || settlement.Movements[1].Quantity != -20 {
+		fmt.Println("Wrong net settlement: ", res.Message, settlement)
+		t.FailNow()
+	}
+
+	checkInvoke(t, stub, shim.OK, checkPosition("AC0689654902", "80"))
+	checkInvoke(t, stub, 409, checkPosition("AC0689654902", "81"))
+	checkInvoke(t, stub, shim.OK, checkPosition("AC0000000001", "20"))
+	checkInvoke(t, stub, 409, checkPosition("AC0000000001", "21"))
+
+	for _, args := range [][]string{fopArgs("AC0000000001", "AC0689654902", "80", "REF1"),
+		fopArgs("AC0689654902", "AC0000000001", "100", "REF2")} {
+		executed := nsd.Instruction{}
+		executed.FillFromArgs(args)
+		if err := executed.LoadFrom(stub); err != nil || executed.Value.Status != nsd.InstructionExecuted ||
+			executed.Value.SettlementBatch != settlement.Batch {
+			fmt.Println("Instruction is not executed in the batch: ", executed.Key.Reference, executed.Value)
+			t.FailNow()
+		}
+	}
+
+	checkInvoke(t, stub, 409, settleBatch(fopArgs("AC0689654902", "AC0000000001", "100", "REF2")))
+
+	// payment amounts are netted in minor units of the currency the book keeps money in
+	data, _ := json.Marshal([]*nsd.InstructionPrivate{&private})
+	stub.SetTransient(map[string][]byte{nsd.InstructionTransientKey: data})
+	checkInvoke(t, stub, shim.OK, settleBatch(dvp))
+	checkInvoke(t, stub, shim.OK, byteArgs("check", "TR0000000001", "", "RUB", "10050"))
+	checkInvoke(t, stub, 409, byteArgs("check", "TR0000000001", "", "RUB", "10051"))
+	checkInvoke(t, stub, shim.OK, byteArgs("check", "RC0000000001", "", "RUB", "9950"))
+}
+
+func TestBook_MovePartially(t *testing.T) {
+	stub := newBook(t, bookEntries([4]string{"AC0689654902", testDivision, testSecurity, "40"},
+		[4]string{"RC0000000001", "", "RUB", "100000"}), instructionChannels)
+
+	instruction := []string{"AC0689654902", testDivision, "AC0000000001", testDivision,
+		testSecurity, "100", "REF1", "2018-03-29", "2018-03-29", "dvp", "RUB"}
+	private := nsd.InstructionPrivate{TransfererRequisites: nsd.Requisites{Account: "TR0000000001", Bic: "044525505"},
+		ReceiverRequisites: nsd.Requisites{Account: "RC0000000001", Bic: "044525505"}, PaymentAmount: "1000",
+		Salt: "0123456789abcdef"}
+	transient := func(private nsd.InstructionPrivate) map[string][]byte {
+		data, _ := json.Marshal(private)
+		return map[string][]byte{nsd.InstructionTransientKey: data}
+	}
+	stub.SetTransient(transient(private))
+
+	remainderArgs := append([]string{}, instruction...)
+	remainderArgs[5] = "60"
+	remainderPrivate := private
+	remainderPrivate.PaymentAmount = "600.00"
+	ledger := addInstructionLedger(stub)
+	ledger.record(instruction, nsd.InstructionMatched, "", private)
+	ledger.record(remainderArgs, nsd.InstructionMatched, "", remainderPrivate)
+
+	move := func(args ...string) [][]byte {
+		return byteArgs(append(append([]string{"move"}, instruction...), args...)...)
+	}
+
+	// requisites and payment amount are passed only in transient data
+	stub.SetTransient(nil)
+	checkInvoke(t, stub, 400, move())
+	stub.SetTransient(transient(private))
+
+	// without the flag the whole quantity is required
+	checkInvoke(t, stub, 409, move())
+
+	// both parties are to allow partial settlement in instruction chaincode
+	checkInvoke(t, stub, 403, move("partial"))
+	ledger.instructions[0].Value.PartialSettlementFrom = true
+	checkInvoke(t, stub, 403, move("partial"))
+	ledger.instructions[0].Value.PartialSettlementTo = true
+
+	res := stub.MockInvoke("2", move("partial"))
+	if res.Status != shim.OK {
+		fmt.Println("Partial settlement failed: ", res.Message)
+		t.FailNow()
+	}
+	checkInvoke(t, stub, shim.OK, checkPosition("AC0000000001", "40"))
+	checkInvoke(t, stub, 409, checkPosition("AC0000000001", "41"))
+	// money is kept in minor units of the currency
+	checkInvoke(t, stub, shim.OK, byteArgs("check", "TR0000000001", "", "RUB", "40000"))
+	checkInvoke(t, stub, 409, byteArgs("check", "TR0000000001", "", "RUB", "40001"))
+
+	parent := nsd.Instruction{}
+	parent.FillFromArgs(instruction)
+	parent.FillPrivate(private)
+	if err := parent.LoadFrom(stub); err != nil || parent.Value.Status != nsd.InstructionPartiallyExecuted ||
+		parent.Value.SettledQuantity != "40" || parent.Value.SettledAmount != "400.00" ||
+		parent.Value.Remainder != string(res.Payload) {
+		fmt.Println("Instruction is not executed partially: ", parent.Value)
+		t.FailNow()
+	}
+
+	// instruction chaincode records partial settlement as the book reports it
+	compositeKey, _ := parent.ToCompositeKey(stub)
+	res = stub.MockInvoke("3", byteArgs("settlement", nsd.InstructionId(compositeKey)))
+	settled := nsd.Instruction{}
+	if err := json.Unmarshal(res.Payload, &settled); res.Status != shim.OK || err != nil ||
+		settled.Value.SettledQuantity != "40" || settled.Value.Remainder != parent.Value.Remainder {
+		fmt.Println("Wrong settlement of instruction: ", res.Message, settled.Value)
+		t.FailNow()
+	}
+	checkInvoke(t, stub, 404, byteArgs("settlement", "unknown"))
+
+	remainder := nsd.Instruction{}
+	remainder.FillFromArgs(remainderArgs)
+	remainder.FillPrivate(remainderPrivate)
+	if err := remainder.LoadFrom(stub); err != nil || remainder.Value.Status != nsd.InstructionMatched ||
+		remainder.Value.Parent == "" {
+		fmt.Println("Remainder is not matched: ", remainder.Value)
+		t.FailNow()
+	}
+
+	checkInvoke(t, stub, 202, move("partial"))
+	// nothing is left to the transferer, the remainder keeps consent of the parties
+	ledger.instructions[1].Value.PartialSettlementFrom = true
+	ledger.instructions[1].Value.PartialSettlementTo = true
+	stub.SetTransient(transient(remainderPrivate))
+	checkInvoke(t, stub, 409, byteArgs(append(append([]string{"move"}, remainderArgs...), "partial")...))
+}
+
+func TestBook_MoveLegacyDvp(t *testing.T) {
+	stub := newBook(t, bookEntries([4]string{"AC0689654902", testDivision, testSecurity, "100"},
+		[4]string{"RC0000000001", "", "RUB", "100000"}), instructionChannels)
+
+	instruction := []string{"AC0689654902", testDivision, "AC0000000001", testDivision,
+		testSecurity, "10", "REF1", "2018-03-29", "2018-03-29", "dvp", "RUB"}
+	private := nsd.InstructionPrivate{TransfererRequisites: nsd.Requisites{Account: "TR0000000001", Bic: "044525505"},
+		ReceiverRequisites: nsd.Requisites{Account: "RC0000000001", Bic: "044525505"}, PaymentAmount: "1000"}
+	data, _ := json.Marshal(private)
+	stub.SetTransient(map[string][]byte{nsd.InstructionTransientKey: data})
+
+	// instruction chaincode keeps the key with requisites and payment amount of instruction stored before
+	// they were moved out of it, and its id
+	ledger := addInstructionLedger(stub)
+	ledger.record(instruction, nsd.InstructionMatched, "", private)
+	ledger.instructions[0].Key.PrivateHash = ""
+
+	checkInvoke(t, stub, shim.OK, byteArgs(append([]string{"move"}, instruction...)...))
+	checkInvoke(t, stub, shim.OK, checkPosition("AC0000000001", "10"))
+}
+
+func TestBook_SettlementDate(t *testing.T) {
+	stub := newBook(t, bookEntries([4]string{"AC0689654902", testDivision, testSecurity, "100"}), instructionChannels)
+
+	// traded on Friday, settles on Tuesday as instruction chaincode has recorded on matching
+	instruction := fopArgs("AC0689654902", "AC0000000001", "10", "REF1")
+	instruction[7], instruction[8] = "2018-03-30", "2018-03-30"
+	ledger := addInstructionLedger(stub)
+	ledger.record(instruction, nsd.InstructionMatched, "")
+	ledger.instructions[0].Value.SettlementDate = "2018-04-03"
+	move := byteArgs(append([]string{"move"}, instruction...)...)
+
+	// the recorded date holds though the calendar would settle it earlier now
+	stub.SetTxTime(time.Date(2018, 4, 2, 12, 0, 0, 0, time.UTC))
+	checkInvoke(t, stub, 406, move)
+	checkInvoke(t, stub, 404, checkPosition("AC0000000001", "1"))
+
+	stub.SetTxTime(time.Date(2018, 4, 3, 12, 0, 0, 0, time.UTC))
+	checkInvoke(t, stub, shim.OK, move)
+
+	// settlement date of instruction matched before dates were recorded is found by the calendar of security chaincode
+	legacy := fopArgs("AC0689654902", "AC0000000001", "10", "REF2")
+	legacy[7], legacy[8] = "2018-03-30", "2018-03-30"
+	ledger.record(legacy, nsd.InstructionMatched, "")
+	stub.SetCalendar(`{"settlementCycle": 1, "holidays": ["2018-04-02"]}`)
+	move = byteArgs(append([]string{"move"}, legacy...)...)
+
+	stub.SetTxTime(time.Date(2018, 4, 2, 12, 0, 0, 0, time.UTC))
+	checkInvoke(t, stub, 406, move)
+	stub.SetTxTime(time.Date(2018, 4, 3, 12, 0, 0, 0, time.UTC))
+	checkInvoke(t, stub, shim.OK, move)
+}
@@ -2,7 +2,12 @@ package main
 
 import (
 	"encoding/json"
+	"encoding/xml"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"sort"
 	"strconv"
 	"strings"
 	"text/template"
@@ -13,26 +18,66 @@ import (
 	pb "github.com/hyperledger/fabric/protos/peer"
 	"github.com/Altoros/nsd-commercial-paper-common"
 	"github.com/Altoros/nsd-commercial-paper-common/certificates"
+	"github.com/Altoros/nsd-commercial-paper-common/identity"
 )
 
 var logger = shim.NewLogger("InstructionChaincode")
 
 const (
-	authenticationIndex = `Authentication`
 	referenceIndex = `Reference`
 	instructionIdIndex = `InstructionId`
+	limitsIndex = `Limits`
+	alamedaTemplateIndex = `AlamedaTemplate`
 )
 
+// indexes of values versioned by nsd schemas, see migrate
+var schemaIndexes = append([]string{nsd.InstructionIndex, nsd.InstructionKeyIndex, limitsIndex, alamedaTemplateIndex},
+	nsd.CommonSchemaIndexes...)
+
+func init() {
+	nsd.RegisterSchema(nsd.Schema{Index: limitsIndex, Version: 1, Upgrades: map[int]nsd.Upgrade{0: nsd.Unversioned}})
+	nsd.RegisterSchema(nsd.Schema{Index: alamedaTemplateIndex, Version: 1,
+		Upgrades: map[int]nsd.Upgrade{0: nsd.Unversioned}})
+}
+
 // TODO: think about making these constants public in nsd.go
 // args base lengths
 const (
 	fopArgsLength = 10
-	dvpArgsLength = 16
+	// requisites and payment amount of DVP instruction are passed in transient data, see nsd.InstructionTransientKey
+	dvpArgsLength = 11
+	// DVP arguments followed by the closing date and repo rate
+	repoArgsLength = dvpArgsLength + 2
 )
 
 type InstructionChaincode struct {
 }
 
+// AlamedaTemplate is a version of text/template of Alameda documents of one side of instructions of a type
+type AlamedaTemplate struct {
+	Type     string `json:"type"`
+	Side     string `json:"side"`
+	Version  int    `json:"version"`
+	Template string `json:"template"`
+}
+
+// Limits are rules the main organization sets for instructions of an organization, an empty rule imposes no restriction
+type Limits struct {
+	Organization   string   `json:"organization"`
+	Counterparties []string `json:"counterparties,omitempty"`
+	Securities     []string `json:"securities,omitempty"`
+	MaxQuantity    int      `json:"maxQuantity,omitempty"`
+	// maximum total payment amount of DVP instructions submitted the same day, by currency
+	MaxDailyDvp map[string]nsd.Amount `json:"maxDailyDvp,omitempty"`
+}
+
+// LimitsUsage is the result of limits query: limits along with DVP amounts already instructed on date
+type LimitsUsage struct {
+	Limits
+	Date     string                `json:"date"`
+	DailyDvp map[string]nsd.Amount `json:"dailyDvp"`
+}
+
 // **** Instruction Methods **** //
 
 func matchIf(this *nsd.Instruction, stub shim.ChaincodeStubInterface,
@@ -50,12 +95,14 @@ func matchIf(this *nsd.Instruction, stub shim.ChaincodeStubInterface,
 	}
 
 	this.Value.Status = nsd.InstructionMatched
+	if response := setSettlementDate(stub, this); response.Status != shim.OK {
+		return response
+	}
 
-	if this.Key.Type == nsd.InstructionTypeFOP {
-		this.Value.AlamedaFrom, this.Value.AlamedaTo = createAlamedaFopXMLs(this)
-	} else { // nsd.InstructionTypeDvp
-		this.Value.AlamedaFrom, this.Value.AlamedaTo = createAlamedaDvpXMLs(this)
+	if err := createAlamedaXMLs(stub, this); err != nil {
+		return pb.Response{Status: 500, Message: "Cannot create Alameda documents: " + err.Error()}
 	}
+	this.Value.Sese023From, this.Value.Sese023To = createSese023XMLs(this)
 
 	if err := this.UpsertIn(stub); err != nil {
 		return pb.Response{Status: 500, Message: "Persistence failure."}
@@ -65,211 +112,671 @@ func matchIf(this *nsd.Instruction, stub shim.ChaincodeStubInterface,
 		return pb.Response{Status: 500, Message: "Event emission failure."}
 	}
 
+	return shim.Success([]byte(this.Id))
+}
+
+// setSettlementDate sets settlement date of instruction by the calendar "security" chaincode keeps,
+// the book settles instruction on the date recorded here
+func setSettlementDate(stub shim.ChaincodeStubInterface, this *nsd.Instruction) pb.Response {
+	calendar, err := nsd.GetCalendar(stub)
+	if err != nil {
+		return pb.Response{Status: 500, Message: "Unable to get calendar: " + err.Error()}
+	}
+
+	this.Value.SettlementDate, err = calendar.SettlementDate(this.Key)
+	if err != nil {
+		return pb.Response{Status: 400, Message: err.Error()}
+	}
 	return shim.Success(nil)
 }
 
-func createAlamedaFopXMLs(this *nsd.Instruction) (string, string) {
-	const xmlTemplate = `<?xml version="1.0" encoding="Windows-1251"?>
+// functions of Alameda templates, xml escapes user supplied values which text/template prints as is
+var alamedaFuncs = template.FuncMap{
+	"xml": func(value string) (string, error) {
+		buf := new(bytes.Buffer)
+		if err := xml.EscapeText(buf, []byte(value)); err != nil {
+			return "", err
+		}
+		return buf.String(), nil
+	},
+	// executeDate is the beginning of the date
+	"executeDate": func(date string) string {
+		d, _ := time.Parse("2006-01-02", date)
+		return d.Format("2006-01-02 15:04:05")
+	},
+	// expirationDate is the end of the day days after the date
+	"expirationDate": func(date string, days int) string {
+		d, _ := time.Parse("2006-01-02", date)
+		return d.AddDate(0, 0, days).Add(time.Hour*23 + time.Minute*59 + time.Second*59).Format("2006-01-02 15:04:05")
+	},
+}
+
+// code of NSD in Alameda documents
+const alamedaDepositary = "NDC000000000"
+
+// Alameda accepts documents in Windows-1251 only, they are kept in the ledger in UTF-8
+const alamedaDeclaration = `<?xml version="1.0" encoding="UTF-8"?>`
+const alamedaExportDeclaration = `<?xml version="1.0" encoding="Windows-1251"?>`
+
+// characters of Windows-1251 from 0x80 to 0xBF, 0x98 is not used,
+// those from 0xC0 to 0xFF are the Cyrillic letters from U+0410 to U+044F
+var windows1251High = []rune("ЂЃ‚ѓ„…†‡€‰Љ‹ЊЌЋЏђ‘’“”•–—\uFFFD™љ›њќћџ\u00A0ЎўЈ¤Ґ¦§Ё©Є«¬\u00AD®Ї°±Ііґµ¶·ё№є»јЅѕї")
+
+// toWindows1251 encodes text in Windows-1251, characters it lacks are replaced with "?"
+func toWindows1251(text string) []byte {
+	encoded := make([]byte, 0, len(text))
+	for _, r := range text {
+		if r < 0x80 {
+			encoded = append(encoded, byte(r))
+			continue
+		}
+		if r >= 0x410 && r <= 0x44F {
+			encoded = append(encoded, byte(r-0x410+0xC0))
+			continue
+		}
+
+		c := byte('?')
+		for i, high := range windows1251High {
+			if high == r && r != '\uFFFD' {
+				c = byte(0x80 + i)
+				break
+			}
+		}
+		encoded = append(encoded, c)
+	}
+	return encoded
+}
+
+// fromWindows1251 decodes text in Windows-1251
+func fromWindows1251(encoded []byte) string {
+	decoded := make([]rune, 0, len(encoded))
+	for _, c := range encoded {
+		switch {
+		case c < 0x80:
+			decoded = append(decoded, rune(c))
+		case c < 0xC0:
+			decoded = append(decoded, windows1251High[c-0x80])
+		default:
+			decoded = append(decoded, rune(c)-0xC0+0x410)
+		}
+	}
+	return string(decoded)
+}
+
+// exportAlamedaXML makes Alameda document stored in the ledger ready to be sent to Alameda
+func exportAlamedaXML(document string) []byte {
+	return toWindows1251(strings.Replace(document, alamedaDeclaration, alamedaExportDeclaration, 1))
+}
+
+// alamedaResponse is a document of response of Alameda to an instruction of a member:
+// either report on its execution or its rejection with the reason
+type alamedaResponse struct {
+	XMLName         xml.Name `xml:"Batch"`
+	DocumentsAmount int      `xml:"Documents_amount"`
+	Documents       []struct {
+		Depositary    string           `xml:"ORDER_HEADER>deposit_c"`
+		Contragent    string           `xml:"ORDER_HEADER>contrag_c"`
+		InstructionID string           `xml:"ORDER_HEADER>contr_d_id"`
+		Execution     *alamedaDecision `xml:"EXECUTION"`
+		Rejection     *alamedaDecision `xml:"REJECTION"`
+	} `xml:"Document"`
+}
+
+type alamedaDecision struct {
+	Reference  string `xml:"deal_reference"`
+	ReasonCode string `xml:"reason_c"`
+	Reason     string `xml:"reason"`
+}
+
+// parseAlamedaResponse reads and validates response of Alameda in UTF-8 or Windows-1251,
+// returns its only document
+func parseAlamedaResponse(document []byte) (alamedaResponse, error) {
+	var response alamedaResponse
+
+	decoder := xml.NewDecoder(bytes.NewReader(document))
+	decoder.CharsetReader = func(charset string, input io.Reader) (io.Reader, error) {
+		if !strings.EqualFold(charset, "Windows-1251") {
+			return nil, fmt.Errorf("unsupported encoding %s", charset)
+		}
+		encoded, err := ioutil.ReadAll(input)
+		if err != nil {
+			return nil, err
+		}
+		return strings.NewReader(fromWindows1251(encoded)), nil
+	}
+	if err := decoder.Decode(&response); err != nil {
+		return response, err
+	}
+
+	if response.DocumentsAmount != 1 || len(response.Documents) != 1 {
+		return response, fmt.Errorf("response must have one document")
+	}
+	header := response.Documents[0]
+	if header.Depositary != alamedaDepositary {
+		return response, fmt.Errorf("response is not from depositary %s", alamedaDepositary)
+	}
+	if header.Contragent == "" || header.InstructionID == "" {
+		return response, fmt.Errorf("contrag_c and contr_d_id are required")
+	}
+	if (header.Execution == nil) == (header.Rejection == nil) {
+		return response, fmt.Errorf("response must be either execution or rejection")
+	}
+	if decision := alamedaDecisionOf(response); decision.Reference == "" {
+		return response, fmt.Errorf("deal_reference is required")
+	}
+	return response, nil
+}
+
+// alamedaDecisionOf tells the execution or the rejection of the response
+func alamedaDecisionOf(response alamedaResponse) alamedaDecision {
+	if response.Documents[0].Execution != nil {
+		return *response.Documents[0].Execution
+	}
+	return *response.Documents[0].Rejection
+}
+
+// alamedaFopTemplate is the default template of Alameda MF010 document of FOP instruction
+func alamedaFopTemplate(operationCode string) string {
+	return `<?xml version="1.0" encoding="UTF-8"?>
 <Batch>
 <Documents_amount>1</Documents_amount>
 <Document DOC_ID="1" version="7">
 <ORDER_HEADER>
-<deposit_c>{{.Depositary}}</deposit_c>
-<contrag_c>{{.Initiator}}</contrag_c>
-<contr_d_id>{{.InstructionID}}</contr_d_id>
-<createdate>{{.Instruction.Key.InstructionDate}}</createdate>
-<order_t_id>{{.OperationCode}}</order_t_id>
-<execute_dt>{{.InstructionDate}}</execute_dt>
-<expirat_dt>{{.ExpirationDate}}</expirat_dt>
+<deposit_c>` + alamedaDepositary + `</deposit_c>
+<contrag_c>{{xml .Initiator}}</contrag_c>
+<contr_d_id>{{xml .InstructionID}}</contr_d_id>
+<createdate>{{xml .Instruction.Key.InstructionDate}}</createdate>
+<order_t_id>` + operationCode + `</order_t_id>
+<execute_dt>{{executeDate .Instruction.Key.InstructionDate}}</execute_dt>
+<expirat_dt>{{expirationDate .Instruction.Key.InstructionDate 29}}</expirat_dt>
 </ORDER_HEADER>
 <MF010>
-<dep_acc_c>{{.Instruction.Key.Transferer.Account}}</dep_acc_c>
-<sec_c>{{.Instruction.Key.Transferer.Division}}</sec_c>
-<deponent_c>{{.Instruction.Value.DeponentFrom}}</deponent_c>
-<corr_acc_c>{{.Instruction.Key.Receiver.Account}}</corr_acc_c>
-<corr_sec_c>{{.Instruction.Key.Receiver.Division}}</corr_sec_c>
-<corr_code>{{.Instruction.Value.DeponentTo}}</corr_code>
-{{if .ReasonExists}}{{with .Reason.Description -}}<based_on>{{.}}</based_on>{{end}}
-{{with .Reason.Document -}}<based_numb>{{.}}</based_numb>{{end}}
-{{with .Reason.DocumentDate -}}<based_date>{{.}}</based_date>{{end}}{{end}}
+<dep_acc_c>{{xml .Instruction.Key.Transferer.Account}}</dep_acc_c>
+<sec_c>{{xml .Instruction.Key.Transferer.Division}}</sec_c>
+<deponent_c>{{xml .Instruction.Value.DeponentFrom}}</deponent_c>
+<corr_acc_c>{{xml .Instruction.Key.Receiver.Account}}</corr_acc_c>
+<corr_sec_c>{{xml .Instruction.Key.Receiver.Division}}</corr_sec_c>
+<corr_code>{{xml .Instruction.Value.DeponentTo}}</corr_code>
+{{if and .Reason.Document .Reason.Description .Reason.DocumentDate}}{{with .Reason.Description -}}<based_on>{{xml .}}</based_on>{{end}}
+{{with .Reason.Document -}}<based_numb>{{xml .}}</based_numb>{{end}}
+{{with .Reason.DocumentDate -}}<based_date>{{xml .}}</based_date>{{end}}{{end}}
 <securities>
 <security>
-<security_c>{{.Instruction.Key.Security}}</security_c>
-<security_q>{{.Instruction.Key.Quantity}}</security_q>
+<security_c>{{xml .Instruction.Key.Security}}</security_c>
+<security_q>{{xml .Instruction.Key.Quantity}}</security_q>
 </security>
 </securities>
-<deal_reference>{{.Reference}}</deal_reference>
-<date_deal>{{.Instruction.Key.TradeDate}}</date_deal>
+<deal_reference>{{xml .Reference}}</deal_reference>
+<date_deal>{{xml .Instruction.Key.TradeDate}}</date_deal>
 </MF010>
 </Document>
 </Batch>`
-
-	type InstructionWrapper struct {
-		Instruction     nsd.Instruction
-		Depositary      string
-		Initiator       string
-		InstructionID   string
-		OperationCode   string
-		InstructionDate string
-		ExpirationDate  string
-		ReasonExists    bool
-		Reason          nsd.Reason
-		Reference       string
-	}
-
-	dateLayout := "2006-01-02"
-	instructionDate, _ := time.Parse(dateLayout, this.Key.InstructionDate)
-	expirationDate := instructionDate
-	expirationDate = expirationDate.Truncate(time.Hour * 24).Add(time.Hour*(29*24+23) + time.Minute*59 + time.Second*59)
-
-	instructionWrapper := InstructionWrapper{
-		Instruction:     *this,
-		Depositary:      "NDC000000000",
-		Initiator:       this.Value.DeponentFrom,
-		InstructionID:   this.Value.MemberInstructionIdFrom,
-		OperationCode:   "16",
-		InstructionDate: instructionDate.Format("2006-01-02 15:04:05"),
-		ExpirationDate:  expirationDate.Format("2006-01-02 15:04:05"),
-		Reason:          this.Value.ReasonFrom,
-		Reference:       strings.ToUpper(this.Key.Reference),
-	}
-	instructionWrapper.ReasonExists = (instructionWrapper.Reason.Document != "") && (instructionWrapper.Reason.Description != "") && (instructionWrapper.Reason.DocumentDate != "")
-
-	t := template.Must(template.New("xmlTemplate").Parse(xmlTemplate))
-
-	buf := new(bytes.Buffer)
-	t.Execute(buf, instructionWrapper)
-	alamedaFrom := buf.String()
-
-	buf.Reset()
-	instructionWrapper.OperationCode = "16/1"
-	instructionWrapper.Initiator = this.Value.DeponentTo
-	instructionWrapper.InstructionID = this.Value.MemberInstructionIdTo
-	instructionWrapper.Reason = this.Value.ReasonTo
-	instructionWrapper.ReasonExists = (instructionWrapper.Reason.Document != "") && (instructionWrapper.Reason.Description != "") && (instructionWrapper.Reason.DocumentDate != "")
-
-	t.Execute(buf, instructionWrapper)
-	alamedaTo := buf.String()
-
-	return alamedaFrom, alamedaTo
 }
 
-// TODO: get rid of test wrapper
-func CreateAlamedaXMLsTestWrapper(this *nsd.Instruction, instructionType string) (string, string) {
-	if instructionType == nsd.InstructionTypeDVP {
-		return createAlamedaDvpXMLs(this)
-	} else {
-		return createAlamedaFopXMLs(this)
+// alamedaDvpTemplate is the default template of Alameda MF170 document of DVP instruction,
+// the receiver's one confirms the transferer's (f_instruction) and passes additional information
+func alamedaDvpTemplate(operationCode string, confirming bool) string {
+	fInstruction, additionalInfo := "N", ""
+	if confirming {
+		fInstruction = "Y"
+		additionalInfo = "\n<add_info>/NZP {{xml .Instruction.Value.AdditionalInformation.Description}}</add_info>"
 	}
-}
 
-func createAlamedaDvpXMLs(this *nsd.Instruction) (string, string) {
-	const xmlTemplate = `<?xml version="1.0" encoding="Windows-1251"?>
+	return `<?xml version="1.0" encoding="UTF-8"?>
 <Batch>
 <Documents_amount>1</Documents_amount>
 <Document DOC_ID="1" version="7">
 <ORDER_HEADER>
-<deposit_c>{{.Depositary}}</deposit_c>
-<contrag_c>{{.Initiator}}</contrag_c>
-<contr_d_id>{{.InstructionID}}</contr_d_id>
-<createdate>{{.Instruction.Key.InstructionDate}}</createdate>
-<order_t_id>{{.OperationCode}}</order_t_id>
-<execute_dt>{{.InstructionDate}}</execute_dt>
-<expirat_dt>{{.ExpirationDate}}</expirat_dt>
+<deposit_c>` + alamedaDepositary + `</deposit_c>
+<contrag_c>{{xml .Initiator}}</contrag_c>
+<contr_d_id>{{xml .InstructionID}}</contr_d_id>
+<createdate>{{xml .Instruction.Key.InstructionDate}}</createdate>
+<order_t_id>` + operationCode + `</order_t_id>
+<execute_dt>{{executeDate .Instruction.Key.InstructionDate}}</execute_dt>
+<expirat_dt>{{expirationDate .Instruction.Key.InstructionDate 0}}</expirat_dt>
 </ORDER_HEADER>
 <MF170>
-<dep_acc_c>{{.Instruction.Key.Transferer.Account}}</dep_acc_c>
-<sec_c>{{.Instruction.Key.Transferer.Division}}</sec_c>
-<corr_acc_c>{{.Instruction.Key.Receiver.Account}}</corr_acc_c>
-<corr_sec_c>{{.Instruction.Key.Receiver.Division}}</corr_sec_c>
-<deal_num>{{.Reference}}</deal_num>
-<deal_date>{{.Instruction.Key.TradeDate}}</deal_date>
-<con_code>{{.Contragent}}</con_code>
-<sen_acc>{{.Instruction.Key.ReceiverRequisites.Account}}</sen_acc>
-<sen_bic>{{.Instruction.Key.ReceiverRequisites.Bic}}</sen_bic>
-<rec_acc>{{.Instruction.Key.TransfererRequisites.Account}}</rec_acc>
-<rec_bic>{{.Instruction.Key.TransfererRequisites.Bic}}</rec_bic>
-<pay_sum>{{.Instruction.Key.PaymentAmount}}</pay_sum>
-<pay_curr>{{.Instruction.Key.PaymentCurrency}}</pay_curr>
-{{if .ReasonExists}}{{with .Reason.Description -}}<based_on>{{.}}</based_on>{{end}}{{end}}
-<block_securities>{{.BlockSecurities}}</block_securities>
-<f_instruction>{{.FInstruction}}</f_instruction>
-<auto_borr>{{.AutoBorr}}</auto_borr>{{if .AdditionalInfoExists}}
-{{with .AdditionalInfo.Description -}}<add_info>{{.}}</add_info>{{end}}{{end}}
+<dep_acc_c>{{xml .Instruction.Key.Transferer.Account}}</dep_acc_c>
+<sec_c>{{xml .Instruction.Key.Transferer.Division}}</sec_c>
+<corr_acc_c>{{xml .Instruction.Key.Receiver.Account}}</corr_acc_c>
+<corr_sec_c>{{xml .Instruction.Key.Receiver.Division}}</corr_sec_c>
+<deal_num>{{xml .Reference}}</deal_num>
+<deal_date>{{xml .Instruction.Key.TradeDate}}</deal_date>
+<con_code>{{xml .Contragent}}</con_code>
+<sen_acc>{{xml .Instruction.Key.ReceiverRequisites.Account}}</sen_acc>
+<sen_bic>{{xml .Instruction.Key.ReceiverRequisites.Bic}}</sen_bic>
+<rec_acc>{{xml .Instruction.Key.TransfererRequisites.Account}}</rec_acc>
+<rec_bic>{{xml .Instruction.Key.TransfererRequisites.Bic}}</rec_bic>
+<pay_sum>{{xml .Instruction.Key.PaymentAmount}}</pay_sum>
+<pay_curr>{{xml .Instruction.Key.PaymentCurrency}}</pay_curr>
+{{with .Reason.Description -}}<based_on>{{xml .}}</based_on>{{end}}
+<block_securities>N</block_securities>
+<f_instruction>` + fInstruction + `</f_instruction>
+<auto_borr>N</auto_borr>` + additionalInfo + `
 <securities>
 <security>
-<security_c>{{.Instruction.Key.Security}}</security_c>
-<security_q>{{.Instruction.Key.Quantity}}</security_q>
+<security_c>{{xml .Instruction.Key.Security}}</security_c>
+<security_q>{{xml .Instruction.Key.Quantity}}</security_q>
 </security>
 </securities>
 </MF170>
 </Document>
 </Batch>`
+}
+
+// defaultAlamedaTemplate is the template of the side of instructions of the type the registry is seeded with,
+// Alameda operation codes are 16 and 16/1 for FOP and 16/2 and 16/3 for DVP
+func defaultAlamedaTemplate(instructionType string, side string) AlamedaTemplate {
+	t := AlamedaTemplate{Type: instructionType, Side: side, Version: 1}
+	switch {
+	case instructionType == nsd.InstructionTypeFOP && side == "transferer":
+		t.Template = alamedaFopTemplate("16")
+	case instructionType == nsd.InstructionTypeFOP:
+		t.Template = alamedaFopTemplate("16/1")
+	case side == "transferer":
+		t.Template = alamedaDvpTemplate("16/2", false)
+	default:
+		t.Template = alamedaDvpTemplate("16/3", true)
+	}
+	return t
+}
+
+// alamedaDocument is the data Alameda templates are executed with: the instruction and its side
+type alamedaDocument struct {
+	Instruction   nsd.Instruction
+	Initiator     string
+	Contragent    string
+	InstructionID string
+	Reason        nsd.Reason
+	Reference     string
+}
+
+// execute makes Alameda document of the side of the template of instruction
+func (this AlamedaTemplate) execute(instruction *nsd.Instruction) (string, error) {
+	t, err := template.New(this.Type + "/" + this.Side).Funcs(alamedaFuncs).Parse(this.Template)
+	if err != nil {
+		return "", err
+	}
 
-	type InstructionWrapper struct {
-		Instruction          nsd.Instruction
-		Depositary           string
-		Initiator      	     string
-		InstructionID        string
-		OperationCode        string
-		InstructionDate      string
-		ExpirationDate       string
-		ReasonExists    	 bool
-		Reason          	 nsd.Reason
-		Reference       	 string
-		Contragent      	 string
-		BlockSecurities      string
-		FInstruction         string
-		AutoBorr             string
-		AdditionalInfoExists bool
-		AdditionalInfo       nsd.Reason
-	}
-
-	dateLayout := "2006-01-02"
-	instructionDate, _ := time.Parse(dateLayout, this.Key.InstructionDate)
-	expirationDate := instructionDate
-	expirationDate = expirationDate.Truncate(time.Hour * 24).Add(time.Hour*23 + time.Minute*59 + time.Second*59)
-
-	instructionWrapper := InstructionWrapper{
-		Instruction:          *this,
-		Depositary:           "NDC000000000",
-		Initiator:            this.Value.DeponentFrom,
-		InstructionID:        this.Value.MemberInstructionIdFrom,
-		OperationCode:        "16/2",
-		InstructionDate:      instructionDate.Format("2006-01-02 15:04:05"),
-		ExpirationDate:       expirationDate.Format("2006-01-02 15:04:05"),
-		Reason:               this.Value.ReasonFrom,
-		Reference:            strings.ToUpper(this.Key.Reference),
-		Contragent:           this.Value.DeponentTo,
-		BlockSecurities:      "N",
-		FInstruction:         "N",
-		AutoBorr:             "N",
-		AdditionalInfoExists: false,
-		AdditionalInfo:       this.Value.AdditionalInformation,
-	}
-	instructionWrapper.ReasonExists = instructionWrapper.Reason.Description != ""
-
-	t := template.Must(template.New("xmlTemplate").Parse(xmlTemplate))
+	document := alamedaDocument{
+		Instruction:   *instruction,
+		Initiator:     instruction.Value.DeponentFrom,
+		Contragent:    instruction.Value.DeponentTo,
+		InstructionID: instruction.Value.MemberInstructionIdFrom,
+		Reason:        instruction.Value.ReasonFrom,
+		Reference:     strings.ToUpper(instruction.Key.Reference),
+	}
+	if this.Side == "receiver" {
+		document.Initiator, document.Contragent = document.Contragent, document.Initiator
+		document.InstructionID = instruction.Value.MemberInstructionIdTo
+		document.Reason = instruction.Value.ReasonTo
+	}
 
 	buf := new(bytes.Buffer)
-	t.Execute(buf, instructionWrapper)
-	alamedaFrom := buf.String()
+	if err := t.Execute(buf, document); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+func alamedaTemplateKey(stub shim.ChaincodeStubInterface, instructionType string, side string, version int) (string, error) {
+	return stub.CreateCompositeKey(alamedaTemplateIndex, []string{instructionType, side, strconv.Itoa(version)})
+}
+
+// getAlamedaTemplate reads the version of template of the side of instructions of the type,
+// the latest one if version is 0; default templates are used until the registry is seeded
+func getAlamedaTemplate(stub shim.ChaincodeStubInterface, instructionType string, side string,
+	version int) (AlamedaTemplate, error) {
+	templates, err := findAlamedaTemplates(stub, instructionType, side)
+	if err != nil {
+		return AlamedaTemplate{}, err
+	}
+
+	var found *AlamedaTemplate
+	for i, t := range templates {
+		if (version == 0 && (found == nil || t.Version > found.Version)) || t.Version == version {
+			found = &templates[i]
+		}
+	}
+	if found != nil {
+		return *found, nil
+	}
+
+	if version <= 1 {
+		return defaultAlamedaTemplate(instructionType, side), nil
+	}
+	return AlamedaTemplate{}, fmt.Errorf("no version %d of template of %s %s", version, instructionType, side)
+}
+
+// findAlamedaTemplates reads all versions of templates, of the type and the side if given
+func findAlamedaTemplates(stub shim.ChaincodeStubInterface, keyParts ...string) ([]AlamedaTemplate, error) {
+	it, err := stub.GetStateByPartialCompositeKey(alamedaTemplateIndex, keyParts)
+	if err != nil {
+		return nil, err
+	}
+	defer it.Close()
+
+	templates := []AlamedaTemplate{}
+	for it.HasNext() {
+		response, err := it.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		var t AlamedaTemplate
+		if err := nsd.UnmarshalValue(alamedaTemplateIndex, response.Value, &t); err != nil {
+			return nil, err
+		}
+		templates = append(templates, t)
+	}
+	return templates, nil
+}
+
+func putAlamedaTemplate(stub shim.ChaincodeStubInterface, t AlamedaTemplate) error {
+	key, err := alamedaTemplateKey(stub, t.Type, t.Side, t.Version)
+	if err != nil {
+		return err
+	}
+	data, err := nsd.MarshalValue(alamedaTemplateIndex, t)
+	if err != nil {
+		return err
+	}
+	return stub.PutState(key, data)
+}
+
+// seedAlamedaTemplates stores the default templates of sides lacking any
+func seedAlamedaTemplates(stub shim.ChaincodeStubInterface) error {
+	for _, instructionType := range []string{nsd.InstructionTypeFOP, nsd.InstructionTypeDVP} {
+		for _, side := range []string{"transferer", "receiver"} {
+			templates, err := findAlamedaTemplates(stub, instructionType, side)
+			if err != nil {
+				return err
+			}
+			if len(templates) != 0 {
+				continue
+			}
+			if err := putAlamedaTemplate(stub, defaultAlamedaTemplate(instructionType, side)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
 
-	buf.Reset()
-	instructionWrapper.OperationCode = "16/3"
-	instructionWrapper.Initiator = this.Value.DeponentTo
-	instructionWrapper.InstructionID = this.Value.MemberInstructionIdTo
-	instructionWrapper.Reason = this.Value.ReasonTo
-	instructionWrapper.ReasonExists = instructionWrapper.Reason.Description != ""
-	instructionWrapper.Contragent = this.Value.DeponentFrom
-	instructionWrapper.FInstruction = "Y"
-	instructionWrapper.AdditionalInfoExists = true
-	instructionWrapper.AdditionalInfo.Description = "/NZP " + instructionWrapper.AdditionalInfo.Description
+// renderAlamedaXMLs makes Alameda documents of both sides of instruction with the templates
+func renderAlamedaXMLs(this *nsd.Instruction, from AlamedaTemplate, to AlamedaTemplate) (string, string, error) {
+	alamedaFrom, err := from.execute(this)
+	if err != nil {
+		return "", "", err
+	}
+	alamedaTo, err := to.execute(this)
+	if err != nil {
+		return "", "", err
+	}
+	return alamedaFrom, alamedaTo, nil
+}
+
+// createAlamedaXMLs makes Alameda documents of matched instruction with the latest templates
+// and records their versions in the instruction
+func createAlamedaXMLs(stub shim.ChaincodeStubInterface, this *nsd.Instruction) error {
+	from, err := getAlamedaTemplate(stub, this.Key.Type, "transferer", 0)
+	if err != nil {
+		return err
+	}
+	to, err := getAlamedaTemplate(stub, this.Key.Type, "receiver", 0)
+	if err != nil {
+		return err
+	}
+
+	this.Value.AlamedaTemplateFrom, this.Value.AlamedaTemplateTo = from.Version, to.Version
+	this.Value.AlamedaFrom, this.Value.AlamedaTo, err = renderAlamedaXMLs(this, from, to)
+	return err
+}
+
+// recreateAlamedaXMLs makes Alameda documents of instruction again with the templates it was matched with,
+// instructions matched before templates were versioned have got documents of the default ones
+func recreateAlamedaXMLs(stub shim.ChaincodeStubInterface, this *nsd.Instruction) (string, string, error) {
+	versionFrom, versionTo := this.Value.AlamedaTemplateFrom, this.Value.AlamedaTemplateTo
+	if versionFrom == 0 {
+		versionFrom = 1
+	}
+	if versionTo == 0 {
+		versionTo = 1
+	}
+
+	from, err := getAlamedaTemplate(stub, this.Key.Type, "transferer", versionFrom)
+	if err != nil {
+		return "", "", err
+	}
+	to, err := getAlamedaTemplate(stub, this.Key.Type, "receiver", versionTo)
+	if err != nil {
+		return "", "", err
+	}
+	return renderAlamedaXMLs(this, from, to)
+}
+
+// TODO: get rid of test wrapper
+func CreateAlamedaXMLsTestWrapper(this *nsd.Instruction, instructionType string) (string, string) {
+	from, to, err := renderAlamedaXMLs(this, defaultAlamedaTemplate(instructionType, "transferer"),
+		defaultAlamedaTemplate(instructionType, "receiver"))
+	if err != nil {
+		logger.Error(err)
+	}
+	return from, to
+}
+
+const sese023Namespace = "urn:iso:std:iso:20022:tech:xsd:sese.023.001.07"
+
+// BIC of NSD acting as the place of settlement
+const depositoryBic = "NADCRUMM"
+
+// sese023Parties is the counterparty of the leg along with its safekeeping account
+type sese023Parties struct {
+	Depository string `xml:"Dpstry>Id>AnyBIC"`
+	Deponent   string `xml:"Pty1>Id>PrtryId>Id"`
+	Issuer     string `xml:"Pty1>Id>PrtryId>Issr"`
+	Account    string `xml:"Pty1>SfkpgAcct>Id"`
+}
+
+type sese023Amount struct {
+	Amount struct {
+		Currency string `xml:"Ccy,attr"`
+		Value    string `xml:",chardata"`
+	} `xml:"Amt"`
+	CreditDebit string `xml:"CdtDbtInd"`
+}
+
+// sese023Document is securities settlement transaction instruction (sese.023.001.07) of one leg of instruction,
+// only elements mandatory for settlement in NSD are filled
+type sese023Document struct {
+	XMLName   xml.Name `xml:"Document"`
+	Namespace string   `xml:"xmlns,attr"`
+
+	TransactionId      string          `xml:"SctiesSttlmTxInstr>TxId"`
+	MovementType       string          `xml:"SctiesSttlmTxInstr>SttlmTpAndAddtlParams>SctiesMvmntTp"`
+	Payment            string          `xml:"SctiesSttlmTxInstr>SttlmTpAndAddtlParams>Pmt"`
+	TradeId            string          `xml:"SctiesSttlmTxInstr>TradDtls>TradId"`
+	TradeDate          string          `xml:"SctiesSttlmTxInstr>TradDtls>TradDt>Dt>Dt"`
+	SettlementDate     string          `xml:"SctiesSttlmTxInstr>TradDtls>SttlmDt>Dt>Dt"`
+	Isin               string          `xml:"SctiesSttlmTxInstr>FinInstrmId>ISIN"`
+	Quantity           string          `xml:"SctiesSttlmTxInstr>QtyAndAcctDtls>SttlmQty>Qty>Unit"`
+	SafekeepingAccount string          `xml:"SctiesSttlmTxInstr>QtyAndAcctDtls>SfkpgAcct>Id"`
+	TransactionType    string          `xml:"SctiesSttlmTxInstr>SttlmParams>SctiesTxTp>Cd"`
+	DeliveringParties  *sese023Parties `xml:"SctiesSttlmTxInstr>DlvrgSttlmPties,omitempty"`
+	ReceivingParties   *sese023Parties `xml:"SctiesSttlmTxInstr>RcvgSttlmPties,omitempty"`
+	SettlementAmount   *sese023Amount  `xml:"SctiesSttlmTxInstr>SttlmAmt,omitempty"`
+}
+
+// createSese023XMLs makes ISO 20022 settlement instructions of matched instruction:
+// delivery of the transferer and receipt of the receiver, against payment for DVP.
+// Instructions settle on their settlement date, those matched before it was recorded on the trade date
+func createSese023XMLs(this *nsd.Instruction) (string, string) {
+	settlementDate := this.Value.SettlementDate
+	if settlementDate == "" {
+		settlementDate = this.Key.TradeDate
+	}
+
+	document := sese023Document{
+		Namespace:       sese023Namespace,
+		TransactionId:   this.Value.MemberInstructionIdFrom,
+		MovementType:    "DELI",
+		Payment:         "FREE",
+		TradeId:         strings.ToUpper(this.Key.Reference),
+		TradeDate:       this.Key.TradeDate,
+		SettlementDate:  settlementDate,
+		Isin:            this.Key.Security,
+		Quantity:        this.Key.Quantity,
+		TransactionType: "TRAD",
+	}
+
+	from, to := document, document
+
+	from.SafekeepingAccount = this.Key.Transferer.Account
+	from.ReceivingParties = &sese023Parties{Depository: depositoryBic, Deponent: this.Value.DeponentTo,
+		Issuer: "NSD", Account: this.Key.Receiver.Account}
+
+	to.TransactionId = this.Value.MemberInstructionIdTo
+	to.MovementType = "RECE"
+	to.SafekeepingAccount = this.Key.Receiver.Account
+	to.DeliveringParties = &sese023Parties{Depository: depositoryBic, Deponent: this.Value.DeponentFrom,
+		Issuer: "NSD", Account: this.Key.Transferer.Account}
+
+	if this.Key.Type == nsd.InstructionTypeDVP {
+		from.Payment, to.Payment = "APMT", "APMT"
+
+		// the transferer is paid, the receiver pays
+		from.SettlementAmount = &sese023Amount{CreditDebit: "CRDT"}
+		from.SettlementAmount.Amount.Currency = this.Key.PaymentCurrency
+		from.SettlementAmount.Amount.Value = this.Key.PaymentAmount
+		to.SettlementAmount = &sese023Amount{CreditDebit: "DBIT"}
+		to.SettlementAmount.Amount = from.SettlementAmount.Amount
+	}
+
+	marshal := func(document sese023Document) string {
+		data, err := xml.MarshalIndent(document, "", "  ")
+		if err != nil {
+			logger.Error(err)
+			return ""
+		}
+		return xml.Header + string(data)
+	}
+
+	return marshal(from), marshal(to)
+}
+
+// SWIFT messages of settlement instructions by direction of securities and payment
+const (
+	mtReceiveFree           = "MT540"
+	mtReceiveAgainstPayment = "MT541"
+	mtDeliverFree           = "MT542"
+	mtDeliverAgainstPayment = "MT543"
+)
+
+// swiftDate formats date of instruction as YYYYMMDD
+func swiftDate(date string) string {
+	return strings.Replace(date, "-", "", -1)
+}
 
-	t.Execute(buf, instructionWrapper)
-	alamedaTo := buf.String()
+// swiftDecimal formats number with decimal comma which ISO 15022 requires even for integers
+func swiftDecimal(number string) string {
+	if !strings.Contains(number, ".") {
+		return number + ","
+	}
+	return strings.Replace(number, ".", ",", 1)
+}
+
+// createMT makes ISO 15022 settlement instruction of the party (transferer or receiver):
+// MT540/MT541 to receive and MT542/MT543 to deliver securities free or against payment.
+// Instructions settle on their settlement date, those matched before it was recorded on the instruction date.
+// Returns type of the message and its text block.
+func createMT(this *nsd.Instruction, party string) (string, string) {
+	settlementDate := this.Value.SettlementDate
+	if settlementDate == "" {
+		settlementDate = this.Key.InstructionDate
+	}
+
+	messageType := mtReceiveFree
+	reference := this.Value.MemberInstructionIdTo
+	account := this.Key.Receiver.Account
+	agent := "DEAG"
+	counterpartyDeponent := this.Value.DeponentFrom
+	counterpartyAccount := this.Key.Transferer.Account
+
+	if party == "transferer" {
+		messageType = mtDeliverFree
+		reference = this.Value.MemberInstructionIdFrom
+		account = this.Key.Transferer.Account
+		agent = "REAG"
+		counterpartyDeponent = this.Value.DeponentTo
+		counterpartyAccount = this.Key.Receiver.Account
+	}
+
+	againstPayment := this.Key.Type == nsd.InstructionTypeDVP
+	if againstPayment {
+		// MT541 and MT543 follow the free ones
+		if messageType == mtReceiveFree {
+			messageType = mtReceiveAgainstPayment
+		} else {
+			messageType = mtDeliverAgainstPayment
+		}
+	}
+
+	lines := []string{
+		"{4:",
+		":16R:GENL",
+		":20C::SEME//" + reference,
+		":23G:NEWM",
+		":16R:LINK",
+		":20C::TRRF//" + strings.ToUpper(this.Key.Reference),
+		":16S:LINK",
+		":16S:GENL",
+		":16R:TRADDET",
+		":98A::SETT//" + swiftDate(settlementDate),
+		":98A::TRAD//" + swiftDate(this.Key.TradeDate),
+		":35B:ISIN " + this.Key.Security,
+		":16S:TRADDET",
+		":16R:FIAC",
+		":36B::SETT//UNIT/" + swiftDecimal(this.Key.Quantity),
+		":97A::SAFE//" + account,
+		":16S:FIAC",
+		":16R:SETDET",
+		":22F::SETR//TRAD",
+		":16R:SETPRTY",
+		":95R::" + agent + "/NSDR/" + counterpartyDeponent,
+		":97A::SAFE//" + counterpartyAccount,
+		":16S:SETPRTY",
+		":16R:SETPRTY",
+		":95P::PSET//" + depositoryBic,
+		":16S:SETPRTY",
+	}
+	if againstPayment {
+		lines = append(lines,
+			":16R:AMT",
+			":19A::SETT//" + this.Key.PaymentCurrency + swiftDecimal(this.Key.PaymentAmount),
+			":16S:AMT")
+	}
+	lines = append(lines, ":16S:SETDET", "-}")
+
+	return messageType, strings.Join(lines, "\r\n")
+}
 
-	return alamedaFrom, alamedaTo
+// roles required to call functions changing instructions, queries are open to auditors as well
+var requiredRoles = map[string]string{
+	"receive":                identity.RoleOperator,
+	"transfer":               identity.RoleOperator,
+	"status":                 identity.RoleOperator,
+	"sign":                   identity.RoleSigner,
+	"updateDownloadFlags":    identity.RoleOperator,
+	"propose":                identity.RoleOperator,
+	"approve":                identity.RoleOperator,
+	"migrate":                identity.RoleOperator,
+	"applyAlamedaResponse":   identity.RoleOperator,
+	"uploadTemplate":         identity.RoleOperator,
+	"terminateRepo":          identity.RoleOperator,
+	"link":                   identity.RoleOperator,
+	"unlink":                 identity.RoleOperator,
+	"allowPartialSettlement": identity.RoleOperator,
+	"settlePartially":        identity.RoleOperator,
 }
 
 // **** Chaincode Methods **** //
@@ -280,27 +787,28 @@ func (t *InstructionChaincode) Init(stub shim.ChaincodeStubInterface) pb.Respons
 	logger.Info("########### " + strings.Join(args, " ") + " ###########")
 	logger.Info("########### " + certificates.GetCreatorOrganization(stub) + " ###########")
 
-	type Organization struct {
-		Name     string        `json:"organization"`
-		Balances []nsd.Balance `json:"balances"`
+	// init, balances, configuration; main organization is kept by "security" chaincode
+	config := ""
+	if len(args) > 2 {
+		config = args[2]
+	}
+	if rs := nsd.InitConfig(stub, config); rs.Status != shim.OK {
+		return rs
 	}
 
-	var organizations []Organization
+	var organizations []nsd.Organization
 	if err := json.Unmarshal([]byte(args[1]), &organizations); err == nil && len(organizations) != 0 {
-		for _, organization := range organizations {
-			for _, balance := range organization.Balances {
-				keyParts := []string{balance.Account, balance.Division}
-				if key, err := stub.CreateCompositeKey(authenticationIndex, keyParts); err == nil {
-					if err := stub.PutState(key, []byte(organization.Name)); err != nil {
-						return pb.Response{Status: 500, Message: "Persistence failure."}
-					}
-				}
-			}
+		if err := nsd.RegisterBalances(stub, organizations); err != nil {
+			return pb.Response{Status: 500, Message: "Persistence failure."}
 		}
 	} else {
 		return pb.Response{Status: 400, Message: "JSON unmarshalling error."}
 	}
 
+	if err := seedAlamedaTemplates(stub); err != nil {
+		return pb.Response{Status: 500, Message: "Persistence failure."}
+	}
+
 	return shim.Success(nil)
 }
 
@@ -309,20 +817,70 @@ func (t *InstructionChaincode) Invoke(stub shim.ChaincodeStubInterface) pb.Respo
 
 	function, args := stub.GetFunctionAndParameters()
 
+	if role, ok := requiredRoles[function]; ok {
+		if rs := nsd.AuthorizeRole(stub, "call "+function, role); rs.Status != shim.OK {
+			return rs
+		}
+	}
+
+	governed := nsd.Governed{"rollback": t.rollback, "addBalances": t.addBalances, "removeBalances": t.removeBalances,
+		"setLimits": t.setLimits}
+	if rs, ok := governed.Invoke(stub, function, args); ok {
+		return rs
+	}
+	if rs, ok := t.balanceRegistry().Invoke(stub, function, args); ok {
+		return rs
+	}
+
 	if function == "receive" {
 		if len(args) < fopArgsLength + 4 {
 			return pb.Response{Status: 400, Message: "Incorrect number of arguments."}
 		}
-		return t.receive(stub, args)
+		if args[9] == nsd.InstructionTypeRepo {
+			return t.repo(stub, function, args)
+		}
+		instruction, rs := instructionFromArgs(stub, args)
+		if rs.Status != shim.OK {
+			return rs
+		}
+		return t.receive(stub, instruction, args, nil)
 	}
 	if function == "transfer" {
 		if len(args) < fopArgsLength + 4 {
 			return pb.Response{Status: 400, Message: "Incorrect number of arguments."}
 		}
-		return t.transfer(stub, args)
+		if args[9] == nsd.InstructionTypeRepo {
+			return t.repo(stub, function, args)
+		}
+		instruction, rs := instructionFromArgs(stub, args)
+		if rs.Status != shim.OK {
+			return rs
+		}
+		return t.transfer(stub, instruction, args, nil)
+	}
+	if function == "link" {
+		return t.link(stub, args)
+	}
+	if function == "unlink" {
+		return t.unlink(stub, args)
+	}
+	if function == "groupStatus" {
+		return t.queryGroup(stub, args)
+	}
+	if function == "queryById" {
+		return t.queryById(stub, args)
+	}
+	if function == "terminateRepo" {
+		return t.terminateRepo(stub, args)
+	}
+	if function == "allowPartialSettlement" {
+		return t.allowPartialSettlement(stub, args)
+	}
+	if function == "settlePartially" {
+		return t.settlePartially(stub, args)
 	}
 	if function == "status" {
-		if len(args) < fopArgsLength + 1 {
+		if len(args) < 2 {
 			return pb.Response{Status: 400, Message: "Incorrect number of arguments."}
 		}
 		return t.status(stub, args)
@@ -339,62 +897,114 @@ func (t *InstructionChaincode) Invoke(stub shim.ChaincodeStubInterface) pb.Respo
 		}
 		return t.queryByType(stub, args)
 	}
+	if function == "dueForSettlement" {
+		return t.queryDueForSettlement(stub, args)
+	}
 	if function == "history" {
-		if len(args) < fopArgsLength {
+		if len(args) < 1 {
 			return pb.Response{Status: 400, Message: "Incorrect number of arguments."}
 		}
 		return t.history(stub, args)
 	}
 	if function == "sign" {
-		if len(args) < fopArgsLength + 1 {
+		if len(args) < 2 {
 			return pb.Response{Status: 400, Message: "Incorrect number of arguments."}
 		}
 		return t.sign(stub, args)
 	}
-	if function == "rollback" {
-		if len(args) < fopArgsLength {
+	if function == "getBalances" {
+		if len(args) < 0 {
 			return pb.Response{Status: 400, Message: "Incorrect number of arguments."}
 		}
-		return t.rollback(stub, args)
+		return t.getBalances(stub, args)
 	}
-	if function == "addBalances" {
-		if len(args) < 1 {
+	if function == "updateDownloadFlags" {
+		if len(args) < 2 {
 			return pb.Response{Status: 400, Message: "Incorrect number of arguments."}
 		}
-		return t.addBalances(stub, args)
+		return t.updateDownloadFlags(stub, args)
+	}
+	if function == "uploadTemplate" {
+		return t.uploadTemplate(stub, args)
+	}
+	if function == "templates" {
+		return t.templates(stub, args)
 	}
-	if function == "removeBalances" {
+	if function == "applyAlamedaResponse" {
+		return t.applyAlamedaResponse(stub, args)
+	}
+	if function == "exportAlameda" {
 		if len(args) < 1 {
 			return pb.Response{Status: 400, Message: "Incorrect number of arguments."}
 		}
-		return t.removeBalances(stub, args)
+		return t.exportAlameda(stub, args)
 	}
-	if function == "getBalances" {
-		if len(args) < 0 {
+	if function == "exportMT" {
+		if len(args) < 1 {
 			return pb.Response{Status: 400, Message: "Incorrect number of arguments."}
 		}
-		return t.getBalances(stub, args)
+		return t.exportMT(stub, args)
 	}
-	if function == "updateDownloadFlags" {
-		if len(args) < fopArgsLength + 1 {
-			return pb.Response{Status: 400, Message: "Incorrect number of arguments."}
-		}
-		return t.updateDownloadFlags(stub, args)
+	if function == "limits" {
+		return t.limits(stub, args)
+	}
+	if function == "mainOrg" {
+		return nsd.QueryMainOrg(stub)
+	}
+	if function == "config" {
+		return nsd.QueryConfig(stub)
+	}
+	if function == "pendingMigration" {
+		return nsd.PendingMigration(stub, args, schemaIndexes...)
+	}
+	if function == "migrate" {
+		return nsd.Migrate(stub, args, schemaIndexes...)
+	}
+	if function == "schemaStatus" {
+		return nsd.SchemaStatus(stub, schemaIndexes...)
 	}
 
 	err := fmt.Sprintf("Unknown function, check the first argument, must be one of: receive, transfer, query, " +
-		"queryByType, history, status, sign, rollback, addBalances, removeBalances, getBalances, updateDownloadFlags." +
+		"queryByType, history, exportAlameda, exportMT, status, link, unlink, groupStatus, queryById, terminateRepo, applyAlamedaResponse, uploadTemplate, templates, sign, getBalances, updateDownloadFlags, mainOrg, config, " +
+		"pendingMigration, migrate, schemaStatus, " +
+		"limits, propose (rollback, addBalances, removeBalances, setLimits), approve, pending, proposalHistory, " +
+		"acceptBalanceChange, rejectBalanceChange, balanceChanges." +
 		" But got: %v", function)
 	logger.Error(err)
 	return shim.Error(err)
 }
 
-func (t *InstructionChaincode) receive(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+// instructionFromArgs fills instruction a party submits: the private part of DVP one is taken from transient data
+// along with the salt unless the counterparty has submitted the instruction already, its salt is taken then
+func instructionFromArgs(stub shim.ChaincodeStubInterface, args []string) (nsd.Instruction, pb.Response) {
 	instruction := nsd.Instruction{}
 	if err := instruction.FillFromArgs(args); err != nil {
-		return pb.Response{Status: 400, Message: "Wrong arguments."}
+		return instruction, pb.Response{Status: 400, Message: "Wrong arguments."}
+	}
+	if instruction.Key.Type != nsd.InstructionTypeDVP {
+		return instruction, shim.Success(nil)
 	}
 
+	if err := instruction.FillFromTransient(stub, 0); err != nil {
+		return instruction, pb.Response{Status: 400, Message: err.Error()}
+	}
+	found, err := instruction.FindSaltIn(stub)
+	if err != nil {
+		return instruction, shim.Error(err.Error())
+	}
+	// instructions stored before the private part was moved out of the key are matched without salt
+	if !found && !instruction.ExistsIn(stub) && len(instruction.Key.Salt) < nsd.MinSaltLength {
+		return instruction, pb.Response{Status: 400, Message: fmt.Sprintf(
+			"Salt of at least %d characters is expected along with requisites.", nsd.MinSaltLength)}
+	}
+	return instruction, shim.Success(nil)
+}
+
+// receive submits instruction of the receiver filled by instructionFromArgs from args,
+// repo links it to repo deal if it is a leg of one
+func (t *InstructionChaincode) receive(stub shim.ChaincodeStubInterface, instruction nsd.Instruction, args []string,
+	repo *nsd.Repo) pb.Response {
+
 	if authenticateCaller(stub, instruction.Key.Receiver) == false {
 		return pb.Response{Status: 403, Message: "Caller must be receiver."}
 	}
@@ -406,6 +1016,18 @@ func (t *InstructionChaincode) receive(stub shim.ChaincodeStubInterface, args []
 		argsOffset = len(args) - 5
 	}
 
+	if rs := checkDeponents(stub, instruction, args[argsOffset], args[argsOffset + 1]); rs.Status != shim.OK {
+		return rs
+	}
+
+	today, err := txDate(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if rs := checkLimits(stub, instruction, nsd.InitiatorIsReceiver, today); rs.Status != shim.OK {
+		return rs
+	}
+
 	callerOrg, err := getOrganizationName(stub, instruction.Key.Receiver)
 	if err != nil {
 		return pb.Response{Status: 500, Message: "Persistence failure."}
@@ -437,7 +1059,12 @@ func (t *InstructionChaincode) receive(stub shim.ChaincodeStubInterface, args []
 			return pb.Response{Status: 404, Message: "Instruction not found."}
 		}
 
+		if !sameRepo(instruction.Value.Repo, repo) {
+			return pb.Response{Status: 400, Message: "Repo deal differs from entered by another party."}
+		}
+
 		instruction.Value.MemberInstructionIdTo = args[argsOffset + 2]
+		instruction.Value.SubmittedTo = today
 		if err := json.Unmarshal([]byte(args[argsOffset + 3]), &instruction.Value.ReasonTo); err != nil {
 			return pb.Response{Status: 400, Message: "Wrong arguments."}
 		}
@@ -467,8 +1094,10 @@ func (t *InstructionChaincode) receive(stub shim.ChaincodeStubInterface, args []
 		instruction.Value.DeponentFrom = args[argsOffset]
 		instruction.Value.DeponentTo = args[argsOffset + 1]
 		instruction.Value.MemberInstructionIdTo = args[argsOffset + 2]
+		instruction.Value.SubmittedTo = today
 		instruction.Value.Initiator = nsd.InitiatorIsReceiver
 		instruction.Value.Status = nsd.InstructionInitiated
+		instruction.Value.Repo = repo
 		if err := json.Unmarshal([]byte(args[argsOffset + 3]), &instruction.Value.ReasonTo); err != nil {
 			return pb.Response{Status: 400, Message: "Wrong arguments."}
 		}
@@ -496,6 +1125,10 @@ func (t *InstructionChaincode) receive(stub shim.ChaincodeStubInterface, args []
 			return pb.Response{Status: 500, Message: "Persistence failure."}
 		}
 
+		if instruction.PutPrivateIn(stub) != nil {
+			return pb.Response{Status: 500, Message: "Persistence failure."}
+		}
+
 		if err := stub.PutState(referenceKey, []byte("true")); err != nil {
 			return pb.Response{Status: 500, Message: "Persistence failure."}
 		}
@@ -504,15 +1137,446 @@ func (t *InstructionChaincode) receive(stub shim.ChaincodeStubInterface, args []
 			return pb.Response{Status: 500, Message: "Persistence failure."}
 		}
 
-		return shim.Success(nil)
+		return shim.Success([]byte(instruction.Id))
 	}
 }
 
-func (t *InstructionChaincode) transfer(stub shim.ChaincodeStubInterface, args []string) pb.Response {
-	instruction := nsd.Instruction{}
-	if err := instruction.FillFromArgs(args); err != nil {
-		return pb.Response{Status: 400, Message: "Wrong arguments."}
+// sameRepo checks instruction is submitted by both parties as the same leg of the same repo deal or not as a leg
+func sameRepo(stored *nsd.Repo, entered *nsd.Repo) bool {
+	if stored == nil || entered == nil {
+		return stored == entered
 	}
+	return stored.Deal == entered.Deal && stored.Leg == entered.Leg && stored.Rate == entered.Rate
+}
+
+// closingLegArgs are arguments of the key of the closing leg of repo deal with the opening leg:
+// the parties are swapped, the instruction date is the closing date
+func closingLegArgs(opening nsd.InstructionKey, closingDate string) []string {
+	return []string{
+		opening.Receiver.Account, opening.Receiver.Division,
+		opening.Transferer.Account, opening.Transferer.Division,
+		opening.Security, opening.Quantity, opening.Reference, closingDate, opening.TradeDate, nsd.InstructionTypeDVP,
+		opening.PaymentCurrency,
+	}
+}
+
+// closingLeg is the closing leg of repo deal with the opening leg, requisites are swapped as well
+// and hashed with the salt of the opening leg
+func closingLeg(opening nsd.InstructionKey, closingDate string, price string) (nsd.Instruction, error) {
+	closing := nsd.Instruction{}
+	if err := closing.FillFromArgs(closingLegArgs(opening, closingDate)); err != nil {
+		return closing, err
+	}
+	err := closing.FillPrivate(nsd.InstructionPrivate{
+		TransfererRequisites: opening.ReceiverRequisites,
+		ReceiverRequisites:   opening.TransfererRequisites,
+		PaymentAmount:        price,
+		Salt:                 opening.Salt,
+	})
+	return closing, err
+}
+
+// repurchasePrice is payment amount of the closing leg of repo deal: that of the opening leg with interest
+// at the repo rate (percent per annum) for the days between the legs, actual/365, rounded half up to minor units.
+// It is computed with exact fractions since every peer has to get the same amount
+func repurchasePrice(opening nsd.InstructionKey, closingDate string, rate string) (string, error) {
+	openingDay, err := time.Parse("2006-01-02", opening.InstructionDate)
+	if err != nil {
+		return "", fmt.Errorf("Invalid instruction date.")
+	}
+	closingDay, err := time.Parse("2006-01-02", closingDate)
+	if err != nil {
+		return "", fmt.Errorf("Invalid closing date.")
+	}
+	if !closingDay.After(openingDay) {
+		return "", fmt.Errorf("Closing date must be after instruction date.")
+	}
+
+	r, ok := new(big.Rat).SetString(rate)
+	if !ok || r.Sign() < 0 || strings.ContainsAny(rate, "/eE") {
+		return "", fmt.Errorf("Repo rate must be non-negative decimal number.")
+	}
+	amount, err := nsd.ParseAmount(opening.PaymentAmount)
+	if err != nil {
+		return "", fmt.Errorf("Payment amount must be decimal number.")
+	}
+
+	days := int64(closingDay.Sub(openingDay).Hours() / 24)
+	interest := new(big.Rat).Mul(big.NewRat(int64(amount)*days, 100*365), r)
+
+	// half up: floor of interest + 1/2, interest is non-negative
+	interest.Add(interest, big.NewRat(1, 2))
+	units := new(big.Int).Quo(interest.Num(), interest.Denom())
+	if !units.IsInt64() {
+		return "", fmt.Errorf("Repurchase price is too large.")
+	}
+	return (amount + nsd.Amount(units.Int64())).String(), nil
+}
+
+// repo submits both legs of repo deal by its party: the opening DVP instruction as given and the closing one
+// in the opposite direction on the closing date for the repurchase price.
+// Arguments are those of DVP instruction of type repo followed by the closing date and repo rate, deponents,
+// member instruction ids of the opening and the closing legs, reason and additional information of the leg
+// the party receives securities in. Returns the deal id - id of the opening leg.
+func (t *InstructionChaincode) repo(stub shim.ChaincodeStubInterface, function string, args []string) pb.Response {
+	if len(args) != repoArgsLength + 6 {
+		return pb.Response{Status: 400, Message: "Incorrect number of arguments."}
+	}
+
+	openingArgs := append([]string{}, args[:dvpArgsLength]...)
+	openingArgs[9] = nsd.InstructionTypeDVP
+
+	opening, rs := instructionFromArgs(stub, openingArgs)
+	if rs.Status != shim.OK {
+		return rs
+	}
+
+	closingDate, rate := args[dvpArgsLength], args[dvpArgsLength + 1]
+	price, err := repurchasePrice(opening.Key, closingDate, rate)
+	if err != nil {
+		return pb.Response{Status: 400, Message: err.Error()}
+	}
+
+	openingKey, err := opening.ToCompositeKey(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	deal := nsd.InstructionId(openingKey)
+
+	deponentFrom, deponentTo := args[repoArgsLength], args[repoArgsLength + 1]
+	openingId, closingId := args[repoArgsLength + 2], args[repoArgsLength + 3]
+	reason, additionalInformation := args[repoArgsLength + 4], args[repoArgsLength + 5]
+
+	closing, err := closingLeg(opening.Key, closingDate, price)
+	if err != nil {
+		return pb.Response{Status: 400, Message: err.Error()}
+	}
+	openingArgs = append(openingArgs, deponentFrom, deponentTo, openingId, reason)
+	closingArgs := append(closingLegArgs(opening.Key, closingDate), deponentTo, deponentFrom, closingId, reason)
+
+	openingRepo := &nsd.Repo{Deal: deal, Leg: nsd.RepoLegOpening, Rate: rate}
+	closingRepo := &nsd.Repo{Deal: deal, Leg: nsd.RepoLegClosing, Rate: rate}
+
+	if function == "transfer" {
+		// the party delivers securities in the opening leg and gets them back in the closing one
+		if rs = t.transfer(stub, opening, openingArgs, openingRepo); rs.Status == shim.OK {
+			rs = t.receive(stub, closing, append(closingArgs, additionalInformation), closingRepo)
+		}
+	} else {
+		if rs = t.receive(stub, opening, append(openingArgs, additionalInformation), openingRepo); rs.Status == shim.OK {
+			rs = t.transfer(stub, closing, closingArgs, closingRepo)
+		}
+	}
+	if rs.Status != shim.OK {
+		return rs
+	}
+
+	return shim.Success([]byte(deal))
+}
+
+// terminateRepo moves the closing leg of repo deal to an earlier date with the repurchase price recomputed
+// once both parties request it with the same date, the new closing leg has to be signed again
+func (t *InstructionChaincode) terminateRepo(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 2 {
+		return pb.Response{Status: 400, Message: "Incorrect number of arguments. Expecting deal id and closing date"}
+	}
+	deal, date := args[0], args[1]
+
+	instructions, err := findInstructions(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	var opening, closing *nsd.Instruction
+	for i, instruction := range instructions {
+		if instruction.Value.Repo == nil || instruction.Value.Repo.Deal != deal {
+			continue
+		}
+		if instruction.Value.Repo.Leg == nsd.RepoLegOpening {
+			opening = &instructions[i]
+		} else {
+			closing = &instructions[i]
+		}
+	}
+	if opening == nil || closing == nil {
+		return pb.Response{Status: 404, Message: "Repo deal not found."}
+	}
+
+	party := ""
+	if authenticateCaller(stub, closing.Key.Transferer) {
+		party = nsd.InitiatorIsTransferer
+	} else if authenticateCaller(stub, closing.Key.Receiver) {
+		party = nsd.InitiatorIsReceiver
+	} else {
+		return pb.Response{Status: 403, Message: "Repo can be terminated only by its parties."}
+	}
+
+	if opening.Value.Status != nsd.InstructionExecuted {
+		return pb.Response{Status: 406, Message: "Opening leg is not executed."}
+	}
+	if closing.Value.Status != nsd.InstructionMatched && closing.Value.Status != nsd.InstructionSigned {
+		return pb.Response{Status: 406, Message: "Closing leg in status " + closing.Value.Status +
+			" cannot be changed."}
+	}
+	if date >= closing.Key.InstructionDate {
+		return pb.Response{Status: 400, Message: "Termination date must be before closing date."}
+	}
+
+	price, err := repurchasePrice(opening.Key, date, closing.Value.Repo.Rate)
+	if err != nil {
+		return pb.Response{Status: 400, Message: err.Error()}
+	}
+
+	// the first request waits for the other party
+	repo := closing.Value.Repo
+	if repo.TerminationDate != date || repo.TerminationBy == "" || repo.TerminationBy == party {
+		repo.TerminationDate, repo.TerminationBy = date, party
+
+		if err := closing.UpsertIn(stub); err != nil {
+			return pb.Response{Status: 500, Message: "Persistence failure."}
+		}
+		if err := closing.EmitState(stub); err != nil {
+			return pb.Response{Status: 500, Message: "Event emission failure."}
+		}
+		return shim.Success(nil)
+	}
+
+	terminated, err := closingLeg(opening.Key, date, price)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	terminated.Value = closing.Value
+	terminated.Value.Repo = &nsd.Repo{Deal: deal, Leg: nsd.RepoLegClosing, Rate: repo.Rate}
+	terminated.Value.Status = nsd.InstructionMatched
+	terminated.Value.AlamedaSignatureFrom, terminated.Value.AlamedaSignatureTo = "", ""
+	terminated.Value.TransfererSignatureDownloaded, terminated.Value.ReceiverSignatureDownloaded = false, false
+	if response := setSettlementDate(stub, &terminated); response.Status != shim.OK {
+		return response
+	}
+
+	if err := createAlamedaXMLs(stub, &terminated); err != nil {
+		return pb.Response{Status: 500, Message: "Cannot create Alameda documents: " + err.Error()}
+	}
+	terminated.Value.Sese023From, terminated.Value.Sese023To = createSese023XMLs(&terminated)
+
+	// references and member instruction ids of the parties move to the termination date
+	closingIndexKeys, err := instructionIndexKeys(stub, *closing)
+	if err != nil {
+		return pb.Response{Status: 500, Message: "Persistence failure."}
+	}
+	terminatedIndexKeys, err := instructionIndexKeys(stub, terminated)
+	if err != nil {
+		return pb.Response{Status: 500, Message: "Persistence failure."}
+	}
+	for _, key := range terminatedIndexKeys {
+		if data, err := stub.GetState(key); err != nil {
+			return pb.Response{Status: 500, Message: "Persistence failure."}
+		} else if data != nil {
+			return pb.Response{Status: 400, Message: "Reference or instruction id of the closing leg is not unique " +
+				"on the termination date."}
+		}
+	}
+
+	if err := deleteInstructionFromLedger(stub, *closing); err != nil {
+		return pb.Response{Status: 500, Message: "Persistence failure."}
+	}
+	for _, key := range closingIndexKeys {
+		if err := stub.DelState(key); err != nil {
+			return pb.Response{Status: 500, Message: "Persistence failure."}
+		}
+	}
+	for _, key := range terminatedIndexKeys {
+		if err := stub.PutState(key, []byte("true")); err != nil {
+			return pb.Response{Status: 500, Message: "Persistence failure."}
+		}
+	}
+	if err := terminated.UpsertIn(stub); err != nil {
+		return pb.Response{Status: 500, Message: "Persistence failure."}
+	}
+	if err := terminated.PutPrivateIn(stub); err != nil {
+		return pb.Response{Status: 500, Message: "Persistence failure."}
+	}
+	if err := terminated.EmitState(stub); err != nil {
+		return pb.Response{Status: 500, Message: "Event emission failure."}
+	}
+
+	return shim.Success([]byte(terminated.Id))
+}
+
+// allowPartialSettlement opts the side of the caller in settlement of the quantity the transferer has
+// when it lacks the whole one, the book settles instruction partially only if both parties allow it
+func (t *InstructionChaincode) allowPartialSettlement(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	instruction := nsd.Instruction{}
+	if _, err := instruction.FillFromIdOrArgs(stub, args); err == nsd.ErrInstructionNotFound {
+		return pb.Response{Status: 404, Message: err.Error()}
+	} else if err != nil {
+		return pb.Response{Status: 400, Message: "cannot initialize instruction from args"}
+	}
+
+	if err := instruction.LoadFrom(stub); err != nil || instruction.Value.Status == "" {
+		return pb.Response{Status: 404, Message: "Instruction not found."}
+	}
+
+	switch {
+	case authenticateCaller(stub, instruction.Key.Transferer):
+		instruction.Value.PartialSettlementFrom = true
+	case authenticateCaller(stub, instruction.Key.Receiver):
+		instruction.Value.PartialSettlementTo = true
+	default:
+		return pb.Response{Status: 403, Message: "Partial settlement can be allowed only by parties of instruction."}
+	}
+
+	switch instruction.Value.Status {
+	case nsd.InstructionInitiated, nsd.InstructionMatched, nsd.InstructionSigned, nsd.InstructionDownloaded:
+	default:
+		return pb.Response{Status: 406, Message: "Instruction in status " + instruction.Value.Status +
+			" cannot be changed."}
+	}
+
+	if err := instruction.UpsertIn(stub); err != nil {
+		return pb.Response{Status: 500, Message: "Persistence failure."}
+	}
+
+	if err := instruction.EmitState(stub); err != nil {
+		return pb.Response{Status: 500, Message: "Event emission failure."}
+	}
+
+	return shim.Success(nil)
+}
+
+// settlePartially records settlement of part of quantity of instruction by the book: the instruction becomes
+// partially executed and the remainder of it is matched to be signed and settled as usual, its id is returned.
+// The settled quantity is that of the book, the one given if any must be the same.
+func (t *InstructionChaincode) settlePartially(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	instruction := nsd.Instruction{}
+	args, err := instruction.FillFromIdOrArgs(stub, args)
+	if err == nsd.ErrInstructionNotFound {
+		return pb.Response{Status: 404, Message: err.Error()}
+	} else if err != nil || len(args) > 1 {
+		return pb.Response{Status: 400,
+			Message: "Incorrect number of arguments. Expecting instruction and optionally settled quantity"}
+	}
+
+	if !nsd.CallerIsMainOrg(stub) {
+		return pb.Response{Status: 403, Message: "Partial settlement can be recorded only by main organization."}
+	}
+
+	if err := instruction.LoadFrom(stub); err != nil || instruction.Value.Status == "" {
+		return pb.Response{Status: 404, Message: "Instruction not found."}
+	}
+	if err := revealPrivate(stub, &instruction); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	switch instruction.Value.Status {
+	case nsd.InstructionMatched, nsd.InstructionSigned, nsd.InstructionDownloaded:
+	default:
+		return pb.Response{Status: 406, Message: "Instruction in status " + instruction.Value.Status +
+			" cannot be settled."}
+	}
+	if !instruction.Value.AllowsPartialSettlement() {
+		return pb.Response{Status: 406, Message: "Partial settlement is not allowed by both parties."}
+	}
+
+	compositeKey, err := instruction.ToCompositeKey(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	instruction.Id = nsd.InstructionId(compositeKey)
+
+	rs := nsd.InvokeBook(stub, "settlement", instruction.Id)
+	if rs.Status == 404 {
+		return pb.Response{Status: 409, Message: "Instruction is not settled partially by the book."}
+	}
+	if rs.Status >= 400 {
+		return pb.Response{Status: 400, Message: "Unable to invoke \"book\": " + rs.Message}
+	}
+	settledByBook := nsd.Instruction{}
+	if err := json.Unmarshal(rs.Payload, &settledByBook); err != nil {
+		return shim.Error("Cannot unmarshal response: " + err.Error())
+	}
+	if settledByBook.Value.Status != nsd.InstructionPartiallyExecuted {
+		return pb.Response{Status: 409, Message: "Instruction is not settled partially by the book."}
+	}
+	if len(args) == 1 && args[0] != settledByBook.Value.SettledQuantity {
+		return pb.Response{Status: 409, Message: "The book has settled quantity " +
+			settledByBook.Value.SettledQuantity + "."}
+	}
+
+	settled, err := strconv.Atoi(settledByBook.Value.SettledQuantity)
+	if err != nil {
+		return pb.Response{Status: 400, Message: "Settled quantity must be int."}
+	}
+	remainder, settledAmount, err := instruction.Remainder(settled)
+	if err != nil {
+		return pb.Response{Status: 400, Message: err.Error()}
+	}
+	if remainder.ExistsIn(stub) {
+		return pb.Response{Status: 409, Message: "Remainder of instruction exists already."}
+	}
+
+	remainder.Value = instruction.Value
+	remainder.Value.Status = nsd.InstructionMatched
+	remainder.Value.StatusInfo = ""
+	remainder.Value.Parent = instruction.Id
+	remainder.Value.AlamedaSignatureFrom, remainder.Value.AlamedaSignatureTo = "", ""
+	remainder.Value.TransfererSignatureDownloaded, remainder.Value.ReceiverSignatureDownloaded = false, false
+
+	if err := createAlamedaXMLs(stub, &remainder); err != nil {
+		return pb.Response{Status: 500, Message: "Cannot create Alameda documents: " + err.Error()}
+	}
+	remainder.Value.Sese023From, remainder.Value.Sese023To = createSese023XMLs(&remainder)
+
+	if err := remainder.UpsertIn(stub); err != nil {
+		return pb.Response{Status: 500, Message: "Persistence failure."}
+	}
+	if err := remainder.PutPrivateIn(stub); err != nil {
+		return pb.Response{Status: 500, Message: "Persistence failure."}
+	}
+
+	instruction.Value.Status = nsd.InstructionPartiallyExecuted
+	instruction.Value.SettledQuantity = settledByBook.Value.SettledQuantity
+	instruction.Value.SettledAmount = settledAmount
+	instruction.Value.Remainder = remainder.Id
+	if err := instruction.UpsertIn(stub); err != nil {
+		return pb.Response{Status: 500, Message: "Persistence failure."}
+	}
+
+	if err := instruction.EmitState(stub); err != nil {
+		return pb.Response{Status: 500, Message: "Event emission failure."}
+	}
+
+	return shim.Success([]byte(remainder.Id))
+}
+
+// checkDeponents verifies deponents given by a party are those registered to owners of transferer and receiver balances
+func checkDeponents(stub shim.ChaincodeStubInterface, instruction nsd.Instruction,
+	deponentFrom, deponentTo string) pb.Response {
+
+	if rs := checkDeponent(stub, "transferer", instruction.Key.Transferer, deponentFrom); rs.Status != shim.OK {
+		return rs
+	}
+	return checkDeponent(stub, "receiver", instruction.Key.Receiver, deponentTo)
+}
+
+func checkDeponent(stub shim.ChaincodeStubInterface, party string, balance nsd.Balance, deponent string) pb.Response {
+	registered, err := nsd.GetDeponent(stub, balance)
+	if err != nil {
+		return pb.Response{Status: 500, Message: "Persistence failure."}
+	}
+	if registered == "" {
+		return pb.Response{Status: 400, Message: "Deponent owning " + party + " balance is not registered."}
+	}
+	if registered != deponent {
+		return pb.Response{Status: 400, Message: "Deponent " + deponent + " does not own " + party + " balance."}
+	}
+	return shim.Success(nil)
+}
+
+// transfer submits instruction of the transferer filled by instructionFromArgs from args,
+// repo links it to repo deal if it is a leg of one
+func (t *InstructionChaincode) transfer(stub shim.ChaincodeStubInterface, instruction nsd.Instruction, args []string,
+	repo *nsd.Repo) pb.Response {
 
 	if authenticateCaller(stub, instruction.Key.Transferer) == false {
 		return pb.Response{Status: 403, Message: "Caller must be transferer."}
@@ -520,6 +1584,18 @@ func (t *InstructionChaincode) transfer(stub shim.ChaincodeStubInterface, args [
 
 	argsOffset := len(args) - 4
 
+	if rs := checkDeponents(stub, instruction, args[argsOffset], args[argsOffset + 1]); rs.Status != shim.OK {
+		return rs
+	}
+
+	today, err := txDate(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if rs := checkLimits(stub, instruction, nsd.InitiatorIsTransferer, today); rs.Status != shim.OK {
+		return rs
+	}
+
 	callerOrg, err := getOrganizationName(stub, instruction.Key.Transferer)
 	if err != nil {
 		return pb.Response{Status: 500, Message: "Persistence failure."}
@@ -551,7 +1627,12 @@ func (t *InstructionChaincode) transfer(stub shim.ChaincodeStubInterface, args [
 			return pb.Response{Status: 404, Message: "Instruction not found."}
 		}
 
+		if !sameRepo(instruction.Value.Repo, repo) {
+			return pb.Response{Status: 400, Message: "Repo deal differs from entered by another party."}
+		}
+
 		instruction.Value.MemberInstructionIdFrom = args[argsOffset + 2]
+		instruction.Value.SubmittedFrom = today
 		if err := json.Unmarshal([]byte(args[argsOffset + 3]), &instruction.Value.ReasonFrom); err != nil {
 			return pb.Response{Status: 400, Message: "Wrong arguments."}
 		}
@@ -573,8 +1654,10 @@ func (t *InstructionChaincode) transfer(stub shim.ChaincodeStubInterface, args [
 		instruction.Value.DeponentFrom = args[argsOffset]
 		instruction.Value.DeponentTo = args[argsOffset + 1]
 		instruction.Value.MemberInstructionIdFrom = args[argsOffset + 2]
+		instruction.Value.SubmittedFrom = today
 		instruction.Value.Initiator = nsd.InitiatorIsTransferer
 		instruction.Value.Status = nsd.InstructionInitiated
+		instruction.Value.Repo = repo
 		if err := json.Unmarshal([]byte(args[argsOffset + 3]), &instruction.Value.ReasonFrom); err != nil {
 			return pb.Response{Status: 400, Message: "Wrong arguments."}
 		}
@@ -595,6 +1678,10 @@ func (t *InstructionChaincode) transfer(stub shim.ChaincodeStubInterface, args [
 			return pb.Response{Status: 500, Message: "Persistence failure."}
 		}
 
+		if instruction.PutPrivateIn(stub) != nil {
+			return pb.Response{Status: 500, Message: "Persistence failure."}
+		}
+
 		if err := stub.PutState(referenceKey, []byte("true")); err != nil {
 			return pb.Response{Status: 500, Message: "Persistence failure."}
 		}
@@ -603,7 +1690,7 @@ func (t *InstructionChaincode) transfer(stub shim.ChaincodeStubInterface, args [
 			return pb.Response{Status: 500, Message: "Persistence failure."}
 		}
 
-		return shim.Success(nil)
+		return shim.Success([]byte(instruction.Id))
 	}
 }
 
@@ -612,7 +1699,10 @@ func (t *InstructionChaincode) status(stub shim.ChaincodeStubInterface, args []s
 	logger.Info(args)
 
 	instruction := nsd.Instruction{}
-	if err := instruction.FillFromArgs(args); err != nil {
+	args, err := instruction.FillFromIdOrArgs(stub, args)
+	if err == nsd.ErrInstructionNotFound {
+		return pb.Response{Status: 404, Message: err.Error()}
+	} else if err != nil || len(args) < 1 {
 		return pb.Response{Status: 400, Message: "cannot initialize instruction from args"}
 	}
 
@@ -620,7 +1710,7 @@ func (t *InstructionChaincode) status(stub shim.ChaincodeStubInterface, args []s
 
 	callerIsTransferer := authenticateCaller(stub, instruction.Key.Transferer)
 	callerIsReceiver := authenticateCaller(stub, instruction.Key.Receiver)
-	callerIsMainOrg := certificates.GetCreatorOrganization(stub) == "nsd.nsd.ru"
+	callerIsMainOrg := nsd.CallerIsMainOrg(stub)
 
 	if callerIsTransferer {
 		logger.Info("callerIsTransferer")
@@ -641,14 +1731,8 @@ func (t *InstructionChaincode) status(stub shim.ChaincodeStubInterface, args []s
 		return pb.Response{Status: 404, Message: "Instruction not found."}
 	}
 
-	var expectedArgsLength int
-	if instruction.Key.Type == nsd.InstructionTypeFOP {
-		expectedArgsLength = fopArgsLength + 1
-	} else { // nsd.InstructionTypeDVP
-		expectedArgsLength = dvpArgsLength + 1
-	}
-
-	if len(args) > expectedArgsLength {
+	// status info optionally precedes status
+	if len(args) > 1 {
 		instruction.Value.StatusInfo = args[len(args) - 2]
 	}
 
@@ -686,22 +1770,85 @@ func (t *InstructionChaincode) status(stub shim.ChaincodeStubInterface, args []s
 	return shim.Success(nil)
 }
 
-func (t *InstructionChaincode) check(stub shim.ChaincodeStubInterface, account string, division string, security string,
-	quantity int) bool {
+// applyAlamedaResponse changes status of the instruction Alameda responded to: executed by execution report
+// and declined by rejection, status info is the reason code of the response
+func (t *InstructionChaincode) applyAlamedaResponse(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return pb.Response{Status: 400, Message: "Incorrect number of arguments. Expecting Alameda response document"}
+	}
+
+	if !nsd.CallerIsMainOrg(stub) {
+		return pb.Response{Status: 403, Message: "Alameda responses can be applied only by main organization."}
+	}
 
-	callerIsMainOrg := certificates.GetMyOrganization() == "nsd.nsd.ru"
+	response, err := parseAlamedaResponse([]byte(args[0]))
+	if err != nil {
+		return pb.Response{Status: 400, Message: "Invalid Alameda response: " + err.Error() + "."}
+	}
+	header := response.Documents[0]
+	decision := alamedaDecisionOf(response)
 
-	if callerIsMainOrg {
-		byteArgs := [][]byte{}
-		byteArgs = append(byteArgs, []byte("check"))
-		byteArgs = append(byteArgs, []byte(account))
-		byteArgs = append(byteArgs, []byte(division))
-		byteArgs = append(byteArgs, []byte(security))
-		byteArgs = append(byteArgs, []byte(strconv.Itoa(quantity)))
+	instructions, err := findInstructions(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
 
+	// the response refers to instruction of one of the parties by its member instruction id
+	var found []nsd.Instruction
+	for _, instruction := range instructions {
+		if strings.ToUpper(instruction.Key.Reference) != strings.ToUpper(decision.Reference) {
+			continue
+		}
+		if (instruction.Value.MemberInstructionIdFrom == header.InstructionID &&
+			instruction.Value.DeponentFrom == header.Contragent) ||
+			(instruction.Value.MemberInstructionIdTo == header.InstructionID &&
+				instruction.Value.DeponentTo == header.Contragent) {
+			found = append(found, instruction)
+		}
+	}
+	if len(found) == 0 {
+		return pb.Response{Status: 404, Message: "Instruction not found."}
+	}
+	if len(found) > 1 {
+		return pb.Response{Status: 409, Message: "Response refers to several instructions."}
+	}
+	instruction := found[0]
+
+	switch instruction.Value.Status {
+	case nsd.InstructionMatched, nsd.InstructionSigned, nsd.InstructionDownloaded:
+	default:
+		return pb.Response{Status: 406, Message: "Instruction in status " + instruction.Value.Status +
+			" cannot be settled."}
+	}
+
+	instruction.Value.Status = nsd.InstructionExecuted
+	if header.Rejection != nil {
+		instruction.Value.Status = nsd.InstructionDeclined
+	}
+	instruction.Value.StatusInfo = decision.ReasonCode
+	if decision.Reason != "" {
+		instruction.Value.StatusInfo = strings.TrimSpace(decision.ReasonCode + " " + decision.Reason)
+	}
+
+	if err := instruction.UpsertIn(stub); err != nil {
+		return pb.Response{Status: 500, Message: "Persistence failure."}
+	}
+
+	if err := instruction.EmitState(stub); err != nil {
+		return pb.Response{Status: 500, Message: "Event emission failure."}
+	}
+
+	return shim.Success([]byte(instruction.Id))
+}
+
+func (t *InstructionChaincode) check(stub shim.ChaincodeStubInterface, account string, division string, security string,
+	quantity int) bool {
+
+	// only peers of the main organization have access to "book" chaincode
+	if peerIsMainOrg(stub) {
 		logger.Debugf("BEFORE INVOKE")
 
-		res := stub.InvokeChaincode("book", byteArgs, "depository")
+		res := nsd.InvokeBook(stub, "check", account, division, security, strconv.Itoa(quantity))
 		if res.GetStatus() != 200 {
 			return false
 		}
@@ -712,6 +1859,58 @@ func (t *InstructionChaincode) check(stub shim.ChaincodeStubInterface, account s
 	return true
 }
 
+// peerIsMainOrg checks the endorsing peer belongs to the main organization
+func peerIsMainOrg(stub shim.ChaincodeStubInterface) bool {
+	mainOrg, err := nsd.GetMainOrg(stub)
+	if err != nil {
+		return false
+	}
+	config, err := nsd.GetConfig(stub)
+	if err != nil {
+		return false
+	}
+	mspID := certificates.GetMyMspID(config.PeerCertificate, config.Domain)
+	return mspID != "" && identity.MatchOrganization(mspID, config.Domain, mainOrg)
+}
+
+// callerMaySeePrivate checks the caller is a party of the instruction or the main organization
+func callerMaySeePrivate(stub shim.ChaincodeStubInterface, instruction nsd.Instruction) bool {
+	return authenticateCaller(stub, instruction.Key.Transferer) ||
+		authenticateCaller(stub, instruction.Key.Receiver) ||
+		nsd.CallerIsMainOrg(stub)
+}
+
+// withDocuments creates again Alameda and sese.023 XMLs of matched DVP instruction with value,
+// those are not kept in the ledger
+func withDocuments(stub shim.ChaincodeStubInterface, instruction nsd.Instruction,
+	value nsd.InstructionValue) (nsd.InstructionValue, error) {
+	if !instruction.HasPrivate() || value.MemberInstructionIdFrom == "" || value.MemberInstructionIdTo == "" {
+		return value, nil
+	}
+	instruction.Value = value
+	var err error
+	if value.AlamedaFrom, value.AlamedaTo, err = recreateAlamedaXMLs(stub, &instruction); err != nil {
+		return value, err
+	}
+	value.Sese023From, value.Sese023To = createSese023XMLs(&instruction)
+	return value, nil
+}
+
+// revealPrivate reads requisites and payment amount of DVP instruction from the private data collection
+// for authorised callers, the instruction stays as in the ledger for others
+func revealPrivate(stub shim.ChaincodeStubInterface, instruction *nsd.Instruction) error {
+	if instruction.Key.PrivateHash == "" || !callerMaySeePrivate(stub, *instruction) {
+		return nil
+	}
+
+	if err := instruction.LoadPrivateFrom(stub); err != nil {
+		return err
+	}
+	value, err := withDocuments(stub, *instruction, instruction.Value)
+	instruction.Value = value
+	return err
+}
+
 //TODO: move this code to common package
 func (t *InstructionChaincode) query(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 	it, err := stub.GetStateByPartialCompositeKey(nsd.InstructionIndex, []string{})
@@ -740,10 +1939,11 @@ func (t *InstructionChaincode) query(stub shim.ChaincodeStubInterface, args []st
 		if err := instruction.FillFromCompositeKeyParts(compositeKeyParts); err != nil {
 			return shim.Error(err.Error())
 		}
+		instruction.Id = nsd.InstructionId(response.Key)
 
 		callerIsTransferer := authenticateCaller(stub, instruction.Key.Transferer)
 		callerIsReceiver := authenticateCaller(stub, instruction.Key.Receiver)
-		callerIsMainOrg := certificates.GetCreatorOrganization(stub) == "nsd.nsd.ru"
+		callerIsMainOrg := nsd.CallerIsMainOrg(stub)
 
 		logger.Debug(callerIsTransferer, callerIsReceiver, callerIsMainOrg)
 
@@ -751,6 +1951,10 @@ func (t *InstructionChaincode) query(stub shim.ChaincodeStubInterface, args []st
 			continue
 		}
 
+		if err := revealPrivate(stub, &instruction); err != nil {
+			return shim.Error(err.Error())
+		}
+
 		if (callerIsTransferer && instruction.Value.Initiator == nsd.InitiatorIsTransferer) ||
 			(callerIsReceiver && instruction.Value.Initiator == nsd.InitiatorIsReceiver) ||
 			(instruction.Value.Status == nsd.InstructionMatched) ||
@@ -802,9 +2006,95 @@ func (t *InstructionChaincode) queryByType(stub shim.ChaincodeStubInterface, arg
 			return shim.Error(err.Error())
 		}
 
-		if instruction.Value.Status == expectedStatus {
-			instructions = append(instructions, instruction)
+		if instruction.Value.Status != expectedStatus {
+			continue
+		}
+
+		_, compositeKeyParts, err := stub.SplitCompositeKey(response.Key)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if err := instruction.FillFromCompositeKeyParts(compositeKeyParts); err != nil {
+			return shim.Error(err.Error())
+		}
+		instruction.Id = nsd.InstructionId(response.Key)
+		if err := revealPrivate(stub, &instruction); err != nil {
+			return shim.Error(err.Error())
+		}
+
+		instructions = append(instructions, instruction)
+	}
+
+	result, err := json.Marshal(instructions)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(result)
+}
+
+// queryDueForSettlement returns instructions matched but not executed yet which settle on the day or are overdue,
+// the settlement date of those matched before it was recorded is found by the calendar of "security" chaincode
+func (t *InstructionChaincode) queryDueForSettlement(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return pb.Response{Status: 400, Message: "Incorrect number of arguments. Expecting date"}
+	}
+	day := args[0]
+	if _, err := time.Parse("2006-01-02", day); err != nil {
+		return pb.Response{Status: 400, Message: "Date must be in format 2006-01-02."}
+	}
+
+	calendar, err := nsd.GetCalendar(stub)
+	if err != nil {
+		return pb.Response{Status: 500, Message: "Unable to get calendar: " + err.Error()}
+	}
+
+	it, err := stub.GetStateByPartialCompositeKey(nsd.InstructionIndex, []string{})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer it.Close()
+
+	instructions := []nsd.Instruction{}
+	for it.HasNext() {
+		response, err := it.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		instruction := nsd.Instruction{}
+		if err := instruction.FillFromLedgerValue(response.Value); err != nil {
+			return shim.Error(err.Error())
+		}
+
+		switch instruction.Value.Status {
+		case nsd.InstructionMatched, nsd.InstructionSigned, nsd.InstructionDownloaded:
+		default:
+			continue
+		}
+
+		_, compositeKeyParts, err := stub.SplitCompositeKey(response.Key)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if err := instruction.FillFromCompositeKeyParts(compositeKeyParts); err != nil {
+			return shim.Error(err.Error())
+		}
+
+		if instruction.Value.SettlementDate == "" {
+			if instruction.Value.SettlementDate, err = calendar.SettlementDate(instruction.Key); err != nil {
+				continue
+			}
+		}
+		if instruction.Value.SettlementDate > day {
+			continue
+		}
+
+		instruction.Id = nsd.InstructionId(response.Key)
+		if err := revealPrivate(stub, &instruction); err != nil {
+			return shim.Error(err.Error())
 		}
+
+		instructions = append(instructions, instruction)
 	}
 
 	result, err := json.Marshal(instructions)
@@ -817,7 +2107,9 @@ func (t *InstructionChaincode) queryByType(stub shim.ChaincodeStubInterface, arg
 //TODO: move this code to common package
 func (t *InstructionChaincode) history(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 	instruction := nsd.Instruction{}
-	if err := instruction.FillFromArgs(args); err != nil {
+	if _, err := instruction.FillFromIdOrArgs(stub, args); err == nsd.ErrInstructionNotFound {
+		return pb.Response{Status: 404, Message: err.Error()}
+	} else if err != nil {
 		return pb.Response{Status: 400, Message: "cannot initialize instruction from args"}
 	}
 
@@ -832,6 +2124,12 @@ func (t *InstructionChaincode) history(stub shim.ChaincodeStubInterface, args []
 	}
 	defer it.Close()
 
+	// Alameda and sese.023 XMLs made of the private part are not in the ledger
+	if err := revealPrivate(stub, &instruction); err != nil {
+		return shim.Error(err.Error())
+	}
+	revealed := instruction.Key.PrivateHash != "" && callerMaySeePrivate(stub, instruction)
+
 	modifications := []nsd.InstructionHistoryValue{}
 
 	for it.HasNext() {
@@ -846,28 +2144,358 @@ func (t *InstructionChaincode) history(stub shim.ChaincodeStubInterface, args []
 		entry.IsDelete = response.GetIsDelete()
 		ts := response.GetTimestamp()
 
-		if ts != nil {
-			entry.Timestamp = time.Unix(ts.Seconds, int64(ts.Nanos)).String()
-		}
+		if ts != nil {
+			entry.Timestamp = time.Unix(ts.Seconds, int64(ts.Nanos)).String()
+		}
+
+		err = nsd.UnmarshalValue(nsd.InstructionIndex, response.GetValue(), &entry.Value)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		if revealed {
+			if entry.Value, err = withDocuments(stub, instruction, entry.Value); err != nil {
+				return shim.Error(err.Error())
+			}
+		}
+
+		modifications = append(modifications, entry)
+	}
+
+	result, err := json.Marshal(modifications)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(result)
+}
+
+// exportingParty tells side of instruction the caller exports: given in args or the caller's one,
+// only the party itself or the main organization may export it
+func exportingParty(stub shim.ChaincodeStubInterface, instruction nsd.Instruction, args []string) (string, pb.Response) {
+	isTransferer := authenticateCaller(stub, instruction.Key.Transferer)
+	isReceiver := authenticateCaller(stub, instruction.Key.Receiver)
+
+	party := ""
+	if len(args) == 1 {
+		party = args[0]
+	} else if isTransferer && !isReceiver {
+		party = "transferer"
+	} else if isReceiver && !isTransferer {
+		party = "receiver"
+	}
+
+	if party == "" {
+		return "", pb.Response{Status: 400, Message: "Party is required: transferer or receiver."}
+	}
+	if party != "transferer" && party != "receiver" {
+		return "", pb.Response{Status: 400, Message: "Invalid party."}
+	}
+	if !(party == "transferer" && isTransferer) && !(party == "receiver" && isReceiver) && !nsd.CallerIsMainOrg(stub) {
+		return "", pb.Response{Status: 403, Message: "Instruction can be exported only by its party or main organization."}
+	}
+
+	return party, shim.Success(nil)
+}
+
+// exportAlameda returns Alameda document of the caller's side of matched instruction in Windows-1251,
+// the main organization or a party of both sides chooses the side by the last argument
+func (t *InstructionChaincode) exportAlameda(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	instruction := nsd.Instruction{}
+	rest, err := instruction.FillFromIdOrArgs(stub, args)
+	if err == nsd.ErrInstructionNotFound {
+		return pb.Response{Status: 404, Message: err.Error()}
+	} else if err != nil || len(rest) > 1 {
+		return pb.Response{Status: 400, Message: "cannot initialize instruction from args"}
+	}
+
+	if err := instruction.LoadFrom(stub); err != nil {
+		return pb.Response{Status: 404, Message: "Instruction not found."}
+	}
+
+	party, rs := exportingParty(stub, instruction, rest)
+	if rs.Status != shim.OK {
+		return rs
+	}
+
+	if err := revealPrivate(stub, &instruction); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	document := instruction.Value.AlamedaTo
+	if party == "transferer" {
+		document = instruction.Value.AlamedaFrom
+	}
+	if document == "" {
+		return pb.Response{Status: 404, Message: "Instruction is not matched."}
+	}
+
+	return shim.Success(exportAlamedaXML(document))
+}
+
+// exportMT renders instruction as SWIFT MT540-MT543 settlement instruction of the caller's side,
+// the main organization or a party of both sides chooses the side by the last argument
+func (t *InstructionChaincode) exportMT(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	instruction := nsd.Instruction{}
+	rest, err := instruction.FillFromIdOrArgs(stub, args)
+	if err == nsd.ErrInstructionNotFound {
+		return pb.Response{Status: 404, Message: err.Error()}
+	} else if err != nil || len(rest) > 1 {
+		return pb.Response{Status: 400, Message: "cannot initialize instruction from args"}
+	}
+
+	if err := instruction.LoadFrom(stub); err != nil {
+		return pb.Response{Status: 404, Message: "Instruction not found."}
+	}
+
+	party, rs := exportingParty(stub, instruction, rest)
+	if rs.Status != shim.OK {
+		return rs
+	}
+
+	if err := revealPrivate(stub, &instruction); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	type export struct {
+		MessageType string `json:"messageType"`
+		Message     string `json:"message"`
+	}
+	var result export
+	result.MessageType, result.Message = createMT(&instruction, party)
+
+	data, err := json.Marshal(result)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(data)
+}
+
+// order of statuses instructions pass through, link group is in the earliest status of its instructions
+var statusOrder = map[string]int{
+	nsd.InstructionInitiated:  0,
+	nsd.InstructionMatched:    1,
+	nsd.InstructionSigned:     2,
+	nsd.InstructionDownloaded: 3,
+	nsd.InstructionExecuted:   4,
+}
+
+// findGroup reads instructions of link group
+func findGroup(stub shim.ChaincodeStubInterface, group string) ([]nsd.Instruction, error) {
+	instructions, err := findInstructions(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	members := []nsd.Instruction{}
+	for _, instruction := range instructions {
+		if instruction.Value.LinkGroup == group {
+			members = append(members, instruction)
+		}
+	}
+	return members, nil
+}
+
+// groupStatus is the earliest status of instructions of link group, so the group is matched or signed
+// only when all of them are; a status off the way (declined, canceled, rollback) of any of them is that of the group
+func groupStatus(members []nsd.Instruction) string {
+	status := nsd.InstructionExecuted
+	for _, instruction := range members {
+		order, ok := statusOrder[instruction.Value.Status]
+		if !ok {
+			return instruction.Value.Status
+		}
+		if order < statusOrder[status] {
+			status = instruction.Value.Status
+		}
+	}
+	return status
+}
+
+// linkEvent is emitted by link and unlink with the instructions changed, linked ones have linkGroup
+// and those waiting for consent of the counterparty have only the group of the caller's side
+type linkEvent struct {
+	Group        string            `json:"group"`
+	Instructions []nsd.Instruction `json:"instructions"`
+}
+
+// link puts instructions given by ids in link group to settle them together once both parties of each of them
+// link it to the group, the caller is a party of all of them. Instructions must be initiated or matched
+// and not linked to another group yet. Returns ids of the instructions linked by both parties
+func (t *InstructionChaincode) link(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) < 2 {
+		return pb.Response{Status: 400, Message: "Incorrect number of arguments. Expecting group id and instruction ids"}
+	}
+	group := args[0]
+
+	return changeLinks(stub, "link", group, args[1:], func(instruction *nsd.Instruction) pb.Response {
+		if instruction.Value.LinkGroup != "" && instruction.Value.LinkGroup != group {
+			return pb.Response{Status: 409, Message: "Instruction is linked to group " + instruction.Value.LinkGroup}
+		}
+
+		if authenticateCaller(stub, instruction.Key.Transferer) {
+			instruction.Value.LinkGroupFrom = group
+		}
+		if authenticateCaller(stub, instruction.Key.Receiver) {
+			instruction.Value.LinkGroupTo = group
+		}
+		if instruction.Value.LinkGroupFrom == group && instruction.Value.LinkGroupTo == group {
+			instruction.Value.LinkGroup = group
+		}
+		return shim.Success(nil)
+	})
+}
+
+// unlink takes instructions given by ids out of their link group, or withdraws the request of the caller's side
+// to link them, while they are initiated or matched. The caller has to link them again to put them back
+func (t *InstructionChaincode) unlink(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) < 1 {
+		return pb.Response{Status: 400, Message: "Incorrect number of arguments. Expecting instruction ids"}
+	}
+
+	return changeLinks(stub, "unlink", "", args, func(instruction *nsd.Instruction) pb.Response {
+		if authenticateCaller(stub, instruction.Key.Transferer) {
+			instruction.Value.LinkGroupFrom = ""
+		}
+		if authenticateCaller(stub, instruction.Key.Receiver) {
+			instruction.Value.LinkGroupTo = ""
+		}
+		instruction.Value.LinkGroup = ""
+		return shim.Success(nil)
+	})
+}
+
+// changeLinks applies change to the side of the caller of each instruction given by ids and emits linkEvent
+// of the group, for unlink that the first instruction was linked to. Returns ids of the instructions linked by both parties
+func changeLinks(stub shim.ChaincodeStubInterface, name string, group string, ids []string,
+	change func(instruction *nsd.Instruction) pb.Response) pb.Response {
+
+	event := linkEvent{Group: group, Instructions: []nsd.Instruction{}}
+	linked := []string{}
+	for _, id := range ids {
+		instruction := nsd.Instruction{}
+		if rest, err := instruction.FillFromIdOrArgs(stub, []string{id}); err == nsd.ErrInstructionNotFound {
+			return pb.Response{Status: 404, Message: err.Error()}
+		} else if err != nil || len(rest) != 0 {
+			return pb.Response{Status: 400, Message: "cannot initialize instruction from args"}
+		}
+
+		if err := instruction.LoadFrom(stub); err != nil {
+			return pb.Response{Status: 404, Message: "Instruction not found."}
+		}
+
+		if !authenticateCaller(stub, instruction.Key.Transferer) && !authenticateCaller(stub, instruction.Key.Receiver) {
+			return pb.Response{Status: 403, Message: "Caller must be a party of every instruction linked."}
+		}
+
+		if instruction.Value.Status != nsd.InstructionInitiated && instruction.Value.Status != nsd.InstructionMatched {
+			return pb.Response{Status: 406, Message: "Instruction in status " + instruction.Value.Status +
+				" cannot be linked or unlinked."}
+		}
+
+		for _, linkGroup := range []string{instruction.Value.LinkGroup, instruction.Value.LinkGroupFrom,
+			instruction.Value.LinkGroupTo} {
+			if event.Group == "" {
+				event.Group = linkGroup
+			}
+		}
+		if response := change(&instruction); response.Status != shim.OK {
+			return response
+		}
+
+		if err := instruction.UpsertIn(stub); err != nil {
+			return pb.Response{Status: 500, Message: "Persistence failure."}
+		}
+		event.Instructions = append(event.Instructions, instruction.Public())
+		if instruction.Value.LinkGroup != "" {
+			linked = append(linked, instruction.Id)
+		}
+	}
+
+	data, err := json.Marshal(event)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if err := stub.SetEvent(nsd.InstructionIndex+"."+name, data); err != nil {
+		return pb.Response{Status: 500, Message: "Event emission failure."}
+	}
+
+	result, err := json.Marshal(linked)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(result)
+}
+
+// queryGroup returns status of link group along with ids and statuses of its instructions
+func (t *InstructionChaincode) queryGroup(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return pb.Response{Status: 400, Message: "Incorrect number of arguments. Expecting group id"}
+	}
+
+	members, err := findGroup(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if len(members) == 0 {
+		return pb.Response{Status: 404, Message: "Group not found."}
+	}
+
+	type memberStatus struct {
+		Id     string `json:"id"`
+		Status string `json:"status"`
+	}
+	type groupResult struct {
+		Group        string         `json:"group"`
+		Status       string         `json:"status"`
+		Instructions []memberStatus `json:"instructions"`
+	}
+
+	result := groupResult{Group: args[0], Status: groupStatus(members), Instructions: []memberStatus{}}
+	for _, instruction := range members {
+		result.Instructions = append(result.Instructions, memberStatus{Id: instruction.Id, Status: instruction.Value.Status})
+	}
+
+	data, err := json.Marshal(result)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(data)
+}
+
+// queryById returns instruction by id to its parties and the main organization, book chaincode settles
+// instructions as they are recorded here
+func (t *InstructionChaincode) queryById(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return pb.Response{Status: 400, Message: "Incorrect number of arguments. Expecting instruction id"}
+	}
 
-		err = json.Unmarshal(response.GetValue(), &entry.Value)
-		if err != nil {
-			return shim.Error(err.Error())
-		}
+	instruction := nsd.Instruction{}
+	if _, err := instruction.FillFromIdOrArgs(stub, args); err != nil {
+		return pb.Response{Status: 404, Message: "Instruction not found."}
+	}
+	if err := instruction.LoadFrom(stub); err != nil || instruction.Value.Status == "" {
+		return pb.Response{Status: 404, Message: "Instruction not found."}
+	}
+	if !callerMaySeePrivate(stub, instruction) {
+		return pb.Response{Status: 403, Message: "Instruction is available only to its parties."}
+	}
 
-		modifications = append(modifications, entry)
+	if err := revealPrivate(stub, &instruction); err != nil {
+		return shim.Error(err.Error())
 	}
 
-	result, err := json.Marshal(modifications)
+	data, err := json.Marshal(instruction)
 	if err != nil {
 		return shim.Error(err.Error())
 	}
-	return shim.Success(result)
+	return shim.Success(data)
 }
 
 func (t *InstructionChaincode) sign(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 	instruction := nsd.Instruction{}
-	if err := instruction.FillFromArgs(args); err != nil {
+	if rest, err := instruction.FillFromIdOrArgs(stub, args); err == nsd.ErrInstructionNotFound {
+		return pb.Response{Status: 404, Message: err.Error()}
+	} else if err != nil || len(rest) != 1 {
 		return pb.Response{Status: 400, Message: "cannot initialize instruction from args"}
 	}
 
@@ -905,18 +2533,18 @@ func (t *InstructionChaincode) sign(stub shim.ChaincodeStubInterface, args []str
 }
 
 func (t *InstructionChaincode) rollback(stub shim.ChaincodeStubInterface, args []string) pb.Response {
-	rs := stub.InvokeChaincode("book", [][]byte{[]byte("mainOrg")}, "depository")
-	if rs.Status >= 400 {
-		return pb.Response{Status: 400, Message: "Unable to invoke \"book\": " + rs.Message}
+	if rs := nsd.AuthorizeMainOrg(stub, "roll back Instructions"); rs.Status != shim.OK {
+		return rs
 	}
 
-	mainOrg := string(rs.Payload)
-	if certificates.GetCreatorOrganization(stub) != mainOrg {
-		return pb.Response{Status: 403, Message: "Instruction can be rolled back only by " + mainOrg + " ."}
+	if len(args) < 1 {
+		return pb.Response{Status: 400, Message: "Incorrect number of arguments."}
 	}
 
 	instruction := nsd.Instruction{}
-	if err := instruction.FillFromArgs(args); err != nil {
+	if _, err := instruction.FillFromIdOrArgs(stub, args); err == nsd.ErrInstructionNotFound {
+		return pb.Response{Status: 404, Message: err.Error()}
+	} else if err != nil {
 		return pb.Response{Status: 400, Message: "Wrong arguments."}
 	}
 
@@ -941,85 +2569,142 @@ func (t *InstructionChaincode) rollback(stub shim.ChaincodeStubInterface, args [
 }
 
 func (t *InstructionChaincode) addBalances(stub shim.ChaincodeStubInterface, args []string) pb.Response {
-	rs := stub.InvokeChaincode("book", [][]byte{[]byte("mainOrg")}, "depository")
-	if rs.Status >= 400 {
-		return pb.Response{Status: 400, Message: "Unable to invoke \"book\": " + rs.Message}
+	if rs := nsd.AuthorizeMainOrg(stub, "change balances"); rs.Status != shim.OK {
+		return rs
 	}
 
-	if certificates.GetCreatorOrganization(stub) != string(rs.Payload) {
-		return pb.Response{Status: 403, Message: "Insufficient privileges."}
+	if len(args) < 1 {
+		return pb.Response{Status: 400, Message: "Incorrect number of arguments."}
 	}
 
-	type Organization struct {
-		Name     string        `json:"organization"`
-		Balances []nsd.Balance `json:"balances"`
+	var organizations []nsd.Organization
+	if err := json.Unmarshal([]byte(args[0]), &organizations); err != nil || len(organizations) == 0 {
+		return pb.Response{Status: 400, Message: "JSON unmarshalling error."}
 	}
 
-	var organizations []Organization
-	if err := json.Unmarshal([]byte(args[0]), &organizations); err == nil && len(organizations) != 0 {
-		for _, organization := range organizations {
-			for _, balance := range organization.Balances {
-				keyParts := []string{balance.Account, balance.Division}
-				if key, err := stub.CreateCompositeKey(authenticationIndex, keyParts); err == nil {
-					if err := stub.PutState(key, []byte(organization.Name)); err != nil {
-						return pb.Response{Status: 500, Message: "Persistence failure."}
-					}
-				}
-			}
-		}
-	} else {
+	return t.balanceRegistry().ProposeBalanceChange(stub, nsd.BalanceChangeAdd, organizations)
+}
+
+func (t *InstructionChaincode) removeBalances(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if rs := nsd.AuthorizeMainOrg(stub, "change balances"); rs.Status != shim.OK {
+		return rs
+	}
+
+	if len(args) < 1 {
+		return pb.Response{Status: 400, Message: "Incorrect number of arguments."}
+	}
+
+	var organizations []nsd.Organization
+	if err := json.Unmarshal([]byte(args[0]), &organizations); err != nil || len(organizations) == 0 {
 		return pb.Response{Status: 400, Message: "JSON unmarshalling error."}
 	}
 
-	return shim.Success(nil)
+	return t.balanceRegistry().ProposeBalanceChange(stub, nsd.BalanceChangeRemove, organizations)
 }
 
-func (t *InstructionChaincode) removeBalances(stub shim.ChaincodeStubInterface, args []string) pb.Response {
-	rs := stub.InvokeChaincode("book", [][]byte{[]byte("mainOrg")}, "depository")
-	if rs.Status >= 400 {
-		return pb.Response{Status: 400, Message: "Unable to invoke \"book\": " + rs.Message}
+// findInstructions returns every instruction stored on the channel
+func findInstructions(stub shim.ChaincodeStubInterface) ([]nsd.Instruction, error) {
+	it, err := stub.GetStateByPartialCompositeKey(nsd.InstructionIndex, []string{})
+	if err != nil {
+		return nil, err
+	}
+	defer it.Close()
+
+	instructions := []nsd.Instruction{}
+	for it.HasNext() {
+		response, err := it.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		instruction := nsd.Instruction{}
+		if err := instruction.FillFromLedgerValue(response.Value); err != nil {
+			return nil, err
+		}
+		_, compositeKeyParts, err := stub.SplitCompositeKey(response.Key)
+		if err != nil {
+			return nil, err
+		}
+		if err := instruction.FillFromCompositeKeyParts(compositeKeyParts); err != nil {
+			return nil, err
+		}
+		instruction.Id = nsd.InstructionId(response.Key)
+		if err := instruction.LoadPrivateFrom(stub); err != nil {
+			return nil, err
+		}
+
+		instructions = append(instructions, instruction)
 	}
+	return instructions, nil
+}
+
+// balances are changed with consent of organizations gaining or losing them
+func (t *InstructionChaincode) balanceRegistry() nsd.BalanceRegistry {
+	return nsd.BalanceRegistry{CheckRemoval: t.checkBalanceRemoval}
+}
 
-	if certificates.GetCreatorOrganization(stub) != string(rs.Payload) {
-		return pb.Response{Status: 403, Message: "Insufficient privileges."}
+func isOpen(instruction nsd.Instruction) bool {
+	switch instruction.Value.Status {
+	case nsd.InstructionInitiated, nsd.InstructionMatched, nsd.InstructionSigned, nsd.InstructionDownloaded,
+		nsd.InstructionRollbackInitiated:
+		return true
 	}
+	return false
+}
 
-	type Organization struct {
-		Name     string        `json:"organization"`
-		Balances []nsd.Balance `json:"balances"`
+// checkBalanceRemoval refuses removal of a balance which is a party of open instructions or holds securities in book
+func (t *InstructionChaincode) checkBalanceRemoval(stub shim.ChaincodeStubInterface, balance nsd.Balance) pb.Response {
+	instructions, err := findInstructions(stub)
+	if err != nil {
+		return shim.Error(err.Error())
 	}
 
-	var organizations []Organization
-	if err := json.Unmarshal([]byte(args[0]), &organizations); err == nil && len(organizations) != 0 {
-		for _, organization := range organizations {
-			for _, balance := range organization.Balances {
-				keyParts := []string{balance.Account, balance.Division}
-				if key, err := stub.CreateCompositeKey(authenticationIndex, keyParts); err == nil {
-					if err := stub.DelState(key); err != nil {
-						return pb.Response{Status: 500, Message: "Persistence failure."}
-					}
-				}
-			}
+	for _, instruction := range instructions {
+		if isOpen(instruction) && (instruction.Key.Transferer == balance || instruction.Key.Receiver == balance) {
+			return pb.Response{Status: 409, Message: "Balance " + balance.Account + "/" + balance.Division +
+				" has open instructions."}
+		}
+	}
+
+	// only peers of the main organization have access to "book" chaincode
+	if !peerIsMainOrg(stub) {
+		return shim.Success(nil)
+	}
+
+	res := nsd.InvokeBook(stub, "query")
+	if res.Status != shim.OK {
+		return pb.Response{Status: 500, Message: "Unable to query book: " + res.Message}
+	}
+
+	var positions []nsd.Position
+	if err := json.Unmarshal(res.Payload, &positions); err != nil {
+		return pb.Response{Status: 500, Message: "JSON unmarshalling error."}
+	}
+	for _, position := range positions {
+		if position.Balance == balance && position.Quantity != 0 {
+			return pb.Response{Status: 409, Message: "Balance " + balance.Account + "/" + balance.Division +
+				" holds " + position.Security + " in book."}
 		}
-	} else {
-		return pb.Response{Status: 400, Message: "JSON unmarshalling error."}
 	}
 
 	return shim.Success(nil)
 }
 
 func (t *InstructionChaincode) getBalances(stub shim.ChaincodeStubInterface, args []string) pb.Response {
-	it, err := stub.GetStateByPartialCompositeKey(authenticationIndex, []string{})
+	it, err := stub.GetStateByPartialCompositeKey(nsd.AuthenticationIndex, []string{})
 	if err != nil {
 		return shim.Error(err.Error())
 	}
 	defer it.Close()
 
 	type queryResult struct {
-		Name    string      `json:"organization"`
-		Balance nsd.Balance `json:"balance"`
+		Name     string            `json:"organization"`
+		Deponent string            `json:"deponent"`
+		Metadata map[string]string `json:"metadata,omitempty"`
+		Balance  nsd.Balance       `json:"balance"`
 	}
 
+	organizations := map[string]nsd.Organization{}
 	results := []queryResult{}
 	for it.HasNext() {
 		response, err := it.Next()
@@ -1029,7 +2714,18 @@ func (t *InstructionChaincode) getBalances(stub shim.ChaincodeStubInterface, arg
 
 		result := queryResult{}
 
-		result.Name = string(response.Value)
+		if err := nsd.UnmarshalValue(nsd.AuthenticationIndex, response.Value, &result.Name); err != nil {
+			return shim.Error(err.Error())
+		}
+
+		organization, ok := organizations[result.Name]
+		if !ok {
+			if organization, err = nsd.GetOrganization(stub, result.Name); err != nil {
+				return pb.Response{Status: 500, Message: "Persistence failure."}
+			}
+			organizations[result.Name] = organization
+		}
+		result.Deponent, result.Metadata = organization.Deponent, organization.Metadata
 
 		_, compositeKeyParts, err := stub.SplitCompositeKey(response.Key)
 		if err != nil || len(compositeKeyParts) < 2 {
@@ -1048,13 +2744,14 @@ func (t *InstructionChaincode) getBalances(stub shim.ChaincodeStubInterface, arg
 	return shim.Success(payload)
 }
 func (t *InstructionChaincode) updateDownloadFlags(stub shim.ChaincodeStubInterface, args []string) pb.Response {
-	callerIsMainOrg := certificates.GetCreatorOrganization(stub) == "nsd.nsd.ru"
-	if !callerIsMainOrg {
+	if !nsd.CallerIsMainOrg(stub) {
 		return pb.Response{Status: 403, Message: "Download flags can be changed only by main organization."}
 	}
 
 	instruction := nsd.Instruction{}
-	if err := instruction.FillFromArgs(args); err != nil {
+	if rest, err := instruction.FillFromIdOrArgs(stub, args); err == nsd.ErrInstructionNotFound {
+		return pb.Response{Status: 404, Message: err.Error()}
+	} else if err != nil || len(rest) != 1 {
 		return pb.Response{Status: 400, Message: "cannot initialize instruction from args"}
 	}
 
@@ -1100,6 +2797,14 @@ func deleteInstructionFromLedger(stub shim.ChaincodeStubInterface, instruction n
 		return err
 	}
 
+	if err = instruction.DelPrivateFrom(stub); err != nil {
+		return err
+	}
+
+	if err = instruction.DelIdFrom(stub); err != nil {
+		return err
+	}
+
 	var initiatorBalance nsd.Balance
 	var instructionId string
 	if instruction.Value.Initiator == nsd.InitiatorIsReceiver {
@@ -1147,30 +2852,336 @@ func deleteInstructionFromLedger(stub shim.ChaincodeStubInterface, instruction n
 	return nil
 }
 
+// instructionIndexKeys are keys of the reference and the member instruction id of each party submitted instruction,
+// these keep both unique for the organization on the instruction date
+func instructionIndexKeys(stub shim.ChaincodeStubInterface, instruction nsd.Instruction) ([]string, error) {
+	sides := []struct {
+		balance       nsd.Balance
+		instructionId string
+	}{
+		{instruction.Key.Transferer, instruction.Value.MemberInstructionIdFrom},
+		{instruction.Key.Receiver, instruction.Value.MemberInstructionIdTo},
+	}
+
+	var keys []string
+	for _, side := range sides {
+		if side.instructionId == "" {
+			continue
+		}
+
+		organization, err := getOrganizationName(stub, side.balance)
+		if err != nil {
+			return nil, err
+		}
+
+		referenceKey, err := stub.CreateCompositeKey(referenceIndex, []string{instruction.Key.Reference, organization,
+			instruction.Key.InstructionDate, instruction.Key.TradeDate})
+		if err != nil {
+			return nil, err
+		}
+		instructionIdKey, err := stub.CreateCompositeKey(instructionIdIndex, []string{side.instructionId, organization,
+			instruction.Key.InstructionDate})
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, referenceKey, instructionIdKey)
+	}
+	return keys, nil
+}
+
 func getOrganizationName(stub shim.ChaincodeStubInterface, callerBalance nsd.Balance) (string, error) {
-	keyParts := []string{callerBalance.Account, callerBalance.Division}
+	return nsd.GetOrganizationName(stub, callerBalance)
+}
+
+func authenticateCaller(stub shim.ChaincodeStubInterface, callerBalance nsd.Balance) bool {
+	return nsd.AuthenticateCaller(stub, callerBalance)
+}
 
-	key, err := stub.CreateCompositeKey(authenticationIndex, keyParts)
+func getLimits(stub shim.ChaincodeStubInterface, organization string) (Limits, error) {
+	limits := Limits{Organization: organization}
+
+	key, err := stub.CreateCompositeKey(limitsIndex, []string{organization})
 	if err != nil {
-		return "", err
+		return limits, err
 	}
 
 	data, err := stub.GetState(key)
+	if err != nil || len(data) == 0 {
+		return limits, err
+	}
+
+	err = nsd.UnmarshalValue(limitsIndex, data, &limits)
+	return limits, err
+}
+
+// uploadTemplate adds next version of template of Alameda documents of the side of instructions of the type,
+// instructions matched since then get documents made with it
+func (t *InstructionChaincode) uploadTemplate(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if rs := nsd.AuthorizeMainOrg(stub, "upload templates"); rs.Status != shim.OK {
+		return rs
+	}
+
+	if len(args) != 3 {
+		return pb.Response{Status: 400, Message: "Incorrect number of arguments. Expecting type, side and template"}
+	}
+
+	instructionType, side := args[0], args[1]
+	if instructionType != nsd.InstructionTypeFOP && instructionType != nsd.InstructionTypeDVP {
+		return pb.Response{Status: 400, Message: "Invalid instruction type."}
+	}
+	if side != "transferer" && side != "receiver" {
+		return pb.Response{Status: 400, Message: "Invalid party."}
+	}
+
+	latest, err := getAlamedaTemplate(stub, instructionType, side, 0)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	uploaded := AlamedaTemplate{Type: instructionType, Side: side, Version: latest.Version + 1, Template: args[2]}
+
+	// the template must be executable with any instruction
+	sample := nsd.Instruction{Key: nsd.InstructionKey{Type: instructionType}}
+	if _, err := uploaded.execute(&sample); err != nil {
+		return pb.Response{Status: 400, Message: "Invalid template: " + err.Error()}
+	}
+
+	if err := putAlamedaTemplate(stub, uploaded); err != nil {
+		return pb.Response{Status: 500, Message: "Persistence failure."}
+	}
+
+	return shim.Success([]byte(strconv.Itoa(uploaded.Version)))
+}
+
+// templates returns all versions of templates of Alameda documents, of the type and the side if given
+func (t *InstructionChaincode) templates(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) > 2 {
+		return pb.Response{Status: 400, Message: "Incorrect number of arguments. Expecting optional type and side"}
+	}
+
+	templates, err := findAlamedaTemplates(stub, args...)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	sort.Slice(templates, func(i, j int) bool {
+		if templates[i].Type != templates[j].Type {
+			return templates[i].Type < templates[j].Type
+		}
+		if templates[i].Side != templates[j].Side {
+			return templates[i].Side < templates[j].Side
+		}
+		return templates[i].Version < templates[j].Version
+	})
+
+	data, err := json.Marshal(templates)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(data)
+}
+
+// setLimits replaces limits of every organization given, see Limits
+func (t *InstructionChaincode) setLimits(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if rs := nsd.AuthorizeMainOrg(stub, "set limits"); rs.Status != shim.OK {
+		return rs
+	}
+
+	if len(args) != 1 {
+		return pb.Response{Status: 400, Message: "Incorrect number of arguments. Expecting limits as JSON array"}
+	}
+
+	var limits []Limits
+	if err := json.Unmarshal([]byte(args[0]), &limits); err != nil || len(limits) == 0 {
+		return pb.Response{Status: 400, Message: "JSON unmarshalling error."}
+	}
+
+	for _, l := range limits {
+		if l.Organization == "" || l.MaxQuantity < 0 {
+			return pb.Response{Status: 400, Message: "Limits must name organization and cannot be negative."}
+		}
+		for _, max := range l.MaxDailyDvp {
+			if max < 0 {
+				return pb.Response{Status: 400, Message: "Limits must name organization and cannot be negative."}
+			}
+		}
+
+		key, err := stub.CreateCompositeKey(limitsIndex, []string{l.Organization})
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		data, err := nsd.MarshalValue(limitsIndex, l)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if err := stub.PutState(key, data); err != nil {
+			return pb.Response{Status: 500, Message: "Persistence failure."}
+		}
+	}
+
+	return shim.Success(nil)
+}
+
+// txDate is the day of the transaction, daily limits count instructions by it rather than by dates they name
+func txDate(stub shim.ChaincodeStubInterface) (string, error) {
+	txTimestamp, err := stub.GetTxTimestamp()
 	if err != nil {
 		return "", err
 	}
+	return time.Unix(txTimestamp.Seconds, int64(txTimestamp.Nanos)).UTC().Format("2006-01-02"), nil
+}
+
+// dailyDvp sums payment amounts of DVP instructions organization submitted its side of on date by currency,
+// canceled and declined instructions are not counted
+func dailyDvp(stub shim.ChaincodeStubInterface, organization string, date string) (map[string]nsd.Amount, error) {
+	instructions, err := findInstructions(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	usage := map[string]nsd.Amount{}
+	for _, instruction := range instructions {
+		if instruction.Key.Type != nsd.InstructionTypeDVP {
+			continue
+		}
+		switch instruction.Value.Status {
+		case nsd.InstructionCanceled, nsd.InstructionDeclined, nsd.InstructionRollbackDone:
+			continue
+		}
+
+		for _, side := range []string{nsd.InitiatorIsTransferer, nsd.InitiatorIsReceiver} {
+			balance, submitted := instruction.Key.Transferer, instruction.Value.SubmittedFrom
+			if side == nsd.InitiatorIsReceiver {
+				balance, submitted = instruction.Key.Receiver, instruction.Value.SubmittedTo
+			}
+			if submitted != date {
+				continue
+			}
+
+			owner, err := getOrganizationName(stub, balance)
+			if err != nil {
+				return nil, err
+			}
+			if owner != organization {
+				continue
+			}
 
-	return string(data), nil
+			amount, err := nsd.ParseAmount(instruction.Key.PaymentAmount)
+			if err != nil {
+				logger.Warningf("cannot count payment amount %s of instruction %s", instruction.Key.PaymentAmount,
+					instruction.Key.Reference)
+				continue
+			}
+			usage[instruction.Key.PaymentCurrency] += amount
+		}
+	}
+	return usage, nil
 }
 
-func authenticateCaller(stub shim.ChaincodeStubInterface, callerBalance nsd.Balance) bool {
-	keyParts := []string{callerBalance.Account, callerBalance.Division}
-	if key, err := stub.CreateCompositeKey(authenticationIndex, keyParts); err == nil {
-		if data, err := stub.GetState(key); err == nil && certificates.GetCreatorOrganization(stub) == string(data) {
-			return true
+// checkLimits verifies instruction submitted by the owner of the side given today is within limits of its organization
+func checkLimits(stub shim.ChaincodeStubInterface, instruction nsd.Instruction, side string, today string) pb.Response {
+	balance, counterpartyBalance := instruction.Key.Transferer, instruction.Key.Receiver
+	if side == nsd.InitiatorIsReceiver {
+		balance, counterpartyBalance = counterpartyBalance, balance
+	}
+
+	organization, err := getOrganizationName(stub, balance)
+	if err != nil {
+		return pb.Response{Status: 500, Message: "Persistence failure."}
+	}
+	counterparty, err := getOrganizationName(stub, counterpartyBalance)
+	if err != nil {
+		return pb.Response{Status: 500, Message: "Persistence failure."}
+	}
+
+	limits, err := getLimits(stub, organization)
+	if err != nil {
+		return pb.Response{Status: 500, Message: "Persistence failure."}
+	}
+
+	contains := func(values []string, value string) bool {
+		for _, v := range values {
+			if v == value {
+				return true
+			}
 		}
+		return false
 	}
-	return false
+
+	if len(limits.Counterparties) != 0 && !contains(limits.Counterparties, counterparty) {
+		return pb.Response{Status: 403, Message: "Counterparty " + counterparty + " is not allowed to " + organization + "."}
+	}
+	if len(limits.Securities) != 0 && !contains(limits.Securities, instruction.Key.Security) {
+		return pb.Response{Status: 403, Message: "Security " + instruction.Key.Security + " is not allowed to " +
+			organization + "."}
+	}
+	if limits.MaxQuantity != 0 {
+		quantity, err := strconv.Atoi(instruction.Key.Quantity)
+		if err != nil {
+			return pb.Response{Status: 400, Message: "Quantity must be integer."}
+		}
+		if quantity > limits.MaxQuantity {
+			return pb.Response{Status: 403, Message: fmt.Sprintf("Quantity %d exceeds limit %d of %s.",
+				quantity, limits.MaxQuantity, organization)}
+		}
+	}
+
+	max, ok := limits.MaxDailyDvp[instruction.Key.PaymentCurrency]
+	if instruction.Key.Type != nsd.InstructionTypeDVP || !ok {
+		return shim.Success(nil)
+	}
+
+	amount, err := nsd.ParseAmount(instruction.Key.PaymentAmount)
+	if err != nil {
+		return pb.Response{Status: 400, Message: "Payment amount: " + err.Error() + "."}
+	}
+	usage, err := dailyDvp(stub, organization, today)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if usage[instruction.Key.PaymentCurrency] + amount > max {
+		return pb.Response{Status: 403, Message: fmt.Sprintf("DVP amount %s %s of %s exceeds daily limit %s.",
+			usage[instruction.Key.PaymentCurrency] + amount, instruction.Key.PaymentCurrency, organization, max)}
+	}
+
+	return shim.Success(nil)
+}
+
+// limits shows limits of organization along with DVP amounts it instructed on date (of the transaction by default),
+// organizations see their own limits only
+func (t *InstructionChaincode) limits(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) < 1 || len(args) > 2 {
+		return pb.Response{Status: 400, Message: "Incorrect number of arguments. " +
+			"Expecting organization and optionally date"}
+	}
+
+	organization := args[0]
+	if !nsd.CallerIsMainOrg(stub) && !nsd.CreatorBelongsTo(stub, organization) {
+		return pb.Response{Status: 403, Message: "Only main organization can see limits of others."}
+	}
+
+	date, err := txDate(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if len(args) > 1 {
+		date = args[1]
+	}
+
+	limits, err := getLimits(stub, organization)
+	if err != nil {
+		return pb.Response{Status: 500, Message: "Persistence failure."}
+	}
+	usage, err := dailyDvp(stub, organization, date)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	result, err := json.Marshal(LimitsUsage{Limits: limits, Date: date, DailyDvp: usage})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(result)
 }
 
 // **** main method **** //
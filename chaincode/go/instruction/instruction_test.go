@@ -4,18 +4,28 @@ import (
 	"testing"
 	"github.com/Altoros/nsd-commercial-paper-common"
 	"github.com/Altoros/nsd-commercial-paper-common/testutils"
+	"github.com/Altoros/nsd-commercial-paper-common/identity"
 	"fmt"
 	"github.com/hyperledger/fabric/core/chaincode/shim"
 	pb "github.com/hyperledger/fabric/protos/peer"
 	"encoding/json"
+	"encoding/xml"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
 	"sort"
+	"strings"
+	"time"
 )
 
 const nsdName = "nsd.nsd.ru"
 
 type queryResult struct {
-	Name    string      `json:"organization"`
-	Balance nsd.Balance `json:"balance"`
+	Name     string            `json:"organization"`
+	Deponent string            `json:"deponent"`
+	Metadata map[string]string `json:"metadata"`
+	Balance  nsd.Balance       `json:"balance"`
 }
 
 func toByteArray(arr []string) [][]byte {
@@ -37,6 +47,7 @@ func getInitializedStub(t *testing.T) *testutils.TestStub{
 	args := [][]byte{[]byte("init"), []byte(
 		`[{
 			"organization": "org1",
+			"deponent": "MCXXXXX00000",
 			"balances": [
 				{
 					"account": "MZ0987654321",
@@ -45,6 +56,8 @@ func getInitializedStub(t *testing.T) *testutils.TestStub{
 			]
 		}, {
 			"organization": "org2",
+			"deponent": "MSYYYYY00000",
+			"metadata": {"name": "Org 2"},
 			"balances": [
 				{
 					"account": "30109810000000000000",
@@ -56,10 +69,24 @@ func getInitializedStub(t *testing.T) *testutils.TestStub{
 	stub.SetCaller(nsdName)
 	stub.SetMainOrganization(nsdName)
 	stub.MockInit("1", args)
+	stub.SetTransient(dvpPrivate("10000.00", testSalt))
 
 	return stub
 }
 
+const testSalt = "0123456789abcdef"
+
+// dvpPrivate is transient data with requisites and payment amount of DVP instructions of the tests
+func dvpPrivate(amount string, salt string) map[string][]byte {
+	data, _ := json.Marshal(nsd.InstructionPrivate{
+		TransfererRequisites: nsd.Requisites{Account: "tr_money_acc", Bic: "tr_money_bic"},
+		ReceiverRequisites:   nsd.Requisites{Account: "rc_money_acc", Bic: "rc_money_bic"},
+		PaymentAmount:        amount,
+		Salt:                 salt,
+	})
+	return map[string][]byte{nsd.InstructionTransientKey: data}
+}
+
 func TestInstructionChaincode_Init(t *testing.T) {
 	stub := getStub(t)
 	args := [][]byte{[]byte("init"), []byte(
@@ -193,14 +220,12 @@ func TestInstructionChaincode_ReceiveTransfer(t *testing.T) {
 
 	baseRecvArgs[len(baseRecvArgs) - 1] = "dvp"
 	baseRecvArgs[7] = "ANOTHERREF123"
-	baseRecvArgs = append(baseRecvArgs, "tr_money_acc", "tr_money_bic", "rc_money_acc", "rc_money_bic",
-		"10000.00", "RUB")
+	baseRecvArgs = append(baseRecvArgs, "RUB")
 	addRecvArgs = append(addRecvArgs, `{"description": "Additional info."}`)
 	addRecvArgs[2] = "id_to_2"
 	baseTransfArgs[len(baseTransfArgs) - 1] = "dvp"
 	baseTransfArgs[7] = "ANOTHERREF123"
-	baseTransfArgs = append(baseTransfArgs, "tr_money_acc", "tr_money_bic", "rc_money_acc", "rc_money_bic",
-		"10000.00", "RUB")
+	baseTransfArgs = append(baseTransfArgs, "RUB")
 	addTransfArgs[2] = "id_from_2"
 
 	response = stub.MockInvoke("1", toByteArray(append(baseTransfArgs, addTransfArgs...)))
@@ -247,6 +272,361 @@ func TestInstructionChaincode_ReceiveTransfer(t *testing.T) {
 	}
 }
 
+func TestInstructionChaincode_Roles(t *testing.T) {
+	stub := getInitializedStub(t)
+
+	recvArgs := []string{"receive", "MZ0987654321", "19000000000000000", "30109810000000000000", "044525505",
+		"RU000A0JVVB5", "500", "SOMEREF123", "2018-03-29", "2018-03-29", "fop",
+		"MCXXXXX00000", "MSYYYYY00000", "id_to",
+		`{"document": "doc_to", "description": "321", "created": "2018-03-29"}`}
+	signArgs := []string{"sign", "MZ0987654321", "19000000000000000", "30109810000000000000", "044525505",
+		"RU000A0JVVB5", "500", "SOMEREF123", "2018-03-29", "2018-03-29", "fop", "signature"}
+
+	stub.SetCaller("org2")
+	stub.SetCallerRole(identity.RoleAuditor)
+	if response := stub.MockInvoke("1", toByteArray(recvArgs)); response.Status != 403 {
+		fmt.Println("Auditor has created an instruction: ", response.Status, response.Message)
+		t.FailNow()
+	}
+	if response := stub.MockInvoke("1", [][]byte{[]byte("query")}); response.Status != shim.OK {
+		fmt.Println("Auditor cannot query instructions: ", response.Message)
+		t.FailNow()
+	}
+
+	stub.SetCallerRole(identity.RoleSigner)
+	if response := stub.MockInvoke("1", toByteArray(recvArgs)); response.Status != 403 {
+		fmt.Println("Signer has created an instruction: ", response.Status, response.Message)
+		t.FailNow()
+	}
+
+	stub.SetCallerRole(identity.RoleOperator + "," + identity.RoleAuditor)
+	if response := stub.MockInvoke("1", toByteArray(recvArgs)); response.Status != shim.OK {
+		fmt.Println("Operator cannot create an instruction: ", response.Message)
+		t.FailNow()
+	}
+	if response := stub.MockInvoke("1", toByteArray(signArgs)); response.Status != 403 {
+		fmt.Println("Operator has signed an instruction: ", response.Status, response.Message)
+		t.FailNow()
+	}
+
+	stub.SetCallerRole(identity.RoleSigner)
+	if response := stub.MockInvoke("1", toByteArray(signArgs)); response.Status != shim.OK {
+		fmt.Println("Signer cannot sign an instruction: ", response.Message)
+		t.FailNow()
+	}
+}
+
+func TestInstructionChaincode_PeerOrganization(t *testing.T) {
+	stub := getInitializedStub(t)
+	defer os.Unsetenv("CORE_PEER_LOCALMSPID")
+
+	// the peer is matched with the main organization by MSP ID the same way as callers are
+	stub.MockTransactionStart("peer")
+	defer stub.MockTransactionEnd("peer")
+	for mspID, isMainOrg := range map[string]bool{"nsd": true, nsdName: true, "nsd.nsd": false, "org1": false} {
+		os.Setenv("CORE_PEER_LOCALMSPID", mspID)
+		if peerIsMainOrg(stub) != isMainOrg {
+			fmt.Println("Wrong organization of the peer with MSP ID ", mspID)
+			t.FailNow()
+		}
+	}
+
+	// the peer belongs to no organization without MSP ID in the environment and without certificate
+	os.Unsetenv("CORE_PEER_LOCALMSPID")
+	if peerIsMainOrg(stub) {
+		fmt.Println("Peer without identity belongs to the main organization")
+		t.FailNow()
+	}
+}
+
+func TestInstructionChaincode_Deponents(t *testing.T) {
+	stub := getInitializedStub(t)
+
+	transferArgs := []string{"transfer", "MZ0987654321", "19000000000000000", "30109810000000000000", "044525505",
+		"RU000A0JVVB5", "500", "SOMEREF123", "2018-03-29", "2018-03-29", "fop",
+		"MCXXXXX00000", "MSYYYYY00000", "id_from",
+		`{"document": "doc_from", "description": "123", "created": "2018-03-29"}`}
+
+	stub.SetCaller("org1")
+	for _, deponents := range [][]string{{"MSYYYYY00000", "MSYYYYY00000"}, {"MCXXXXX00000", "MCXXXXX00000"}} {
+		args := append([]string{}, transferArgs...)
+		args[11], args[12] = deponents[0], deponents[1]
+		if response := stub.MockInvoke("1", toByteArray(args)); response.Status != 400 {
+			fmt.Println("Instruction created with deponents not owning balances: ", deponents)
+			t.FailNow()
+		}
+	}
+
+	// balances of organizations with no deponent registered cannot be instructed
+	stub.SetCaller(nsdName)
+	stub.MockAcceptedBalanceChange(stub.MockApprovedInvoke([][]byte{[]byte("addBalances"),
+		[]byte(`[{"organization": "org3", "balances": [{"account": "MZ0987654323", "division": "19000000000000000"}]}]`)}))
+	args := append([]string{}, transferArgs...)
+	args[3], args[4] = "MZ0987654323", "19000000000000000"
+	stub.SetCaller("org1")
+	if response := stub.MockInvoke("1", toByteArray(args)); response.Status != 400 {
+		fmt.Println("Instruction created for receiver with no deponent registered.")
+		t.FailNow()
+	}
+
+	if response := stub.MockInvoke("1", toByteArray(transferArgs)); response.Status != shim.OK {
+		fmt.Println("Transfer error: " + response.Message)
+		t.FailNow()
+	}
+}
+
+func TestInstructionChaincode_Limits(t *testing.T) {
+	stub := getInitializedStub(t)
+
+	transferArgs := []string{"transfer", "MZ0987654321", "19000000000000000", "30109810000000000000", "044525505",
+		"RU000A0JVVB5", "500", "SOMEREF1", "2018-03-29", "2018-03-29", "fop",
+		"MCXXXXX00000", "MSYYYYY00000", "id_from1",
+		`{"document": "doc_from", "description": "123", "created": "2018-03-29"}`}
+	dvpArgs := func(reference, amount string) []string {
+		args := append([]string{}, transferArgs[:11]...)
+		args[7], args[10] = reference, "dvp"
+		args = append(args, "RUB")
+		stub.SetTransient(dvpPrivate(amount, testSalt))
+		return append(args, "MCXXXXX00000", "MSYYYYY00000", "id_"+reference, transferArgs[14])
+	}
+	check := func(expectedStatus int32, args []string) {
+		if response := stub.MockInvoke("1", toByteArray(args)); response.Status != expectedStatus {
+			fmt.Println("Wrong status. Current value: ", response.Status, ", Expected value: ", expectedStatus, ". ",
+				response.Message)
+			t.FailNow()
+		}
+	}
+
+	stub.SetCaller("org1")
+	check(403, []string{"setLimits", `[{"organization": "org1", "maxQuantity": 100}]`})
+	check(403, []string{"limits", "org2"})
+
+	stub.SetCaller(nsdName)
+	if response := stub.MockApprovedInvoke(toByteArray([]string{"setLimits", `[{"organization": "org1",
+		"counterparties": ["org3"]}]`})); response.Status != shim.OK {
+		fmt.Println("Cannot set limits: " + response.Message)
+		t.FailNow()
+	}
+	stub.SetCaller("org1")
+	check(403, transferArgs)
+
+	stub.SetCaller(nsdName)
+	stub.MockApprovedInvoke(toByteArray([]string{"setLimits", `[{"organization": "org1",
+		"counterparties": ["org2"], "securities": ["RU000A0JVVB5"], "maxQuantity": 1000,
+		"maxDailyDvp": {"RUB": 15000}}]`}))
+	stub.SetCaller("org1")
+
+	args := append([]string{}, transferArgs...)
+	args[5] = "RU000A0JVVB6"
+	check(403, args)
+	args = append([]string{}, transferArgs...)
+	args[6] = "1500"
+	check(403, args)
+	stub.SetTxTime(time.Date(2018, 3, 29, 12, 0, 0, 0, time.UTC))
+	check(200, transferArgs)
+
+	check(200, dvpArgs("SOMEREF2", "10000.00"))
+	check(403, dvpArgs("SOMEREF3", "5000.01"))
+	check(400, dvpArgs("SOMEREF3", "100.001"))
+
+	// usage is counted by the day instructions are submitted on, not by the date they name
+	dvp := dvpArgs("SOMEREF3", "10000.00")
+	dvp[8] = "2018-03-30"
+	check(403, dvp)
+
+	// limits of counterparty are not affected, another day has its own limit
+	stub.SetTxTime(time.Date(2018, 3, 30, 12, 0, 0, 0, time.UTC))
+	check(200, dvp)
+
+	stub.SetCaller("org2")
+	recv := dvpArgs("SOMEREF2", "10000.00")
+	recv[0], recv[len(recv) - 2] = "receive", "id_to2"
+	check(200, append(recv, `{"description": "Additional info."}`))
+
+	stub.SetCaller("org1")
+	response := stub.MockInvoke("1", toByteArray([]string{"limits", "org1", "2018-03-29"}))
+	var usage LimitsUsage
+	if err := json.Unmarshal(response.Payload, &usage); err != nil || usage.MaxQuantity != 1000 ||
+		usage.DailyDvp["RUB"] != 1000000 {
+		fmt.Println("Wrong limits usage: ", usage, response.Message)
+		t.FailNow()
+	}
+
+	stub.SetCaller(nsdName)
+	response = stub.MockInvoke("1", toByteArray([]string{"limits", "org2", "2018-03-30"}))
+	usage = LimitsUsage{}
+	if err := json.Unmarshal(response.Payload, &usage); err != nil || usage.MaxQuantity != 0 ||
+		usage.DailyDvp["RUB"] != 1000000 {
+		fmt.Println("Wrong limits usage of counterparty: ", usage, response.Message)
+		t.FailNow()
+	}
+}
+
+func TestInstructionChaincode_PrivateRequisites(t *testing.T) {
+	stub := getInitializedStub(t)
+
+	instructionArgs := []string{"MZ0987654321", "19000000000000000", "30109810000000000000", "044525505",
+		"RU000A0JVVB5", "500", "SOMEREF123", "2018-03-29", "2018-03-29", "dvp", "RUB"}
+	transferArgs := append(append([]string{"transfer"}, instructionArgs...), "MCXXXXX00000", "MSYYYYY00000",
+		"id_from", `{"document": "doc_from", "description": "123", "created": "2018-03-29"}`)
+	receiveArgs := append(append([]string{"receive"}, instructionArgs...), "MCXXXXX00000", "MSYYYYY00000",
+		"id_to", `{"document": "doc_to", "description": "321", "created": "2018-03-29"}`,
+		`{"description": "Additional info."}`)
+
+	// requisites are passed only in transient data, new instruction needs a salt to hash them with
+	stub.SetCaller("org1")
+	for _, transient := range []map[string][]byte{nil, dvpPrivate("10000.00", ""), dvpPrivate("10000.00", "short")} {
+		stub.SetTransient(transient)
+		if response := stub.MockInvoke("1", toByteArray(transferArgs)); response.Status != 400 {
+			fmt.Println("Transfer without requisites or salt: ", response.Status, response.Message)
+			t.FailNow()
+		}
+	}
+
+	stub.SetTransient(dvpPrivate("10000.00", testSalt))
+	if response := stub.MockInvoke("1", toByteArray(transferArgs)); response.Status != shim.OK {
+		fmt.Println("Transfer error: " + response.Message)
+		t.FailNow()
+	}
+	// the counterparty does not know the salt, the one of the stored instruction is taken
+	stub.SetCaller("org2")
+	stub.SetTransient(dvpPrivate("10000.00", ""))
+	if response := stub.MockInvoke("2", toByteArray(receiveArgs)); response.Status != shim.OK {
+		fmt.Println("Receive error: " + response.Message)
+		t.FailNow()
+	}
+
+	// the hash of requisites cannot be checked against guessed ones without the salt
+	for _, salt := range []string{"", testSalt} {
+		instruction := nsd.Instruction{}
+		instruction.FillFromArgs(instructionArgs)
+		instruction.FillPrivate(nsd.InstructionPrivate{
+			TransfererRequisites: nsd.Requisites{Account: "tr_money_acc", Bic: "tr_money_bic"},
+			ReceiverRequisites:   nsd.Requisites{Account: "rc_money_acc", Bic: "rc_money_bic"},
+			PaymentAmount:        "10000.00",
+			Salt:                 salt,
+		})
+		key, _ := instruction.ToCompositeKey(stub)
+		if (stub.State[key] != nil) != (salt != "") {
+			fmt.Println("Instruction is stored by the hash of requisites with salt \"" + salt + "\": ", salt == "")
+			t.FailNow()
+		}
+	}
+
+	for key, value := range stub.State {
+		if strings.Contains(key+string(value), "money_acc") || strings.Contains(key+string(value), "10000.00") {
+			fmt.Println("Requisites are in the world state: ", key)
+			t.FailNow()
+		}
+	}
+	for len(stub.ChaincodeEventsChannel) > 0 {
+		event := <-stub.ChaincodeEventsChannel
+		if strings.Contains(string(event.Payload), "money_acc") {
+			fmt.Println("Requisites are in event " + event.EventName)
+			t.FailNow()
+		}
+	}
+
+	query := func(caller string) nsd.Instruction {
+		stub.SetCaller(caller)
+		response := stub.MockInvoke("3", [][]byte{[]byte("queryByType"), []byte(nsd.InstructionMatched)})
+		var instructions []nsd.Instruction
+		if err := json.Unmarshal(response.Payload, &instructions); err != nil || len(instructions) != 1 {
+			fmt.Println("Wrong matched instructions: ", response.Message, instructions)
+			t.FailNow()
+		}
+		return instructions[0]
+	}
+
+	for _, caller := range []string{"org1", "org2", nsdName} {
+		instruction := query(caller)
+		if instruction.Key.TransfererRequisites.Account != "tr_money_acc" ||
+			instruction.Key.PaymentAmount != "10000.00" || instruction.Key.Salt != testSalt ||
+			!strings.Contains(instruction.Value.AlamedaFrom, "rc_money_acc") {
+			fmt.Println("Requisites are not revealed to " + caller)
+			t.FailNow()
+		}
+	}
+
+	if instruction := query("org3"); instruction.Key.PaymentAmount != "" || instruction.Key.Salt != "" ||
+		instruction.Value.AlamedaTo != "" {
+		fmt.Println("Requisites are revealed to another organization.")
+		t.FailNow()
+	}
+}
+
+func TestInstructionChaincode_InstructionId(t *testing.T) {
+	stub := getInitializedStub(t)
+
+	instructionArgs := []string{"MZ0987654321", "19000000000000000", "30109810000000000000", "044525505",
+		"RU000A0JVVB5", "500", "SOMEREF123", "2018-03-29", "2018-03-29", "fop"}
+	transferArgs := append(append([]string{"transfer"}, instructionArgs...), "MCXXXXX00000", "MSYYYYY00000",
+		"id_from", `{"document": "doc_from", "description": "123", "created": "2018-03-29"}`)
+	receiveArgs := append(append([]string{"receive"}, instructionArgs...), "MCXXXXX00000", "MSYYYYY00000",
+		"id_to", `{"document": "doc_to", "description": "321", "created": "2018-03-29"}`)
+
+	stub.SetCaller("org1")
+	response := stub.MockInvoke("1", toByteArray(transferArgs))
+	id := string(response.Payload)
+
+	instruction := nsd.Instruction{}
+	instruction.FillFromArgs(instructionArgs)
+	key, _ := instruction.ToCompositeKey(stub)
+	if response.Status != shim.OK || id != nsd.InstructionId(key) {
+		fmt.Println("Wrong instruction id: ", id, response.Message)
+		t.FailNow()
+	}
+
+	stub.SetCaller("org2")
+	if response := stub.MockInvoke("2", toByteArray(receiveArgs)); string(response.Payload) != id {
+		fmt.Println("Matched instruction has another id: ", string(response.Payload), response.Message)
+		t.FailNow()
+	}
+
+	// instructions are found by id only in the index
+	idKey, _ := stub.CreateCompositeKey(nsd.InstructionKeyIndex, []string{id})
+	var indexed string
+	if err := nsd.UnmarshalValue(nsd.InstructionKeyIndex, stub.State[idKey], &indexed); err != nil || indexed != key {
+		fmt.Println("Instruction id is not indexed.")
+		t.FailNow()
+	}
+	index := stub.State[idKey]
+	delete(stub.State, idKey)
+
+	stub.SetCaller("org1")
+	sign := [][]byte{[]byte("sign"), []byte(id), []byte("signature")}
+	if response := stub.MockInvoke("3", sign); response.Status != 404 {
+		fmt.Println("Instruction is found by id without index: ", response.Status, response.Message)
+		t.FailNow()
+	}
+	stub.State[idKey] = index
+	if response := stub.MockInvoke("3", sign); response.Status != shim.OK {
+		fmt.Println("Cannot sign instruction by id: " + response.Message)
+		t.FailNow()
+	}
+
+	stub.SetCaller(nsdName)
+	if response := stub.MockInvoke("4", [][]byte{[]byte("status"), []byte(id), []byte("not enough securities"),
+		[]byte(nsd.InstructionDeclined)}); response.Status != shim.OK {
+		fmt.Println("Cannot change status by id: " + response.Message)
+		t.FailNow()
+	}
+	if response := stub.MockInvoke("5", [][]byte{[]byte("status"), []byte("unknown"),
+		[]byte(nsd.InstructionDeclined)}); response.Status != 404 {
+		fmt.Println("Status of unknown instruction changed.")
+		t.FailNow()
+	}
+
+	response = stub.MockInvoke("6", [][]byte{[]byte("queryByType"), []byte(nsd.InstructionDeclined)})
+	var instructions []nsd.Instruction
+	if err := json.Unmarshal(response.Payload, &instructions); err != nil || len(instructions) != 1 ||
+		instructions[0].Id != id || instructions[0].Value.StatusInfo != "not enough securities" ||
+		instructions[0].Value.AlamedaSignatureFrom != "signature" {
+		fmt.Println("Wrong declined instructions: ", instructions, response.Message)
+		t.FailNow()
+	}
+}
+
 func checkBalanceQuery(results, expectedResults []queryResult) error {
 	if len(results) != len(expectedResults) {
 		return fmt.Errorf("Query result contains less elements then expected.")
@@ -262,6 +642,7 @@ func checkBalanceQuery(results, expectedResults []queryResult) error {
 
 	for i, _ := range results {
 		if results[i].Name != expectedResults[i].Name ||
+		   results[i].Deponent != expectedResults[i].Deponent ||
 		   results[i].Balance.Account != expectedResults[i].Balance.Account ||
 		   results[i].Balance.Division != expectedResults[i].Balance.Division {
 			return fmt.Errorf("Query result #%d is not equal the expected one.", i)
@@ -289,6 +670,7 @@ func TestInstructionChaincode_GetBalances(t *testing.T) {
 	expectedResults := []queryResult{
 		queryResult{
 			Name: "org1",
+			Deponent: "MCXXXXX00000",
 			Balance: nsd.Balance{
 				Account: "MZ0987654321",
 				Division: "19000000000000000",
@@ -296,6 +678,7 @@ func TestInstructionChaincode_GetBalances(t *testing.T) {
 		},
 		queryResult{
 			Name: "org2",
+			Deponent: "MSYYYYY00000",
 			Balance: nsd.Balance{
 				Account: "30109810000000000000",
 				Division: "044525505",
@@ -307,6 +690,10 @@ func TestInstructionChaincode_GetBalances(t *testing.T) {
 		fmt.Println(err)
 		t.FailNow()
 	}
+	if results[0].Metadata["name"] != "Org 2" {
+		fmt.Println("Organization metadata is not returned: ", results[0])
+		t.FailNow()
+	}
 }
 
 func TestInstructionChaincode_AddBalances(t *testing.T) {
@@ -315,6 +702,7 @@ func TestInstructionChaincode_AddBalances(t *testing.T) {
 	expectedResults := []queryResult{
 		queryResult{
 			Name: "org1",
+			Deponent: "MCXXXXX00000",
 			Balance: nsd.Balance{
 				Account: "MZ0987654321",
 				Division: "19000000000000000",
@@ -322,6 +710,7 @@ func TestInstructionChaincode_AddBalances(t *testing.T) {
 		},
 		queryResult{
 			Name: "org1",
+			Deponent: "MCXXXXX00000",
 			Balance: nsd.Balance{
 				Account: "MZ0987654322",
 				Division: "22000000000000000",
@@ -329,6 +718,7 @@ func TestInstructionChaincode_AddBalances(t *testing.T) {
 		},
 		queryResult{
 			Name: "org2",
+			Deponent: "MSYYYYY00000",
 			Balance: nsd.Balance{
 				Account: "30109810000000000000",
 				Division: "044525505",
@@ -341,7 +731,7 @@ func TestInstructionChaincode_AddBalances(t *testing.T) {
 	// first time we're adding a new balance record; second time we're adding existing record
 	// the behaviour isn't expected to change
 	for i := 0; i < 2; i++ {
-		response = stub.MockInvoke("1", [][]byte{[]byte("addBalances"), []byte(`[{
+		response = stub.MockAcceptedBalanceChange(stub.MockApprovedInvoke([][]byte{[]byte("addBalances"), []byte(`[{
 				"organization": "org1",
 				"balances": [
 					{
@@ -349,7 +739,7 @@ func TestInstructionChaincode_AddBalances(t *testing.T) {
 						"division": "22000000000000000"
 					}
 				]
-			}]`)})
+			}]`)}))
 		if response.Status >= 400 {
 			fmt.Println(`"addBalances" error: ` + response.Message)
 			t.FailNow()
@@ -398,6 +788,7 @@ func TestInstructionChaincode_RemoveBalances(t *testing.T) {
 	expectedResults := []queryResult{
 		queryResult{
 			Name: "org2",
+			Deponent: "MSYYYYY00000",
 			Balance: nsd.Balance{
 				Account: "30109810000000000000",
 				Division: "044525505",
@@ -410,7 +801,7 @@ func TestInstructionChaincode_RemoveBalances(t *testing.T) {
 	// first time we're removing an existing record; second time we're removing record that doesn't exist in ledger
 	// the behaviour isn't expected to change
 	for i := 0; i < 2; i++ {
-		response = stub.MockInvoke("1", [][]byte{[]byte("removeBalances"), []byte(`[{
+		response = stub.MockAcceptedBalanceChange(stub.MockApprovedInvoke([][]byte{[]byte("removeBalances"), []byte(`[{
 			"organization": "org1",
 			"balances": [
 				{
@@ -418,7 +809,7 @@ func TestInstructionChaincode_RemoveBalances(t *testing.T) {
 					"division": "19000000000000000"
 				}
 			]
-		}]`)})
+		}]`)}))
 		if response.Status >= 400 {
 			fmt.Println(`"removeBalances" error: ` + response.Message)
 			t.FailNow()
@@ -461,6 +852,103 @@ func TestInstructionChaincode_RemoveBalances(t *testing.T) {
 	}
 }
 
+func checkBalanceChange(t *testing.T, response pb.Response, expectedStatus string) nsd.BalanceChange {
+	var change nsd.BalanceChange
+	if response.Status != shim.OK {
+		fmt.Println("Balance change error: " + response.Message)
+		t.FailNow()
+	}
+	if err := json.Unmarshal(response.Payload, &change); err != nil || change.Status != expectedStatus {
+		fmt.Println("Wrong balance change: ", change, err)
+		t.FailNow()
+	}
+	return change
+}
+
+func checkBalanceOwner(t *testing.T, stub *testutils.TestStub, account string, expectedOrganization string) {
+	var results []queryResult
+	json.Unmarshal(stub.MockInvoke("1", [][]byte{[]byte("getBalances")}).Payload, &results)
+	for _, result := range results {
+		if result.Balance.Account == account && result.Name != expectedOrganization {
+			fmt.Println("Balance " + account + " is registered to " + result.Name + " instead of " + expectedOrganization)
+			t.FailNow()
+		}
+	}
+}
+
+func TestInstructionChaincode_BalanceChange(t *testing.T) {
+	stub := getInitializedStub(t)
+
+	// balance of org1 is handed over to org2, both have to accept
+	response := stub.MockApprovedInvoke([][]byte{[]byte("addBalances"),
+		[]byte(`[{"organization": "org2", "balances": [{"account": "MZ0987654321", "division": "19000000000000000"}]}]`)})
+	change := checkBalanceChange(t, response, nsd.BalanceChangeProposed)
+	if len(change.Required) != 2 || change.Required[0] != "org2" || change.Required[1] != "org1" {
+		fmt.Println("Wrong organizations required to accept: ", change.Required)
+		t.FailNow()
+	}
+	id := []byte(change.Id)
+
+	stub.SetCaller("org3")
+	if response = stub.MockInvoke("1", [][]byte{[]byte("balanceChanges")}); string(response.Payload) != "[]" {
+		fmt.Println("Balance change is visible to unaffected organization: " + string(response.Payload))
+		t.FailNow()
+	}
+	if response = stub.MockInvoke("1", [][]byte{[]byte("acceptBalanceChange"), id}); response.Status != 403 {
+		fmt.Println("Balance change accepted by unaffected organization.")
+		t.FailNow()
+	}
+
+	stub.SetCaller("org1")
+	checkBalanceChange(t, stub.MockInvoke("1", [][]byte{[]byte("acceptBalanceChange"), id}), nsd.BalanceChangeProposed)
+	if response = stub.MockInvoke("1", [][]byte{[]byte("acceptBalanceChange"), id}); response.Status != 409 {
+		fmt.Println("Balance change accepted twice.")
+		t.FailNow()
+	}
+	checkBalanceOwner(t, stub, "MZ0987654321", "org1")
+
+	stub.SetCaller("org2")
+	checkBalanceChange(t, stub.MockInvoke("1", [][]byte{[]byte("acceptBalanceChange"), id}), nsd.BalanceChangeApplied)
+	checkBalanceOwner(t, stub, "MZ0987654321", "org2")
+
+	// rejected change is never applied
+	stub.SetCaller(nsdName)
+	response = stub.MockApprovedInvoke([][]byte{[]byte("removeBalances"),
+		[]byte(`[{"organization": "org2", "balances": [{"account": "MZ0987654321", "division": "19000000000000000"}]}]`)})
+	id = []byte(checkBalanceChange(t, response, nsd.BalanceChangeProposed).Id)
+
+	stub.SetCaller("org2")
+	checkBalanceChange(t, stub.MockInvoke("1", [][]byte{[]byte("rejectBalanceChange"), id}), nsd.BalanceChangeRejected)
+	if response = stub.MockInvoke("1", [][]byte{[]byte("acceptBalanceChange"), id}); response.Status != 409 {
+		fmt.Println("Rejected balance change accepted.")
+		t.FailNow()
+	}
+	checkBalanceOwner(t, stub, "MZ0987654321", "org2")
+
+	// balance with open instructions cannot be removed
+	if response = stub.MockInvoke("1", toByteArray([]string{"receive", "MZ0987654321", "19000000000000000",
+		"30109810000000000000", "044525505", "RU000A0JVVB5", "500", "SOMEREF123", "2018-03-29", "2018-03-29", "fop",
+		"MSYYYYY00000", "MSYYYYY00000", "id_to",
+		`{"document": "doc_to", "description": "321", "created": "2018-03-29"}`})); response.Status != shim.OK {
+		fmt.Println("Receive error: " + response.Message)
+		t.FailNow()
+	}
+
+	stub.SetCaller(nsdName)
+	response = stub.MockApprovedInvoke([][]byte{[]byte("removeBalances"),
+		[]byte(`[{"organization": "org2", "balances": [{"account": "30109810000000000000", "division": "044525505"}]}]`)})
+	if response.Status != 409 {
+		fmt.Println("Balance with open instructions removed: ", response.Status, response.Message)
+		t.FailNow()
+	}
+
+	if response = stub.MockInvoke("1", [][]byte{[]byte("balanceChanges"), []byte(nsd.BalanceChangeApplied)});
+		!strings.Contains(string(response.Payload), string(change.Id)) {
+		fmt.Println("Applied balance change is not listed: " + string(response.Payload))
+		t.FailNow()
+	}
+}
+
 func TestCreateAlamedaFopXMLs(t *testing.T) {
 	instruction := nsd.Instruction{
 		Key: nsd.InstructionKey{
@@ -502,7 +990,7 @@ func TestCreateAlamedaFopXMLs(t *testing.T) {
 
 	from, to := CreateAlamedaXMLsTestWrapper(&instruction, nsd.InstructionTypeFOP)
 
-	const fromExpected = `<?xml version="1.0" encoding="Windows-1251"?>
+	const fromExpected = `<?xml version="1.0" encoding="UTF-8"?>
 <Batch>
 <Documents_amount>1</Documents_amount>
 <Document DOC_ID="1" version="7">
@@ -537,7 +1025,7 @@ func TestCreateAlamedaFopXMLs(t *testing.T) {
 </Document>
 </Batch>`
 
-	const toExpected = `<?xml version="1.0" encoding="Windows-1251"?>
+	const toExpected = `<?xml version="1.0" encoding="UTF-8"?>
 <Batch>
 <Documents_amount>1</Documents_amount>
 <Document DOC_ID="1" version="7">
@@ -636,7 +1124,7 @@ func TestCreateAlamedaDvpXMLs(t *testing.T) {
 
 	from, to := CreateAlamedaXMLsTestWrapper(&instruction, nsd.InstructionTypeDVP)
 
-	const fromExpected = `<?xml version="1.0" encoding="Windows-1251"?>
+	const fromExpected = `<?xml version="1.0" encoding="UTF-8"?>
 <Batch>
 <Documents_amount>1</Documents_amount>
 <Document DOC_ID="1" version="7">
@@ -677,7 +1165,7 @@ func TestCreateAlamedaDvpXMLs(t *testing.T) {
 </Document>
 </Batch>`
 
-	const toExpected = `<?xml version="1.0" encoding="Windows-1251"?>
+	const toExpected = `<?xml version="1.0" encoding="UTF-8"?>
 <Batch>
 <Documents_amount>1</Documents_amount>
 <Document DOC_ID="1" version="7">
@@ -727,4 +1215,1033 @@ func TestCreateAlamedaDvpXMLs(t *testing.T) {
 		t.Errorf("XML \"to\"is not equal expected value")
 		fmt.Println(to)
 	}
-}
\ No newline at end of file
+}
+
+// sese023Instruction is matched DVP instruction sese.023 tests make documents of
+func sese023Instruction() nsd.Instruction {
+	return nsd.Instruction{
+		Key: nsd.InstructionKey{
+			Transferer: nsd.Balance{
+				Account: "transf_acc",
+				Division: "transf_div",
+			},
+			Receiver: nsd.Balance{
+				Account: "recv_acc",
+				Division: "recv_div",
+			},
+			Security: "RU000A0JVVB5",
+			Quantity: "500",
+			Reference: "someref123",
+			InstructionDate: "2018-03-30",
+			TradeDate: "2018-03-29",
+			Type: nsd.InstructionTypeDVP,
+			PaymentAmount: "10000.00",
+			PaymentCurrency: "RUB",
+		},
+
+		Value: nsd.InstructionValue{
+			DeponentFrom: "MCXXXXX00000",
+			DeponentTo: "MSYYYYY00000",
+			Status: "matched",
+			MemberInstructionIdFrom: "id_from",
+			MemberInstructionIdTo: "id_to",
+			SettlementDate: "2018-04-02",
+		},
+	}
+}
+
+// testdata/sese.023.001.07.xsd is a hand-reduced subset of the published ISO 20022 schema: only the elements
+// the chaincode fills in, with their names, order, cardinality and facets, so it does not check the rest of the message
+func TestCreateSese023XMLs_Schema(t *testing.T) {
+	if _, err := exec.LookPath("xmllint"); err != nil {
+		t.Skip("xmllint is not installed, sese.023 documents are not validated against the schema")
+	}
+
+	validate := func(document string) {
+		command := exec.Command("xmllint", "--noout", "--schema", filepath.Join("testdata", "sese.023.001.07.xsd"), "-")
+		command.Stdin = strings.NewReader(document)
+		if output, err := command.CombinedOutput(); err != nil {
+			fmt.Println("Document is not valid sese.023: ", string(output))
+			fmt.Println(document)
+			t.FailNow()
+		}
+	}
+
+	instruction := sese023Instruction()
+	from, to := createSese023XMLs(&instruction)
+	validate(from)
+	validate(to)
+
+	instruction.Key.Type = nsd.InstructionTypeFOP
+	instruction.Key.PaymentAmount, instruction.Key.PaymentCurrency = "", ""
+	from, to = createSese023XMLs(&instruction)
+	validate(from)
+	validate(to)
+}
+
+func TestCreateSese023XMLs(t *testing.T) {
+	instruction := sese023Instruction()
+	from, to := createSese023XMLs(&instruction)
+
+	const fromExpected = `<?xml version="1.0" encoding="UTF-8"?>
+<Document xmlns="urn:iso:std:iso:20022:tech:xsd:sese.023.001.07">
+  <SctiesSttlmTxInstr>
+    <TxId>id_from</TxId>
+    <SttlmTpAndAddtlParams>
+      <SctiesMvmntTp>DELI</SctiesMvmntTp>
+      <Pmt>APMT</Pmt>
+    </SttlmTpAndAddtlParams>
+    <TradDtls>
+      <TradId>SOMEREF123</TradId>
+      <TradDt>
+        <Dt>
+          <Dt>2018-03-29</Dt>
+        </Dt>
+      </TradDt>
+      <SttlmDt>
+        <Dt>
+          <Dt>2018-04-02</Dt>
+        </Dt>
+      </SttlmDt>
+    </TradDtls>
+    <FinInstrmId>
+      <ISIN>RU000A0JVVB5</ISIN>
+    </FinInstrmId>
+    <QtyAndAcctDtls>
+      <SttlmQty>
+        <Qty>
+          <Unit>500</Unit>
+        </Qty>
+      </SttlmQty>
+      <SfkpgAcct>
+        <Id>transf_acc</Id>
+      </SfkpgAcct>
+    </QtyAndAcctDtls>
+    <SttlmParams>
+      <SctiesTxTp>
+        <Cd>TRAD</Cd>
+      </SctiesTxTp>
+    </SttlmParams>
+    <RcvgSttlmPties>
+      <Dpstry>
+        <Id>
+          <AnyBIC>NADCRUMM</AnyBIC>
+        </Id>
+      </Dpstry>
+      <Pty1>
+        <Id>
+          <PrtryId>
+            <Id>MSYYYYY00000</Id>
+            <Issr>NSD</Issr>
+          </PrtryId>
+        </Id>
+        <SfkpgAcct>
+          <Id>recv_acc</Id>
+        </SfkpgAcct>
+      </Pty1>
+    </RcvgSttlmPties>
+    <SttlmAmt>
+      <Amt Ccy="RUB">10000.00</Amt>
+      <CdtDbtInd>CRDT</CdtDbtInd>
+    </SttlmAmt>
+  </SctiesSttlmTxInstr>
+</Document>`
+
+	if from != fromExpected {
+		fmt.Println("XML \"from\" is not equal expected value")
+		fmt.Println(from)
+		t.FailNow()
+	}
+
+	// the receiver's leg must be readable back with the elements of the receipt
+	var document sese023Document
+	if err := xml.Unmarshal([]byte(to), &document); err != nil {
+		fmt.Println(err)
+		t.FailNow()
+	}
+	if document.XMLName.Space != sese023Namespace || document.TransactionId != "id_to" || document.MovementType != "RECE" ||
+		document.SafekeepingAccount != "recv_acc" || document.ReceivingParties != nil || document.DeliveringParties == nil ||
+		document.DeliveringParties.Deponent != "MCXXXXX00000" || document.DeliveringParties.Account != "transf_acc" ||
+		document.SettlementAmount == nil || document.SettlementAmount.CreditDebit != "DBIT" ||
+		document.SettlementAmount.Amount.Value != "10000.00" {
+		fmt.Println("XML \"to\" is not a receipt against payment")
+		fmt.Println(to)
+		t.FailNow()
+	}
+
+	// FOP instruction is free of payment and has no amount
+	instruction.Key.Type = nsd.InstructionTypeFOP
+	instruction.Key.PaymentAmount, instruction.Key.PaymentCurrency = "", ""
+	from, _ = createSese023XMLs(&instruction)
+	if !strings.Contains(from, "<Pmt>FREE</Pmt>") || strings.Contains(from, "SttlmAmt") {
+		fmt.Println("XML of FOP instruction is not free of payment")
+		fmt.Println(from)
+		t.FailNow()
+	}
+
+	// instructions matched before settlement dates were recorded settle on the trade date
+	instruction.Value.SettlementDate = ""
+	from, _ = createSese023XMLs(&instruction)
+	if !strings.Contains(from, "<SttlmDt>\n        <Dt>\n          <Dt>2018-03-29</Dt>") {
+		fmt.Println("XML of instruction without settlement date does not settle on the trade date")
+		fmt.Println(from)
+		t.FailNow()
+	}
+}
+
+func TestCreateMT(t *testing.T) {
+	instruction := nsd.Instruction{
+		Key: nsd.InstructionKey{
+			Transferer: nsd.Balance{
+				Account: "MZ0987654321",
+				Division: "19000000000000000",
+			},
+			Receiver: nsd.Balance{
+				Account: "30109810000000000000",
+				Division: "044525505",
+			},
+			Security: "RU000A0JVVB5",
+			Quantity: "500",
+			Reference: "someref123",
+			InstructionDate: "2018-03-30",
+			TradeDate: "2018-03-29",
+			Type: nsd.InstructionTypeFOP,
+		},
+
+		Value: nsd.InstructionValue{
+			DeponentFrom: "MCXXXXX00000",
+			DeponentTo: "MSYYYYY00000",
+			Status: "matched",
+			MemberInstructionIdFrom: "id_from",
+			MemberInstructionIdTo: "id_to",
+			SettlementDate: "2018-04-02",
+		},
+	}
+
+	// golden files of each message type are in testdata
+	check := func(party string, expectedType string) {
+		messageType, message := createMT(&instruction, party)
+		expected, err := ioutil.ReadFile(filepath.Join("testdata", strings.ToLower(expectedType)+".txt"))
+		if err != nil {
+			fmt.Println(err)
+			t.FailNow()
+		}
+		if messageType != expectedType || message != string(expected) {
+			fmt.Println("Message of " + party + " is not equal expected " + expectedType)
+			fmt.Println(messageType)
+			fmt.Println(message)
+			t.FailNow()
+		}
+	}
+
+	check("receiver", "MT540")
+	check("transferer", "MT542")
+
+	instruction.Key.Type = nsd.InstructionTypeDVP
+	instruction.Key.PaymentAmount = "10000.00"
+	instruction.Key.PaymentCurrency = "RUB"
+
+	check("receiver", "MT541")
+	check("transferer", "MT543")
+
+	// instruction matched before settlement dates were recorded settles on the instruction date
+	instruction.Value.SettlementDate = ""
+	if _, message := createMT(&instruction, "transferer"); !strings.Contains(message, ":98A::SETT//20180330\r\n") {
+		fmt.Println("Message of instruction without settlement date does not settle on the instruction date")
+		fmt.Println(message)
+		t.FailNow()
+	}
+}
+
+func TestInstructionChaincode_ExportMT(t *testing.T) {
+	stub := getInitializedStub(t)
+
+	instructionArgs := []string{"MZ0987654321", "19000000000000000", "30109810000000000000", "044525505",
+		"RU000A0JVVB5", "500", "SOMEREF123", "2018-03-29", "2018-03-29", "dvp", "RUB"}
+	transferArgs := append(append([]string{"transfer"}, instructionArgs...), "MCXXXXX00000", "MSYYYYY00000",
+		"id_from", `{"document": "doc_from", "description": "123", "created": "2018-03-29"}`)
+
+	stub.SetCaller("org1")
+	response := stub.MockInvoke("1", toByteArray(transferArgs))
+	if response.Status != shim.OK {
+		fmt.Println("Transfer error: " + response.Message)
+		t.FailNow()
+	}
+	id := string(response.Payload)
+
+	type export struct {
+		MessageType string `json:"messageType"`
+		Message     string `json:"message"`
+	}
+	exportMT := func(caller string, args ...string) (export, pb.Response) {
+		stub.SetCaller(caller)
+		response := stub.MockInvoke("2", toByteArray(append([]string{"exportMT"}, args...)))
+		var result export
+		json.Unmarshal(response.Payload, &result)
+		return result, response
+	}
+
+	// the transferer delivers against payment, the amount is read from the private data
+	if result, response := exportMT("org1", id); result.MessageType != "MT543" ||
+		!strings.Contains(result.Message, ":19A::SETT//RUB10000,00") {
+		fmt.Println("Wrong message of the transferer: ", result, response.Message)
+		t.FailNow()
+	}
+	if result, response := exportMT(nsdName, id, "receiver"); result.MessageType != "MT541" ||
+		!strings.Contains(result.Message, ":95R::DEAG/NSDR/MCXXXXX00000") {
+		fmt.Println("Wrong message of the receiver: ", result, response.Message)
+		t.FailNow()
+	}
+
+	if _, response := exportMT(nsdName, id); response.Status != 400 {
+		fmt.Println("Message exported without party.")
+		t.FailNow()
+	}
+	if _, response := exportMT("org1", id, "receiver"); response.Status != 403 {
+		fmt.Println("Message of the receiver exported by the transferer.")
+		t.FailNow()
+	}
+	if _, response := exportMT("org3", id, "transferer"); response.Status != 403 {
+		fmt.Println("Message exported by another organization.")
+		t.FailNow()
+	}
+}
+
+func TestExportAlamedaXML(t *testing.T) {
+	instruction := nsd.Instruction{
+		Key: nsd.InstructionKey{
+			Transferer: nsd.Balance{
+				Account: "transf_acc",
+				Division: "transf_div",
+			},
+			Receiver: nsd.Balance{
+				Account: "recv_acc",
+				Division: "recv_div",
+			},
+			Security: "RU000A0JVVB5",
+			Quantity: "500",
+			Reference: "SOMEREF123",
+			InstructionDate: "2018-03-29",
+			TradeDate: "2018-03-29",
+			Type: nsd.InstructionTypeFOP,
+		},
+
+		Value: nsd.InstructionValue{
+			DeponentFrom: "MCXXXXX00000",
+			DeponentTo: "MSYYYYY00000",
+			MemberInstructionIdFrom: "id_from",
+			MemberInstructionIdTo: "id_to",
+			ReasonFrom: nsd.Reason{
+				Description: "Договор <№1> & Ко",
+				Document: "123",
+				DocumentDate: "2018-03-29",
+			},
+		},
+	}
+
+	from, _ := CreateAlamedaXMLsTestWrapper(&instruction, nsd.InstructionTypeFOP)
+	if !strings.Contains(from, "<based_on>Договор &lt;№1&gt; &amp; Ко</based_on>") {
+		fmt.Println("Reason is not escaped.")
+		fmt.Println(from)
+		t.FailNow()
+	}
+
+	exported := exportAlamedaXML(from)
+	if !strings.HasPrefix(string(exported), `<?xml version="1.0" encoding="Windows-1251"?>`) ||
+		!strings.Contains(string(exported), "<based_on>\xc4\xee\xe3\xee\xe2\xee\xf0 &lt;\xb91&gt; &amp; \xca\xee</based_on>") {
+		fmt.Println("Document is not in Windows-1251.")
+		fmt.Println(string(exported))
+		t.FailNow()
+	}
+
+	if string(toWindows1251("Ёё€✓")) != "\xa8\xb8\x88?" {
+		fmt.Println("Wrong encoding of special characters: ", toWindows1251("Ёё€✓"))
+		t.FailNow()
+	}
+}
+
+func TestInstructionChaincode_ApplyAlamedaResponse(t *testing.T) {
+	stub := getInitializedStub(t)
+
+	instructionArgs := []string{"MZ0987654321", "19000000000000000", "30109810000000000000", "044525505",
+		"RU000A0JVVB5", "500", "someref123", "2018-03-29", "2018-03-29", "fop"}
+	transferArgs := append(append([]string{"transfer"}, instructionArgs...), "MCXXXXX00000", "MSYYYYY00000",
+		"id_from", `{"document": "doc_from", "description": "123", "created": "2018-03-29"}`)
+	receiveArgs := append(append([]string{"receive"}, instructionArgs...), "MCXXXXX00000", "MSYYYYY00000",
+		"id_to", `{"document": "doc_to", "description": "321", "created": "2018-03-29"}`)
+
+	stub.SetCaller("org1")
+	stub.MockInvoke("1", toByteArray(transferArgs))
+	stub.SetCaller("org2")
+	id := string(stub.MockInvoke("2", toByteArray(receiveArgs)).Payload)
+
+	responseXML := func(contragent, instructionId, decision string) string {
+		return `<?xml version="1.0" encoding="Windows-1251"?>
+<Batch>
+<Documents_amount>1</Documents_amount>
+<Document DOC_ID="1" version="7">
+<ORDER_HEADER>
+<deposit_c>NDC000000000</deposit_c>
+<contrag_c>` + contragent + `</contrag_c>
+<contr_d_id>` + instructionId + `</contr_d_id>
+</ORDER_HEADER>
+` + decision + `
+</Document>
+</Batch>`
+	}
+	// reason "Нет бумаг" in Windows-1251
+	const rejection = "<REJECTION><deal_reference>SOMEREF123</deal_reference><reason_c>E12</reason_c>" +
+		"<reason>\xcd\xe5\xf2 \xe1\xf3\xec\xe0\xe3</reason></REJECTION>"
+
+	apply := func(caller string, document string) pb.Response {
+		stub.SetCaller(caller)
+		return stub.MockInvoke("3", [][]byte{[]byte("applyAlamedaResponse"), []byte(document)})
+	}
+
+	if response := apply("org1", responseXML("MSYYYYY00000", "id_to", rejection)); response.Status != 403 {
+		fmt.Println("Response applied not by main organization.")
+		t.FailNow()
+	}
+	if response := apply(nsdName, responseXML("MCXXXXX00000", "id_from",
+		"<EXECUTION><deal_reference>SOMEREF123</deal_reference></EXECUTION>" + rejection)); response.Status != 400 {
+		fmt.Println("Response with both execution and rejection applied.")
+		t.FailNow()
+	}
+	if response := apply(nsdName, responseXML("MCXXXXX00000", "id_to", rejection)); response.Status != 404 {
+		fmt.Println("Response applied to instruction of another party: ", response.Message)
+		t.FailNow()
+	}
+
+	if response := apply(nsdName, responseXML("MSYYYYY00000", "id_to", rejection)); response.Status != shim.OK ||
+		string(response.Payload) != id {
+		fmt.Println("Cannot apply rejection: ", response.Message)
+		t.FailNow()
+	}
+
+	stub.SetCaller(nsdName)
+	response := stub.MockInvoke("4", [][]byte{[]byte("queryByType"), []byte(nsd.InstructionDeclined)})
+	var instructions []nsd.Instruction
+	if err := json.Unmarshal(response.Payload, &instructions); err != nil || len(instructions) != 1 ||
+		instructions[0].Value.StatusInfo != "E12 Нет бумаг" {
+		fmt.Println("Wrong declined instructions: ", instructions, response.Message)
+		t.FailNow()
+	}
+
+	if response := apply(nsdName, responseXML("MCXXXXX00000", "id_from",
+		"<EXECUTION><deal_reference>SOMEREF123</deal_reference></EXECUTION>")); response.Status != 406 {
+		fmt.Println("Declined instruction executed.")
+		t.FailNow()
+	}
+}
+
+func TestInstructionChaincode_Templates(t *testing.T) {
+	stub := getInitializedStub(t)
+
+	response := stub.MockInvoke("1", [][]byte{[]byte("templates")})
+	var templates []AlamedaTemplate
+	if err := json.Unmarshal(response.Payload, &templates); err != nil || len(templates) != 4 ||
+		templates[0].Type != nsd.InstructionTypeDVP || templates[0].Side != "receiver" || templates[0].Version != 1 ||
+		!strings.Contains(templates[0].Template, "<order_t_id>16/3</order_t_id>") {
+		fmt.Println("Default templates are not seeded: ", templates, response.Message)
+		t.FailNow()
+	}
+
+	upload := func(caller string, template string) pb.Response {
+		stub.SetCaller(caller)
+		return stub.MockInvoke("2", [][]byte{[]byte("uploadTemplate"), []byte(nsd.InstructionTypeFOP),
+			[]byte("transferer"), []byte(template)})
+	}
+
+	const template = `<order deal="{{xml .Reference}}" id="{{xml .InstructionID}}"/>`
+	if response := upload("org1", template); response.Status != 403 {
+		fmt.Println("Template uploaded not by main organization.")
+		t.FailNow()
+	}
+	if response := upload(nsdName, `{{.Unknown}}`); response.Status != 400 {
+		fmt.Println("Invalid template uploaded.")
+		t.FailNow()
+	}
+	if response := upload(nsdName, template); response.Status != shim.OK || string(response.Payload) != "2" {
+		fmt.Println("Cannot upload template: ", response.Message)
+		t.FailNow()
+	}
+
+	instructionArgs := []string{"MZ0987654321", "19000000000000000", "30109810000000000000", "044525505",
+		"RU000A0JVVB5", "500", "SOMEREF123", "2018-03-29", "2018-03-29", "fop"}
+	transferArgs := append(append([]string{"transfer"}, instructionArgs...), "MCXXXXX00000", "MSYYYYY00000",
+		"id_from", `{"document": "doc_from", "description": "123", "created": "2018-03-29"}`)
+	receiveArgs := append(append([]string{"receive"}, instructionArgs...), "MCXXXXX00000", "MSYYYYY00000",
+		"id_to", `{"document": "doc_to", "description": "321", "created": "2018-03-29"}`)
+
+	stub.SetCaller("org1")
+	stub.MockInvoke("3", toByteArray(transferArgs))
+	stub.SetCaller("org2")
+	stub.MockInvoke("4", toByteArray(receiveArgs))
+
+	response = stub.MockInvoke("5", [][]byte{[]byte("queryByType"), []byte(nsd.InstructionMatched)})
+	var instructions []nsd.Instruction
+	if err := json.Unmarshal(response.Payload, &instructions); err != nil || len(instructions) != 1 {
+		fmt.Println("Wrong matched instructions: ", instructions, response.Message)
+		t.FailNow()
+	}
+	value := instructions[0].Value
+	if value.AlamedaFrom != `<order deal="SOMEREF123" id="id_from"/>` || value.AlamedaTemplateFrom != 2 ||
+		!strings.Contains(value.AlamedaTo, "<order_t_id>16/1</order_t_id>") || value.AlamedaTemplateTo != 1 {
+		fmt.Println("Documents are not made with the latest templates: ", value)
+		t.FailNow()
+	}
+}
+
+func TestInstructionChaincode_Repo(t *testing.T) {
+	stub := getInitializedStub(t)
+
+	repoArgs := []string{"MZ0987654321", "19000000000000000", "30109810000000000000", "044525505",
+		"RU000A0JVVB5", "500", "SOMEREF123", "2018-03-29", "2018-03-29", "repo",
+		"RUB", "2018-04-28", "7.3",
+		"MCXXXXX00000", "MSYYYYY00000"}
+	transferArgs := append(append([]string{"transfer"}, repoArgs...), "open_from", "close_to",
+		`{"document": "doc_from", "description": "123", "created": "2018-03-29"}`, `{"description": "back"}`)
+	receiveArgs := append(append([]string{"receive"}, repoArgs...), "open_to", "close_from",
+		`{"document": "doc_to", "description": "321", "created": "2018-03-29"}`, `{"description": "there"}`)
+
+	stub.SetCaller("org1")
+	response := stub.MockInvoke("1", toByteArray(transferArgs))
+	deal := string(response.Payload)
+	if response.Status != shim.OK {
+		fmt.Println("Transfer repo error: " + response.Message)
+		t.FailNow()
+	}
+	stub.SetCaller("org2")
+	if response := stub.MockInvoke("2", toByteArray(receiveArgs)); response.Status != shim.OK ||
+		string(response.Payload) != deal {
+		fmt.Println("Receive repo error: " + response.Message)
+		t.FailNow()
+	}
+
+	legs := func(status string) map[string]nsd.Instruction {
+		stub.SetCaller("org1")
+		response := stub.MockInvoke("3", [][]byte{[]byte("queryByType"), []byte(status)})
+		var instructions []nsd.Instruction
+		json.Unmarshal(response.Payload, &instructions)
+		legs := map[string]nsd.Instruction{}
+		for _, instruction := range instructions {
+			if instruction.Value.Repo != nil && instruction.Value.Repo.Deal == deal {
+				legs[instruction.Value.Repo.Leg] = instruction
+			}
+		}
+		return legs
+	}
+
+	matched := legs(nsd.InstructionMatched)
+	opening, closing := matched[nsd.RepoLegOpening], matched[nsd.RepoLegClosing]
+	if opening.Id != deal || opening.Key.PaymentAmount != "10000.00" || opening.Value.MemberInstructionIdTo != "open_to" {
+		fmt.Println("Wrong opening leg: ", opening)
+		t.FailNow()
+	}
+	if closing.Key.InstructionDate != "2018-04-28" || closing.Key.PaymentAmount != "10060.00" ||
+		closing.Key.Transferer.Account != "30109810000000000000" || closing.Key.TransfererRequisites.Account != "rc_money_acc" ||
+		closing.Value.DeponentFrom != "MSYYYYY00000" || closing.Value.MemberInstructionIdFrom != "close_from" ||
+		closing.Value.AdditionalInformation.Description != "back" || closing.Value.AlamedaFrom == "" {
+		fmt.Println("Wrong closing leg: ", closing)
+		t.FailNow()
+	}
+
+	terminate := func(caller string) pb.Response {
+		stub.SetCaller(caller)
+		return stub.MockInvoke("4", [][]byte{[]byte("terminateRepo"), []byte(deal), []byte("2018-04-18")})
+	}
+
+	if response := terminate("org1"); response.Status != 406 {
+		fmt.Println("Repo terminated before the opening leg is executed.")
+		t.FailNow()
+	}
+
+	stub.SetCaller(nsdName)
+	if response := stub.MockInvoke("5", [][]byte{[]byte("status"), []byte(deal), []byte(nsd.InstructionExecuted)});
+		response.Status != shim.OK {
+		fmt.Println("Cannot execute opening leg: " + response.Message)
+		t.FailNow()
+	}
+
+	if response := terminate("org3"); response.Status != 403 {
+		fmt.Println("Repo terminated by another organization.")
+		t.FailNow()
+	}
+	if response := terminate("org1"); response.Status != shim.OK {
+		fmt.Println("Cannot request termination: " + response.Message)
+		t.FailNow()
+	}
+	if closing := legs(nsd.InstructionMatched)[nsd.RepoLegClosing]; closing.Key.InstructionDate != "2018-04-28" {
+		fmt.Println("Repo terminated by one party.")
+		t.FailNow()
+	}
+	if response := terminate("org2"); response.Status != shim.OK {
+		fmt.Println("Cannot terminate repo: " + response.Message)
+		t.FailNow()
+	}
+
+	closing = legs(nsd.InstructionMatched)[nsd.RepoLegClosing]
+	if closing.Key.InstructionDate != "2018-04-18" || closing.Key.PaymentAmount != "10040.00" ||
+		closing.Value.Repo.TerminationDate != "" || !strings.Contains(closing.Value.AlamedaTo, "2018-04-18") {
+		fmt.Println("Wrong closing leg of terminated repo: ", closing)
+		t.FailNow()
+	}
+
+	// references and member instruction ids of both parties move to the termination date
+	indexed := func(index string, attributes ...string) bool {
+		key, _ := stub.CreateCompositeKey(index, attributes)
+		return stub.State[key] != nil
+	}
+	for _, side := range [][]string{{"org2", "close_from"}, {"org1", "close_to"}} {
+		if indexed(referenceIndex, "SOMEREF123", side[0], "2018-04-28", "2018-03-29") ||
+			indexed(instructionIdIndex, side[1], side[0], "2018-04-28") ||
+			!indexed(referenceIndex, "SOMEREF123", side[0], "2018-04-18", "2018-03-29") ||
+			!indexed(instructionIdIndex, side[1], side[0], "2018-04-18") {
+			fmt.Println("Closing leg of terminated repo is not indexed on the termination date: ", side)
+			t.FailNow()
+		}
+	}
+}
+
+func TestRepurchasePrice(t *testing.T) {
+	opening := nsd.InstructionKey{InstructionDate: "2018-03-29", PaymentAmount: "10.00"}
+	for _, test := range []struct {
+		closingDate, rate, price string
+	}{
+		{"2018-04-28", "7.3", "10.06"},
+		// half a minor unit of interest is rounded up, less than half is dropped
+		{"2018-03-30", "18.25", "10.01"},
+		{"2018-03-30", "18.2499", "10.00"},
+		{"2018-03-30", "0", "10.00"},
+	} {
+		if price, err := repurchasePrice(opening, test.closingDate, test.rate); err != nil || price != test.price {
+			fmt.Println("Wrong repurchase price: ", price, err, ", expected: ", test.price)
+			t.FailNow()
+		}
+	}
+
+	for _, rate := range []string{"-1", "1/3", "1e2", "rate"} {
+		if _, err := repurchasePrice(opening, "2018-04-28", rate); err == nil {
+			fmt.Println("Invalid repo rate accepted: ", rate)
+			t.FailNow()
+		}
+	}
+	opening.PaymentAmount = "10.001"
+	if _, err := repurchasePrice(opening, "2018-04-28", "7.3"); err == nil {
+		fmt.Println("Payment amount with more than two fractional digits accepted.")
+		t.FailNow()
+	}
+}
+
+func TestInstructionChaincode_Migrate(t *testing.T) {
+	stub := getInitializedStub(t)
+
+	// values stored before versioning are not in envelope
+	legacy := func(index string, attributes []string) {
+		key, _ := stub.CreateCompositeKey(index, attributes)
+		var data json.RawMessage
+		if err := nsd.UnmarshalValue(index, stub.State[key], &data); err != nil || len(data) == 0 {
+			fmt.Println("Cannot read value of ", index, ": ", err)
+			t.FailNow()
+		}
+		if string(data[0]) == `"` {
+			var text string
+			json.Unmarshal(data, &text)
+			data = json.RawMessage(text)
+		}
+		stub.MockTransactionStart("legacy")
+		stub.PutState(key, data)
+		stub.MockTransactionEnd("legacy")
+	}
+	legacy(nsd.OrganizationIndex, []string{"org1"})
+	legacy(nsd.AuthenticationIndex, []string{"MZ0987654321", "19000000000000000"})
+	deponentKey, _ := stub.CreateCompositeKey(nsd.BalanceDeponentIndex, []string{"MZ0987654321", "19000000000000000"})
+	limitsKey, _ := stub.CreateCompositeKey(limitsIndex, []string{"org1"})
+	stub.MockTransactionStart("legacy")
+	stub.PutState(deponentKey, []byte("MCXXXXX00000"))
+	stub.PutState(limitsKey, []byte(`{"organization": "org1", "maxQuantity": 1000}`))
+	stub.MockTransactionEnd("legacy")
+
+	// values are read in any version
+	stub.SetCaller("org1")
+	response := stub.MockInvoke("1", toByteArray([]string{"transfer", "MZ0987654321", "19000000000000000",
+		"30109810000000000000", "044525505", "RU000A0JVVB5", "500", "SOMEREF123", "2018-03-29", "2018-03-29", "fop",
+		"MCXXXXX00000", "MSYYYYY00000", "id_from",
+		`{"document": "doc_from", "description": "123", "created": "2018-03-29"}`}))
+	if response.Status != shim.OK {
+		fmt.Println("Cannot transfer with legacy values: " + response.Message)
+		t.FailNow()
+	}
+	id := string(response.Payload)
+	legacy(nsd.InstructionKeyIndex, []string{id})
+
+	// instruction stored before ids were introduced is found by id once migrated
+	response = stub.MockInvoke("1", toByteArray([]string{"transfer", "MZ0987654321", "19000000000000000",
+		"30109810000000000000", "044525505", "RU000A0JVVB5", "100", "SOMEREF124", "2018-03-29", "2018-03-29", "fop",
+		"MCXXXXX00000", "MSYYYYY00000", "id_from2",
+		`{"document": "doc_from", "description": "124", "created": "2018-03-29"}`}))
+	if response.Status != shim.OK {
+		fmt.Println("Cannot transfer: " + response.Message)
+		t.FailNow()
+	}
+	unindexed := string(response.Payload)
+	unindexedKey, _ := stub.CreateCompositeKey(nsd.InstructionKeyIndex, []string{unindexed})
+	var instructionKey string
+	nsd.UnmarshalValue(nsd.InstructionKeyIndex, stub.State[unindexedKey], &instructionKey)
+	_, instructionKeyParts, _ := stub.SplitCompositeKey(instructionKey)
+	legacy(nsd.InstructionIndex, instructionKeyParts)
+	stub.MockTransactionStart("legacy")
+	stub.DelState(unindexedKey)
+	stub.MockTransactionEnd("legacy")
+	if response := stub.MockInvoke("1", [][]byte{[]byte("sign"), []byte(unindexed), []byte("signature")});
+		response.Status != 404 {
+		fmt.Println("Instruction is found by id before migration: ", response.Status, response.Message)
+		t.FailNow()
+	}
+
+	// every value is stored in the current version once migrated
+	checkMigrated := func() {
+		response := stub.MockInvoke("1", [][]byte{[]byte("schemaStatus")})
+		var status []struct {
+			Index   string         `json:"index"`
+			Records map[string]int `json:"records"`
+		}
+		if err := json.Unmarshal(response.Payload, &status); err != nil || len(status) != len(schemaIndexes) {
+			fmt.Println("Unexpected schema status: ", string(response.Payload))
+			t.FailNow()
+		}
+		for _, s := range status {
+			for version := range s.Records {
+				if version != "1" {
+					fmt.Println("Unexpected schema status of ", s.Index, ": ", s.Records)
+					t.FailNow()
+				}
+			}
+		}
+	}
+
+	stub.SetCaller(nsdName)
+	if migrated, response := stub.MockMigration(3); response.Status != shim.OK || migrated != 6 {
+		fmt.Println("Unexpected migration: ", migrated, response.Message)
+		t.FailNow()
+	}
+	checkMigrated()
+
+	stub.SetCaller("org1")
+	if response := stub.MockInvoke("2", [][]byte{[]byte("sign"), []byte(id), []byte("signature")});
+		response.Status != shim.OK {
+		fmt.Println("Cannot sign instruction by migrated id: " + response.Message)
+		t.FailNow()
+	}
+	if response := stub.MockInvoke("2", [][]byte{[]byte("sign"), []byte(unindexed), []byte("signature")});
+		response.Status != shim.OK {
+		fmt.Println("Cannot sign instruction by id indexed in migration: " + response.Message)
+		t.FailNow()
+	}
+	var usage LimitsUsage
+	response = stub.MockInvoke("3", toByteArray([]string{"limits", "org1", "2018-03-29"}))
+	if err := json.Unmarshal(response.Payload, &usage); err != nil || usage.MaxQuantity != 1000 {
+		fmt.Println("Migration changed limits: ", usage, response.Message)
+		t.FailNow()
+	}
+}
+
+func TestInstructionChaincode_LinkGroup(t *testing.T) {
+	stub := getInitializedStub(t)
+
+	submit := func(reference string, transfer bool, receive bool) string {
+		instructionArgs := []string{"MZ0987654321", "19000000000000000", "30109810000000000000", "044525505",
+			"RU000A0JVVB5", "500", reference, "2018-03-29", "2018-03-29", "fop"}
+		transferArgs := append(append([]string{"transfer"}, instructionArgs...), "MCXXXXX00000", "MSYYYYY00000",
+			reference + "_from", `{"document": "doc_from", "description": "123", "created": "2018-03-29"}`)
+		receiveArgs := append(append([]string{"receive"}, instructionArgs...), "MCXXXXX00000", "MSYYYYY00000",
+			reference + "_to", `{"document": "doc_to", "description": "321", "created": "2018-03-29"}`)
+
+		id := ""
+		if transfer {
+			stub.SetCaller("org1")
+			id = string(stub.MockInvoke("1", toByteArray(transferArgs)).Payload)
+		}
+		if receive {
+			stub.SetCaller("org2")
+			id = string(stub.MockInvoke("2", toByteArray(receiveArgs)).Payload)
+		}
+		return id
+	}
+	first, second := submit("REF1", true, true), submit("REF2", true, false)
+
+	status := func() (string, int) {
+		response := stub.MockInvoke("3", [][]byte{[]byte("groupStatus"), []byte("group1")})
+		var result struct {
+			Status       string `json:"status"`
+			Instructions []struct {
+				Id string `json:"id"`
+			} `json:"instructions"`
+		}
+		json.Unmarshal(response.Payload, &result)
+		return result.Status, len(result.Instructions)
+	}
+
+	link := func(caller string, function string, args ...string) pb.Response {
+		stub.SetCaller(caller)
+		return stub.MockInvoke("4", toByteArray(append([]string{function}, args...)))
+	}
+	lastEvent := func() (string, linkEvent) {
+		var event *pb.ChaincodeEvent
+		for len(stub.ChaincodeEventsChannel) > 0 {
+			event = <-stub.ChaincodeEventsChannel
+		}
+		var payload linkEvent
+		if event == nil || json.Unmarshal(event.Payload, &payload) != nil {
+			fmt.Println("No event of link group.")
+			t.FailNow()
+		}
+		return event.EventName, payload
+	}
+
+	if response := link("org3", "link", "group1", first); response.Status != 403 {
+		fmt.Println("Instructions linked by another organization.")
+		t.FailNow()
+	}
+	if response := link(nsdName, "link", "group1", first); response.Status != 403 {
+		fmt.Println("Instructions linked without consent of their parties.")
+		t.FailNow()
+	}
+
+	// instructions are linked once both parties link them
+	if response := link("org1", "link", "group1", first, second); response.Status != shim.OK ||
+		string(response.Payload) != "[]" {
+		fmt.Println("Cannot request to link instructions: ", response.Message, string(response.Payload))
+		t.FailNow()
+	}
+	if name, event := lastEvent(); name != nsd.InstructionIndex+".link" || event.Group != "group1" ||
+		len(event.Instructions) != 2 || event.Instructions[0].Value.LinkGroupFrom != "group1" ||
+		event.Instructions[0].Value.LinkGroup != "" {
+		fmt.Println("Wrong event of link request: ", name, event)
+		t.FailNow()
+	}
+	if _, count := status(); count != 0 {
+		fmt.Println("Instructions linked by one party.")
+		t.FailNow()
+	}
+
+	if response := link("org2", "link", "group1", first, second); response.Status != shim.OK ||
+		string(response.Payload) != `["`+first+`","`+second+`"]` {
+		fmt.Println("Cannot link instructions: ", response.Message, string(response.Payload))
+		t.FailNow()
+	}
+	if _, event := lastEvent(); event.Instructions[1].Value.LinkGroup != "group1" {
+		fmt.Println("Wrong event of linked instructions: ", event)
+		t.FailNow()
+	}
+	if status, count := status(); status != nsd.InstructionInitiated || count != 2 {
+		fmt.Println("Group with initiated instruction is not initiated: ", status, count)
+		t.FailNow()
+	}
+
+	if response := link("org1", "link", "group2", first); response.Status != 409 {
+		fmt.Println("Instruction linked to another group.")
+		t.FailNow()
+	}
+
+	// a party takes instruction out of the group, only it has to link it again
+	if response := link("org2", "unlink", second); response.Status != shim.OK {
+		fmt.Println("Cannot unlink instruction: " + response.Message)
+		t.FailNow()
+	}
+	if name, event := lastEvent(); name != nsd.InstructionIndex+".unlink" || event.Group != "group1" ||
+		event.Instructions[0].Value.LinkGroup != "" || event.Instructions[0].Value.LinkGroupFrom != "group1" {
+		fmt.Println("Wrong event of unlinked instruction: ", name, event)
+		t.FailNow()
+	}
+	if _, count := status(); count != 1 {
+		fmt.Println("Unlinked instruction is in the group.")
+		t.FailNow()
+	}
+	link("org2", "link", "group1", second)
+
+	submit("REF2", false, true)
+	if status, count := status(); status != nsd.InstructionMatched || count != 2 {
+		fmt.Println("Group of matched instructions is not matched: ", status, count)
+		t.FailNow()
+	}
+
+	// book chaincode reads instructions it settles by id
+	response := link(nsdName, "queryById", second)
+	var instruction nsd.Instruction
+	if err := json.Unmarshal(response.Payload, &instruction); err != nil || instruction.Id != second ||
+		instruction.Value.LinkGroup != "group1" || instruction.Value.Status != nsd.InstructionMatched {
+		fmt.Println("Wrong instruction by id: ", response.Message, instruction)
+		t.FailNow()
+	}
+	if response := link("org3", "queryById", second); response.Status != 403 {
+		fmt.Println("Instruction is read by another organization.")
+		t.FailNow()
+	}
+	if response := link(nsdName, "queryById", "unknown"); response.Status != 404 {
+		fmt.Println("Unknown instruction is found.")
+		t.FailNow()
+	}
+}
+
+// bookLedger stands for book chaincode on the depository channel, it reports instructions as it has settled them
+type bookLedger struct {
+	settled map[string]nsd.Instruction
+}
+
+func (this *bookLedger) Init(stub shim.ChaincodeStubInterface) pb.Response {
+	return shim.Success(nil)
+}
+
+func (this *bookLedger) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
+	function, args := stub.GetFunctionAndParameters()
+	instruction, ok := this.settled[args[0]]
+	if function != "settlement" || !ok {
+		return pb.Response{Status: 404, Message: "Instruction is not settled."}
+	}
+	data, _ := json.Marshal(instruction)
+	return shim.Success(data)
+}
+
+func TestInstructionChaincode_PartialSettlement(t *testing.T) {
+	stub := getInitializedStub(t)
+
+	instructionArgs := []string{"MZ0987654321", "19000000000000000", "30109810000000000000", "044525505",
+		"RU000A0JVVB5", "500", "SOMEREF123", "2018-03-29", "2018-03-29", "dvp", "RUB"}
+	transferArgs := append(append([]string{"transfer"}, instructionArgs...), "MCXXXXX00000", "MSYYYYY00000",
+		"id_from", `{"document": "doc_from", "description": "123", "created": "2018-03-29"}`)
+	receiveArgs := append(append([]string{"receive"}, instructionArgs...), "MCXXXXX00000", "MSYYYYY00000",
+		"id_to", `{"document": "doc_to", "description": "321", "created": "2018-03-29"}`,
+		`{"description": "Additional info."}`)
+
+	stub.SetCaller("org1")
+	id := string(stub.MockInvoke("1", toByteArray(transferArgs)).Payload)
+	stub.SetCaller("org2")
+	stub.MockInvoke("2", toByteArray(receiveArgs))
+
+	book := &bookLedger{settled: map[string]nsd.Instruction{}}
+	stub.AddPeerChaincode("book", "depository", book)
+
+	settle := func(quantity ...string) pb.Response {
+		stub.SetCaller(nsdName)
+		return stub.MockInvoke("3", toByteArray(append([]string{"settlePartially", id}, quantity...)))
+	}
+	allow := func(caller string) pb.Response {
+		stub.SetCaller(caller)
+		return stub.MockInvoke("4", [][]byte{[]byte("allowPartialSettlement"), []byte(id)})
+	}
+
+	if response := allow("org3"); response.Status != 403 {
+		fmt.Println("Partial settlement allowed by another organization.")
+		t.FailNow()
+	}
+	if response := allow("org1"); response.Status != shim.OK {
+		fmt.Println("Cannot allow partial settlement: " + response.Message)
+		t.FailNow()
+	}
+	if response := settle(); response.Status != 406 {
+		fmt.Println("Instruction settled partially without consent of the receiver.")
+		t.FailNow()
+	}
+	allow("org2")
+
+	// the settled quantity is that of the book
+	if response := settle(); response.Status != 409 {
+		fmt.Println("Partial settlement recorded before the book has settled instruction.")
+		t.FailNow()
+	}
+	settled := nsd.Instruction{}
+	settled.Value.Status = nsd.InstructionPartiallyExecuted
+	settled.Value.SettledQuantity = "200"
+	book.settled[id] = settled
+	if response := settle("300"); response.Status != 409 {
+		fmt.Println("Partial settlement recorded with quantity other than that of the book.")
+		t.FailNow()
+	}
+
+	response := settle("200")
+	remainderId := string(response.Payload)
+	if response.Status != shim.OK {
+		fmt.Println("Cannot settle instruction partially: " + response.Message)
+		t.FailNow()
+	}
+	if response := settle(); response.Status != 406 {
+		fmt.Println("Instruction settled partially twice.")
+		t.FailNow()
+	}
+
+	stub.SetCaller("org1")
+	query := func(status string) []nsd.Instruction {
+		var instructions []nsd.Instruction
+		json.Unmarshal(stub.MockInvoke("5", [][]byte{[]byte("queryByType"), []byte(status)}).Payload, &instructions)
+		return instructions
+	}
+
+	parents := query(nsd.InstructionPartiallyExecuted)
+	if len(parents) != 1 || parents[0].Id != id || parents[0].Value.SettledQuantity != "200" ||
+		parents[0].Value.SettledAmount != "4000.00" || parents[0].Value.Remainder != remainderId {
+		fmt.Println("Wrong instruction partially executed: ", parents)
+		t.FailNow()
+	}
+
+	remainders := query(nsd.InstructionMatched)
+	if len(remainders) != 1 || remainders[0].Id != remainderId || remainders[0].Value.Parent != id ||
+		remainders[0].Key.Quantity != "300" || remainders[0].Key.PaymentAmount != "6000.00" ||
+		remainders[0].Value.MemberInstructionIdTo != "id_to" || remainders[0].Value.AlamedaFrom == "" {
+		fmt.Println("Wrong remainder of instruction: ", remainders)
+		t.FailNow()
+	}
+}
+
+func TestInstructionChaincode_DueForSettlement(t *testing.T) {
+	stub := getInitializedStub(t)
+
+	instructionArgs := []string{"MZ0987654321", "19000000000000000", "30109810000000000000", "044525505",
+		"RU000A0JVVB5", "500", "SOMEREF123", "2018-03-29", "2018-03-29", "fop"}
+	transferArgs := append(append([]string{"transfer"}, instructionArgs...), "MCXXXXX00000", "MSYYYYY00000",
+		"id_from", `{"document": "doc_from", "description": "123", "created": "2018-03-29"}`)
+	receiveArgs := append(append([]string{"receive"}, instructionArgs...), "MCXXXXX00000", "MSYYYYY00000",
+		"id_to", `{"document": "doc_to", "description": "321", "created": "2018-03-29"}`)
+
+	stub.SetCaller("org1")
+	id := string(stub.MockInvoke("1", toByteArray(transferArgs)).Payload)
+
+	due := func(day string) []nsd.Instruction {
+		stub.SetCaller(nsdName)
+		var instructions []nsd.Instruction
+		json.Unmarshal(stub.MockInvoke("2", [][]byte{[]byte("dueForSettlement"), []byte(day)}).Payload, &instructions)
+		return instructions
+	}
+
+	if instructions := due("2018-03-29"); len(instructions) != 0 {
+		fmt.Println("Initiated instruction is due for settlement.")
+		t.FailNow()
+	}
+
+	// settlement date is set on matching by the calendar of "security" chaincode: T+1 past the holiday and weekend
+	stub.SetCalendar(`{"settlementCycle": 1, "holidays": ["2018-03-30"]}`)
+	stub.SetCaller("org2")
+	stub.MockInvoke("3", toByteArray(receiveArgs))
+
+	if instructions := due("2018-03-30"); len(instructions) != 0 {
+		fmt.Println("Instruction is due before its settlement date.")
+		t.FailNow()
+	}
+	if instructions := due("2018-04-02"); len(instructions) != 1 || instructions[0].Id != id ||
+		instructions[0].Value.SettlementDate != "2018-04-02" {
+		fmt.Println("Matched instruction is not due for settlement: ", instructions)
+		t.FailNow()
+	}
+
+	if response := stub.MockInvoke("4", [][]byte{[]byte("dueForSettlement"), []byte("30.03.2018")});
+		response.Status != 400 {
+		fmt.Println("Wrong date accepted.")
+		t.FailNow()
+	}
+
+	stub.MockInvoke("5", [][]byte{[]byte("status"), []byte(id), []byte(nsd.InstructionExecuted)})
+	if instructions := due("2018-04-02"); len(instructions) != 0 {
+		fmt.Println("Executed instruction is due for settlement.")
+		t.FailNow()
+	}
+}
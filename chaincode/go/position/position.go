@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"encoding/json"
 	"time"
+	"strconv"
 
 	"github.com/hyperledger/fabric/core/chaincode/shim"
 	pb "github.com/hyperledger/fabric/protos/peer"
@@ -13,6 +14,20 @@ import (
 
 var logger = shim.NewLogger("PositionChaincode")
 
+const syncIndex = `PositionSync`
+
+// organization the bilateral channel is shared with
+const channelOrganizationIndex = `ChannelOrganization`
+
+// indexes of values versioned by nsd schemas, see migrate
+var schemaIndexes = append([]string{nsd.PositionIndex, syncIndex, channelOrganizationIndex}, nsd.CommonSchemaIndexes...)
+
+func init() {
+	nsd.RegisterSchema(nsd.Schema{Index: syncIndex, Version: 1, Upgrades: map[int]nsd.Upgrade{0: nsd.Unversioned}})
+	nsd.RegisterSchema(nsd.Schema{Index: channelOrganizationIndex, Version: 1,
+		Upgrades: map[int]nsd.Upgrade{0: nsd.UnversionedString}, Singleton: true})
+}
+
 type PositionChaincode struct {
 }
 
@@ -29,13 +44,76 @@ type PositionValue struct {
 	Quantity        string 	`json:"quantity"`
 }
 
+// transaction a position was last synchronized from "book" chaincode in
+type SyncValue struct {
+	SyncTxId      string `json:"syncTxId"`
+	SyncTimestamp string `json:"syncTimestamp"`
+}
+
+// required for lastSync
+type PositionSync struct {
+	nsd.Position
+	SyncValue
+}
+
+// holdings grouping criteria
+const (
+	GroupByDeponent = "deponent"
+	GroupBySecurity = "security"
+	GroupByAccount  = "account"
+)
+
+// Holding is total quantity of positions sharing a grouping key along with these positions
+type Holding struct {
+	Deponent     string         `json:"deponent,omitempty"`
+	Organization string         `json:"organization,omitempty"`
+	Account      string         `json:"account,omitempty"`
+	Security     string         `json:"security,omitempty"`
+	Quantity     int            `json:"quantity"`
+	Lines        []nsd.Position `json:"lines"`
+}
+
 // **** Chaincode Methods **** //
 func (t *PositionChaincode) Init(stub shim.ChaincodeStubInterface) pb.Response  {
 	logger.Info("########### PositionChaincode Init ###########")
 
+	_, args := stub.GetFunctionAndParameters()
+
+	// configuration, main organization is kept by "security" chaincode
+	config := ""
+	if len(args) > 0 {
+		config = args[0]
+	}
+	if rs := nsd.InitConfig(stub, config); rs.Status != shim.OK {
+		return rs
+	}
+
+	// organization the channel is shared with is kept on upgrade unless given
+	if len(args) > 1 && args[1] != "" {
+		value, err := nsd.MarshalValue(channelOrganizationIndex, args[1])
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if err := stub.PutState(channelOrganizationIndex, value); err != nil {
+			return pb.Response{Status: 500, Message: "Persistence failure."}
+		}
+	}
+
 	return shim.Success(nil)
 }
 
+// getChannelOrganization returns organization the channel is shared with or empty string
+func getChannelOrganization(stub shim.ChaincodeStubInterface) (string, error) {
+	data, err := stub.GetState(channelOrganizationIndex)
+	if err != nil || len(data) == 0 {
+		return "", err
+	}
+
+	var organization string
+	err = nsd.UnmarshalValue(channelOrganizationIndex, data, &organization)
+	return organization, err
+}
+
 func (t *PositionChaincode) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
 	logger.Info("########### PositionChaincode Invoke ###########")
 
@@ -50,14 +128,47 @@ func (t *PositionChaincode) Invoke(stub shim.ChaincodeStubInterface) pb.Response
 	if function == "history" {
 		return t.history(stub, args)
 	}
+	if function == "syncFromBook" {
+		return t.syncFromBook(stub, args)
+	}
+	if function == "lastSync" {
+		return t.lastSync(stub, args)
+	}
+	if function == "queryByAccount" {
+		return t.queryByAccount(stub, args)
+	}
+	if function == "holdings" {
+		return t.holdings(stub, args)
+	}
+	if function == "mainOrg" {
+		return nsd.QueryMainOrg(stub)
+	}
+	if function == "config" {
+		return nsd.QueryConfig(stub)
+	}
+	if function == "pendingMigration" {
+		return nsd.PendingMigration(stub, args, schemaIndexes...)
+	}
+	if function == "migrate" {
+		return nsd.Migrate(stub, args, schemaIndexes...)
+	}
+	if function == "schemaStatus" {
+		return nsd.SchemaStatus(stub, schemaIndexes...)
+	}
 
 	err := fmt.Sprintf("Unknown function, check the first argument, must be one of: " +
-		"put, query, history. But got: %v", function)
+		"put, query, queryByAccount, history, syncFromBook, lastSync, holdings, mainOrg, config, " +
+		"pendingMigration, migrate, schemaStatus. " +
+		"But got: %v", function)
 	logger.Error(err)
 	return shim.Error(err)
 }
 
 func (t *PositionChaincode) put(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if rs := nsd.AuthorizeMainOrg(stub, "change Positions"); rs.Status != shim.OK {
+		return rs
+	}
+
 	position := nsd.Position{}
 	err := position.FillFromArgs(args)
 	if err != nil {
@@ -65,6 +176,14 @@ func (t *PositionChaincode) put(stub shim.ChaincodeStubInterface, args []string)
 		return shim.Error(err.Error())
 	}
 
+	owner, err := nsd.GetBookOrganization(stub, position.Balance)
+	if err != nil {
+		return pb.Response{Status: 500, Message: "Unable to get balance owner: " + err.Error()}
+	}
+	if err := recordOwner(stub, position.Balance, owner); err != nil {
+		return pb.Response{Status: 500, Message: "Persistence failure."}
+	}
+
 	if position.UpsertIn(stub) != nil {
 		return shim.Error("Position upsertIn error.")
 	}
@@ -73,46 +192,189 @@ func (t *PositionChaincode) put(stub shim.ChaincodeStubInterface, args []string)
 }
 
 func (t *PositionChaincode) query(stub shim.ChaincodeStubInterface, args []string) pb.Response {
-	it, err := stub.GetStateByPartialCompositeKey(nsd.PositionIndex, []string{})
+	positions, err := t.find(stub, []string{})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	result, err := json.Marshal(positions)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(result)
+}
+
+func (t *PositionChaincode) queryByAccount(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) < 1 || len(args) > 2 {
+		return pb.Response{Status: 400, Message: "Incorrect number of arguments. " +
+			"Expecting account and optionally division"}
+	}
+
+	positions, err := t.find(stub, args)
 	if err != nil {
 		return shim.Error(err.Error())
 	}
+
+	result, err := json.Marshal(positions)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(result)
+}
+
+// find returns positions matching partial key account-division-security the caller is allowed to see:
+// main organization sees all of them, others only balances registered to their organization
+func (t *PositionChaincode) find(stub shim.ChaincodeStubInterface, keyParts []string) ([]nsd.Position, error) {
+	it, err := stub.GetStateByPartialCompositeKey(nsd.PositionIndex, keyParts)
+	if err != nil {
+		return nil, err
+	}
 	defer it.Close()
 
+	isMainOrg := nsd.CallerIsMainOrg(stub)
+	owners := balanceOwners{}
+
 	positions := []nsd.Position{}
 	for it.HasNext() {
 		response, err := it.Next()
 		if err != nil {
-			return shim.Error(err.Error())
+			return nil, err
 		}
 
 		position := nsd.Position{}
 
 		err = position.FillFromLedgerValue(response.Value)
 		if err != nil {
-			return shim.Error(err.Error())
+			return nil, err
 		}
 
 		_, compositeKeyParts, err := stub.SplitCompositeKey(response.Key)
 		if err != nil {
-			return shim.Error(err.Error())
+			return nil, err
 		}
 		err = position.FillFromCompositeKeyParts(compositeKeyParts)
 		if err != nil {
-			return shim.Error(err.Error())
+			return nil, err
+		}
+
+		if !isMainOrg {
+			owned, err := owners.ownedByCaller(stub, position.Balance)
+			if err != nil {
+				return nil, err
+			}
+			if !owned {
+				continue
+			}
 		}
 
 		positions = append(positions, position)
+	}
 
+	return positions, nil
+}
+
+// holdings aggregates positions visible to the caller:
+// by deponent code the balance is registered under and security, by security across all balances,
+// or by account across securities
+func (t *PositionChaincode) holdings(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return pb.Response{Status: 400, Message: "Incorrect number of arguments. " +
+			"Expecting grouping: " + GroupByDeponent + ", " + GroupBySecurity + " or " + GroupByAccount}
 	}
 
-	result, err := json.Marshal(positions)
+	groupBy := args[0]
+	if groupBy != GroupByDeponent && groupBy != GroupBySecurity && groupBy != GroupByAccount {
+		return pb.Response{Status: 400, Message: "Unknown grouping " + groupBy + "."}
+	}
+
+	positions, err := t.find(stub, []string{})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	owners := balanceOwners{}
+	holdings := []Holding{}
+	indexes := map[string]int{}
+	for _, position := range positions {
+		holding := Holding{Lines: []nsd.Position{}}
+		switch groupBy {
+		case GroupByDeponent:
+			organization, err := owners.get(stub, position.Balance)
+			if err != nil {
+				return pb.Response{Status: 500, Message: "Unable to get balance owner: " + err.Error()}
+			}
+			holding.Deponent = organization.Deponent
+			holding.Organization = organization.Name
+			holding.Security = position.Security
+		case GroupBySecurity:
+			holding.Security = position.Security
+		case GroupByAccount:
+			holding.Account = position.Balance.Account
+		}
+
+		key := holding.Organization + "/" + holding.Deponent + "/" + holding.Account + "/" + holding.Security
+		i, ok := indexes[key]
+		if !ok {
+			i = len(holdings)
+			indexes[key] = i
+			holdings = append(holdings, holding)
+		}
+
+		holdings[i].Quantity += position.Quantity
+		holdings[i].Lines = append(holdings[i].Lines, position)
+	}
+
+	result, err := json.Marshal(holdings)
 	if err != nil {
 		return shim.Error(err.Error())
 	}
 	return shim.Success(result)
 }
 
+// recordOwner keeps the organization the balance is registered to in "book" chaincode along with
+// the deponent code it is held under in the registry of the channel, the balance is removed if it is not registered
+func recordOwner(stub shim.ChaincodeStubInterface, balance nsd.Balance, owner nsd.Organization) error {
+	if owner.Name == "" {
+		return nsd.UnregisterBalances(stub, []nsd.Organization{{Balances: []nsd.Balance{balance}}})
+	}
+	return nsd.RegisterBalances(stub, []nsd.Organization{{Name: owner.Name,
+		Deponents: map[string][]nsd.Balance{owner.Deponent: {balance}}}})
+}
+
+// balanceOwners resolves organizations owning balances from the registry of the channel, which is copied
+// from "book" chaincode along with positions so that peers of other organizations read it without calling the book;
+// each balance is looked up once per transaction
+type balanceOwners map[nsd.Balance]nsd.Organization
+
+func (this balanceOwners) get(stub shim.ChaincodeStubInterface, balance nsd.Balance) (nsd.Organization, error) {
+	if organization, ok := this[balance]; ok {
+		return organization, nil
+	}
+
+	organization := nsd.Organization{}
+	name, err := nsd.GetOrganizationName(stub, balance)
+	if err != nil {
+		return organization, err
+	}
+	if name != "" {
+		organization.Name = name
+		if organization.Deponent, err = nsd.GetDeponent(stub, balance); err != nil {
+			return organization, err
+		}
+	}
+	this[balance] = organization
+	return organization, nil
+}
+
+// ownedByCaller checks the balance is registered to the organization of transaction creator
+func (this balanceOwners) ownedByCaller(stub shim.ChaincodeStubInterface, balance nsd.Balance) (bool, error) {
+	organization, err := this.get(stub, balance)
+	if err != nil || organization.Name == "" {
+		return false, err
+	}
+	return nsd.CreatorBelongsTo(stub, organization.Name), nil
+}
+
 func (t *PositionChaincode) history(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 	if len(args) != 3 {
 		return shim.Error("Incorrect number of arguments. Expecting account, division, security")
@@ -124,6 +386,16 @@ func (t *PositionChaincode) history(stub shim.ChaincodeStubInterface, args []str
 		return shim.Error(err.Error())
 	}
 
+	if !nsd.CallerIsMainOrg(stub) {
+		owned, err := balanceOwners{}.ownedByCaller(stub, position.Balance)
+		if err != nil {
+			return pb.Response{Status: 500, Message: "Unable to get balance owner: " + err.Error()}
+		}
+		if !owned {
+			return pb.Response{Status: 403, Message: "Position is not owned by caller's organization."}
+		}
+	}
+
 	compositeKey, err := position.ToCompositeKey(stub)
 	if err != nil {
 		return shim.Error(err.Error())
@@ -154,14 +426,11 @@ func (t *PositionChaincode) history(stub shim.ChaincodeStubInterface, args []str
 		}
 
 
-		var values []string
-		err = json.Unmarshal(response.GetValue(), &values)
-		if err != nil {
+		var position nsd.Position
+		if err := position.FillFromLedgerValue(response.GetValue()); err != nil {
 			return shim.Error(err.Error())
 		}
-		if len(values) > 0 {
-			entry.Value.Quantity = values[0]
-		}
+		entry.Value.Quantity = strconv.Itoa(position.Quantity)
 
 		modifications = append(modifications, entry)
 	}
@@ -173,6 +442,171 @@ func (t *PositionChaincode) history(stub shim.ChaincodeStubInterface, args []str
 	return shim.Success(result)
 }
 
+// syncFromBook copies positions of "book" chaincode read by calling it, only those of balances registered there
+// to the organization the channel is shared with, and keeps the registration of these balances in the channel.
+// Positions synchronized by a transaction with a later timestamp are left untouched.
+func (t *PositionChaincode) syncFromBook(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if rs := nsd.AuthorizeMainOrg(stub, "synchronize Positions"); rs.Status != shim.OK {
+		return rs
+	}
+
+	if len(args) != 0 {
+		return pb.Response{Status: 400, Message: "Incorrect number of arguments. Expecting none"}
+	}
+
+	organization, err := getChannelOrganization(stub)
+	if err != nil {
+		return pb.Response{Status: 500, Message: "Persistence failure."}
+	}
+	if organization == "" {
+		return pb.Response{Status: 409, Message: "Organization of the channel is not set."}
+	}
+
+	rs := nsd.InvokeBook(stub, "query")
+	if rs.Status >= 400 {
+		return pb.Response{Status: 400, Message: "Unable to invoke \"book\": " + rs.Message}
+	}
+
+	var positions []nsd.Position
+	if err := json.Unmarshal(rs.Payload, &positions); err != nil {
+		return shim.Error("Cannot unmarshal response: " + err.Error())
+	}
+
+	txTimestamp, err := stub.GetTxTimestamp()
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	syncTime := time.Unix(txTimestamp.Seconds, int64(txTimestamp.Nanos)).UTC()
+
+	sync := SyncValue{
+		SyncTxId:      stub.GetTxID(),
+		SyncTimestamp: syncTime.Format(time.RFC3339Nano),
+	}
+
+	type syncResult struct {
+		Applied int `json:"applied"`
+		Skipped int `json:"skipped"`
+	}
+	result := syncResult{}
+
+	owners := map[nsd.Balance]nsd.Organization{}
+	for _, position := range positions {
+		owner, ok := owners[position.Balance]
+		if !ok {
+			if owner, err = nsd.GetBookOrganization(stub, position.Balance); err != nil {
+				return pb.Response{Status: 500, Message: "Unable to get balance owner: " + err.Error()}
+			}
+			owners[position.Balance] = owner
+
+			// a balance registered to another organization since is no longer shown in the channel
+			if owner.Name != organization {
+				owner = nsd.Organization{}
+			}
+			if err := recordOwner(stub, position.Balance, owner); err != nil {
+				return pb.Response{Status: 500, Message: "Persistence failure."}
+			}
+		}
+		if owner.Name != organization {
+			continue
+		}
+
+		key, err := stub.CreateCompositeKey(syncIndex, []string{position.Balance.Account, position.Balance.Division,
+			position.Security})
+		if err != nil {
+			return pb.Response{Status: 400, Message: "Composite key creation error."}
+		}
+
+		data, err := stub.GetState(key)
+		if err != nil {
+			return pb.Response{Status: 500, Message: "Persistence failure."}
+		}
+
+		if data != nil {
+			var last SyncValue
+			if err := nsd.UnmarshalValue(syncIndex, data, &last); err != nil {
+				return shim.Error(err.Error())
+			}
+
+			lastSyncTime, err := time.Parse(time.RFC3339Nano, last.SyncTimestamp)
+			if err != nil {
+				return shim.Error(err.Error())
+			}
+
+			// read from the book later already
+			if lastSyncTime.After(syncTime) {
+				result.Skipped++
+				continue
+			}
+		}
+
+		if err := position.UpsertIn(stub); err != nil {
+			return pb.Response{Status: 500, Message: "Persistence failure."}
+		}
+
+		value, err := nsd.MarshalValue(syncIndex, sync)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		if err := stub.PutState(key, value); err != nil {
+			return pb.Response{Status: 500, Message: "Persistence failure."}
+		}
+
+		result.Applied++
+	}
+
+	payload, err := json.Marshal(result)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(payload)
+}
+
+// lastSync reports positions along with the book transaction they were last synchronized from,
+// optionally narrowed by account, division and security
+func (t *PositionChaincode) lastSync(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) > 3 {
+		return pb.Response{Status: 400, Message: "Incorrect number of arguments. " +
+			"Expecting optional account, division, security"}
+	}
+
+	positions, err := t.find(stub, args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	results := []PositionSync{}
+	for _, position := range positions {
+		result := PositionSync{Position: position}
+
+		syncKey, err := stub.CreateCompositeKey(syncIndex, []string{position.Balance.Account,
+			position.Balance.Division, position.Security})
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		data, err := stub.GetState(syncKey)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		// positions put directly have never been synchronized
+		if data != nil {
+			if err := nsd.UnmarshalValue(syncIndex, data, &result.SyncValue); err != nil {
+				return shim.Error(err.Error())
+			}
+		}
+
+		results = append(results, result)
+	}
+
+	payload, err := json.Marshal(results)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(payload)
+}
+
 // **** main method **** //
 func main() {
 	err := shim.Start(new(PositionChaincode))
@@ -0,0 +1,418 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Altoros/nsd-commercial-paper-common"
+	"github.com/Altoros/nsd-commercial-paper-common/testutils"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+const nsdName = "nsd.nsd.ru"
+
+func getStub(t *testing.T) *testutils.TestStub {
+	stub := testutils.NewTestStub("position", new(PositionChaincode))
+	stub.SetCaller(nsdName)
+	stub.SetMainOrganization(nsdName)
+	stub.MockInit("1", [][]byte{[]byte("init")})
+	// owners of positions put are looked up in the book, none is registered
+	stub.AddPeerChaincode("book", "depository", &bookChaincode{positions: `[]`})
+	return stub
+}
+
+// every invocation is a transaction of its own, as values read from other chaincodes are cached per transaction
+var transactions int
+
+func checkStatus(t *testing.T, stub *testutils.TestStub, expectedStatus int32, args ...string) []byte {
+	var byteArgs [][]byte
+	for _, arg := range args {
+		byteArgs = append(byteArgs, []byte(arg))
+	}
+
+	transactions++
+	res := stub.MockInvoke(fmt.Sprintf("tx%d", transactions), byteArgs)
+	if res.Status != expectedStatus {
+		fmt.Println("Wrong status. Current value: ", res.Status, ", Expected value: ", expectedStatus, ". ", res.Message)
+		t.FailNow()
+	}
+	return res.Payload
+}
+
+func checkSync(t *testing.T, stub *testutils.TestStub) []PositionSync {
+	var results []PositionSync
+	if err := json.Unmarshal(checkStatus(t, stub, 200, "lastSync"), &results); err != nil {
+		fmt.Println("Cannot unmarshal lastSync: ", err)
+		t.FailNow()
+	}
+	return results
+}
+
+// answers "query" of "book" chaincode with positions synchronized from it
+// and "organization" from the balances it is initialized with
+type bookChaincode struct {
+	positions string
+}
+
+func (cc *bookChaincode) Init(stub shim.ChaincodeStubInterface) pb.Response {
+	_, args := stub.GetFunctionAndParameters()
+	var organizations []nsd.Organization
+	if err := json.Unmarshal([]byte(args[0]), &organizations); err != nil {
+		return pb.Response{Status: 400, Message: "JSON unmarshalling error."}
+	}
+	if err := nsd.RegisterBalances(stub, organizations); err != nil {
+		return pb.Response{Status: 500, Message: "Persistence failure."}
+	}
+	return shim.Success(nil)
+}
+
+func (cc *bookChaincode) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
+	function, args := stub.GetFunctionAndParameters()
+	if function == "organization" {
+		return nsd.QueryOrganization(stub, args)
+	}
+	return shim.Success([]byte(cc.positions))
+}
+
+// registerBalances registers organizations given as JSON in "book" chaincode of the stub
+func registerBalances(t *testing.T, stub *testutils.TestStub, organizations string) {
+	book := stub.AddPeerChaincode("book", "depository", &bookChaincode{positions: `[]`})
+	if res := book.MockInit("1", [][]byte{[]byte("init"), []byte(organizations)}); res.Status != 200 {
+		fmt.Println("Cannot register balances: ", res.Message)
+		t.FailNow()
+	}
+}
+
+func TestPosition_Put(t *testing.T) {
+	stub := getStub(t)
+
+	checkStatus(t, stub, 200, "put", "AC0689654902", "87680000045800005", "RU000ABC0001", "100")
+
+	stub.SetCaller("org1")
+	checkStatus(t, stub, 403, "put", "AC0689654902", "87680000045800005", "RU000ABC0001", "200")
+	checkStatus(t, stub, 403, "syncFromBook")
+
+	stub.SetCaller(nsdName)
+	results := checkSync(t, stub)
+	if len(results) != 1 || results[0].Quantity != 100 || results[0].SyncTxId != "" {
+		fmt.Println("Unexpected positions: ", results)
+		t.FailNow()
+	}
+}
+
+func TestPosition_SyncFromBook(t *testing.T) {
+	stub := getStub(t)
+	book := &bookChaincode{}
+	stub.AddPeerChaincode("book", "depository", book)
+	checkStatus(t, stub, 409, "syncFromBook")
+
+	// the channel is shared with org1, the other balance is registered to org2
+	stub.MockInit("1", [][]byte{[]byte("init"), []byte(""), []byte("org1")})
+	register := func(organizations string) {
+		if res := stub.AddPeerChaincode("book", "depository", book).MockInit("1",
+			[][]byte{[]byte("init"), []byte(organizations)}); res.Status != 200 {
+			fmt.Println("Cannot register balances: ", res.Message)
+			t.FailNow()
+		}
+	}
+	register(`[{"organization": "org1", "deponent": "DE000001",
+			"balances": [{"account": "AC0689654902", "division": "87680000045800005"}]},
+		{"organization": "org2", "balances": [{"account": "MZ0987654321", "division": "19000000000000000"}]}]`)
+
+	positions := func(quantity int) string {
+		return fmt.Sprintf(`[{"balance":{"account":"AC0689654902","division":"87680000045800005"},
+			"security":"RU000ABC0001","quantity":%d}, {"balance":{"account":"MZ0987654321","division":"19000000000000000"},
+			"security":"RU000ABC0001","quantity":%d}]`, quantity, quantity)
+	}
+	sync := func(txTime time.Time) {
+		stub.SetTxTime(txTime)
+		checkStatus(t, stub, 200, "syncFromBook")
+	}
+
+	book.positions = positions(200)
+	sync(time.Date(2018, 4, 18, 13, 20, 0, 0, time.UTC))
+
+	// the book is read by the transaction, an earlier one endorsed later is ignored
+	book.positions = positions(100)
+	sync(time.Date(2018, 4, 18, 13, 19, 55, 0, time.UTC))
+
+	results := checkSync(t, stub)
+	if len(results) != 1 || results[0].Quantity != 200 || results[0].SyncTimestamp != "2018-04-18T13:20:00Z" {
+		fmt.Println("Stale update was applied: ", results)
+		t.FailNow()
+	}
+
+	book.positions = positions(0)
+	sync(time.Date(2018, 4, 18, 13, 21, 0, 0, time.UTC))
+
+	results = checkSync(t, stub)
+	if len(results) != 1 || results[0].Quantity != 0 || results[0].SyncTimestamp != "2018-04-18T13:21:00Z" {
+		fmt.Println("Fresh update was not applied: ", results)
+		t.FailNow()
+	}
+
+	// the registration is kept in the channel, its organization reads positions without calling the book
+	stub.SetCaller("org1")
+	if holdings := checkHoldings(t, stub, GroupByDeponent); len(holdings) != 1 || holdings[0].Deponent != "DE000001" {
+		fmt.Println("Synchronized position is not visible to its owner: ", holdings)
+		t.FailNow()
+	}
+
+	// balance registered to another organization since is no longer shown
+	stub.SetCaller(nsdName)
+	register(`[{"organization": "org2", "balances": [{"account": "AC0689654902", "division": "87680000045800005"}]}]`)
+	sync(time.Date(2018, 4, 18, 13, 22, 0, 0, time.UTC))
+	stub.SetCaller("org1")
+	if positions := checkPositions(t, stub, "query"); len(positions) != 0 {
+		fmt.Println("Position of another organization is visible: ", positions)
+		t.FailNow()
+	}
+
+	stub.SetCaller(nsdName)
+	checkStatus(t, stub, 400, "syncFromBook", "RU000ABC0001")
+}
+
+func checkPositions(t *testing.T, stub *testutils.TestStub, args ...string) []nsd.Position {
+	var positions []nsd.Position
+	if err := json.Unmarshal(checkStatus(t, stub, 200, args...), &positions); err != nil {
+		fmt.Println("Cannot unmarshal positions: ", err)
+		t.FailNow()
+	}
+	return positions
+}
+
+func TestPosition_Visibility(t *testing.T) {
+	stub := getStub(t)
+	organizations := `[{
+			"organization": "org1",
+			"balances": [{"account": "MZ0987654321", "division": "19000000000000000"}]
+		}, {
+			"organization": "org2",
+			"balances": [{"account": "30109810000000000000", "division": "044525505"}]
+		}]`
+	registerBalances(t, stub, organizations)
+
+	checkStatus(t, stub, 200, "put", "MZ0987654321", "19000000000000000", "RU000ABC0001", "100")
+	checkStatus(t, stub, 200, "put", "MZ0987654321", "19000000000000000", "RU000ABC0002", "50")
+	checkStatus(t, stub, 200, "put", "30109810000000000000", "044525505", "RU000ABC0001", "200")
+	checkStatus(t, stub, 200, "put", "UNREGISTERED", "044525505", "RU000ABC0001", "300")
+
+	if positions := checkPositions(t, stub, "query"); len(positions) != 4 {
+		fmt.Println("Main organization doesn't see all positions: ", positions)
+		t.FailNow()
+	}
+
+	stub.SetCaller("org1")
+	positions := checkPositions(t, stub, "query")
+	if len(positions) != 2 || positions[0].Balance.Account != "MZ0987654321" ||
+		positions[1].Balance.Account != "MZ0987654321" {
+		fmt.Println("Organization sees positions of others: ", positions)
+		t.FailNow()
+	}
+
+	if positions := checkPositions(t, stub, "queryByAccount", "MZ0987654321", "19000000000000000"); len(positions) != 2 {
+		fmt.Println("Account lookup returned wrong positions: ", positions)
+		t.FailNow()
+	}
+	if positions := checkPositions(t, stub, "queryByAccount", "30109810000000000000"); len(positions) != 0 {
+		fmt.Println("Account lookup returned positions of another organization: ", positions)
+		t.FailNow()
+	}
+	checkStatus(t, stub, 400, "queryByAccount")
+
+	stub.SetCaller("org2")
+	if positions := checkPositions(t, stub, "query"); len(positions) != 1 || positions[0].Quantity != 200 {
+		fmt.Println("Organization sees positions of others: ", positions)
+		t.FailNow()
+	}
+
+	// balances registered in the book later become visible to their owner once their positions are written again
+	registerBalances(t, stub, organizations[:len(organizations)-1]+
+		`, {"organization": "org2", "balances": [{"account": "UNREGISTERED", "division": "044525505"}]}]`)
+	if positions := checkPositions(t, stub, "query"); len(positions) != 1 {
+		fmt.Println("Registration is not copied with the position: ", positions)
+		t.FailNow()
+	}
+	stub.SetCaller(nsdName)
+	checkStatus(t, stub, 200, "put", "UNREGISTERED", "044525505", "RU000ABC0001", "300")
+	stub.SetCaller("org2")
+	if positions := checkPositions(t, stub, "query"); len(positions) != 2 {
+		fmt.Println("Newly registered balance is not visible: ", positions)
+		t.FailNow()
+	}
+	checkStatus(t, stub, 403, "history", "MZ0987654321", "19000000000000000", "RU000ABC0001")
+	checkStatus(t, stub, 500, "addBalances", `[{"organization": "org2", "balances": []}]`)
+}
+
+func checkHoldings(t *testing.T, stub *testutils.TestStub, groupBy string) []Holding {
+	var holdings []Holding
+	if err := json.Unmarshal(checkStatus(t, stub, 200, "holdings", groupBy), &holdings); err != nil {
+		fmt.Println("Cannot unmarshal holdings: ", err)
+		t.FailNow()
+	}
+	return holdings
+}
+
+func TestPosition_Holdings(t *testing.T) {
+	stub := getStub(t)
+	// org1 holds the second balance under another deponent code
+	registerBalances(t, stub, `[{
+			"organization": "org1", "deponent": "DE000001",
+			"balances": [{"account": "MZ0987654321", "division": "19000000000000000"}],
+			"deponents": {"DE000002": [{"account": "MZ0987654321", "division": "22000000000000000"}]}
+		}, {
+			"organization": "org2", "deponent": "DE000003",
+			"balances": [{"account": "30109810000000000000", "division": "044525505"}]
+		}]`)
+
+	checkStatus(t, stub, 200, "put", "MZ0987654321", "19000000000000000", "RU000ABC0001", "100")
+	checkStatus(t, stub, 200, "put", "MZ0987654321", "22000000000000000", "RU000ABC0001", "20")
+	checkStatus(t, stub, 200, "put", "MZ0987654321", "19000000000000000", "RU000ABC0002", "50")
+	checkStatus(t, stub, 200, "put", "30109810000000000000", "044525505", "RU000ABC0001", "200")
+
+	holdings := checkHoldings(t, stub, GroupByDeponent)
+	if len(holdings) != 4 || holdings[1].Deponent != "DE000001" || holdings[1].Organization != "org1" ||
+		holdings[1].Security != "RU000ABC0001" || holdings[1].Quantity != 100 || len(holdings[1].Lines) != 1 ||
+		holdings[3].Deponent != "DE000002" || holdings[3].Organization != "org1" || holdings[3].Quantity != 20 {
+		fmt.Println("Wrong holdings by deponent: ", holdings)
+		t.FailNow()
+	}
+
+	holdings = checkHoldings(t, stub, GroupBySecurity)
+	if len(holdings) != 2 || holdings[0].Security != "RU000ABC0001" || holdings[0].Quantity != 320 ||
+		len(holdings[0].Lines) != 3 || holdings[1].Quantity != 50 {
+		fmt.Println("Wrong holdings by security: ", holdings)
+		t.FailNow()
+	}
+
+	holdings = checkHoldings(t, stub, GroupByAccount)
+	if len(holdings) != 2 || holdings[1].Account != "MZ0987654321" || holdings[1].Quantity != 170 {
+		fmt.Println("Wrong holdings by account: ", holdings)
+		t.FailNow()
+	}
+
+	// aggregates consist of the caller's own positions only
+	stub.SetCaller("org2")
+	holdings = checkHoldings(t, stub, GroupBySecurity)
+	if len(holdings) != 1 || holdings[0].Quantity != 200 || len(holdings[0].Lines) != 1 {
+		fmt.Println("Holdings include positions of others: ", holdings)
+		t.FailNow()
+	}
+
+	checkStatus(t, stub, 400, "holdings")
+	checkStatus(t, stub, 400, "holdings", "division")
+}
+
+func TestPosition_MainOrg(t *testing.T) {
+	stub := getStub(t)
+	if mainOrg := checkStatus(t, stub, 200, "mainOrg"); string(mainOrg) != nsdName {
+		fmt.Println("Wrong main organization: ", string(mainOrg))
+		t.FailNow()
+	}
+
+	// main organization is read from "security" chaincode, position keeps no record of its own
+	stub.SetMainOrganization("org1")
+	checkStatus(t, stub, 403, "put", "AC0689654902", "87680000045800005", "RU000ABC0001", "100")
+	checkStatus(t, stub, 500, "setMainOrg", nsdName)
+
+	stub.SetCaller("org1")
+	checkStatus(t, stub, 200, "put", "AC0689654902", "87680000045800005", "RU000ABC0001", "100")
+
+	stub.SetMainOrganization("")
+	checkStatus(t, stub, 500, "put", "AC0689654902", "87680000045800005", "RU000ABC0001", "200")
+}
+
+func TestPosition_Migrate(t *testing.T) {
+	stub := getStub(t)
+
+	// positions stored before versioning are arrays of quantity
+	stub.MockTransactionStart("legacy")
+	for _, account := range []string{"AC0689654901", "AC0689654902", "AC0689654903"} {
+		key, _ := stub.CreateCompositeKey(nsd.PositionIndex, []string{account, "87680000045800005", "RU000ABC0001"})
+		stub.PutState(key, []byte(`["25"]`))
+	}
+	stub.MockTransactionEnd("legacy")
+	checkStatus(t, stub, 200, "put", "AC0689654904", "87680000045800005", "RU000ABC0001", "100")
+
+	positions := checkPositions(t, stub, "query")
+	if len(positions) != 4 || positions[0].Quantity != 25 || positions[3].Quantity != 100 {
+		fmt.Println("Unexpected positions: ", positions)
+		t.FailNow()
+	}
+
+	checkVersions := func(expected map[string]int) {
+		var status []struct {
+			Index   string         `json:"index"`
+			Version int            `json:"version"`
+			Records map[string]int `json:"records"`
+		}
+		if err := json.Unmarshal(checkStatus(t, stub, 200, "schemaStatus"), &status); err != nil {
+			fmt.Println("Cannot unmarshal schema status: ", err)
+			t.FailNow()
+		}
+		for _, s := range status {
+			if s.Index == nsd.PositionIndex &&
+				(s.Version != 1 || fmt.Sprint(s.Records) != fmt.Sprint(expected)) {
+				fmt.Println("Unexpected schema status: ", s, ", expected: ", expected)
+				t.FailNow()
+			}
+		}
+	}
+	checkVersions(map[string]int{"0": 3, "1": 1})
+
+	stub.SetCaller("org1")
+	checkStatus(t, stub, 403, "pendingMigration")
+	checkStatus(t, stub, 403, "migrate", "[]")
+
+	stub.SetCaller(nsdName)
+	checkStatus(t, stub, 400, "pendingMigration", "0")
+	checkStatus(t, stub, 400, "pendingMigration", "2", "Unknown/")
+	checkStatus(t, stub, 400, "migrate", "not keys")
+	checkStatus(t, stub, 400, "migrate", `["Unknown"]`)
+
+	// the first batch ends within positions, the next one continues from its bookmark
+	var pending struct {
+		Keys     []string `json:"keys"`
+		Bookmark string   `json:"bookmark"`
+		Done     bool     `json:"done"`
+	}
+	if err := json.Unmarshal(checkStatus(t, stub, 200, "pendingMigration", "2"), &pending); err != nil ||
+		len(pending.Keys) != 2 || pending.Done || !strings.HasPrefix(pending.Bookmark, nsd.PositionIndex+"/") {
+		fmt.Println("Unexpected pending migration: ", pending)
+		t.FailNow()
+	}
+	keys, _ := json.Marshal(pending.Keys)
+	if result := string(checkStatus(t, stub, 200, "migrate", string(keys))); result != `{"migrated":2}` {
+		fmt.Println("Unexpected migration: " + result)
+		t.FailNow()
+	}
+	checkVersions(map[string]int{"0": 1, "1": 3})
+
+	// migrated keys are skipped
+	if result := string(checkStatus(t, stub, 200, "migrate", string(keys))); result != `{"migrated":0}` {
+		fmt.Println("Unexpected migration: " + result)
+		t.FailNow()
+	}
+
+	if err := json.Unmarshal(checkStatus(t, stub, 200, "pendingMigration", "2", pending.Bookmark), &pending); err != nil ||
+		len(pending.Keys) != 1 || pending.Done {
+		fmt.Println("Unexpected pending migration: ", pending)
+		t.FailNow()
+	}
+
+	if migrated, res := stub.MockMigration(2); res.Status != shim.OK || migrated != 1 {
+		fmt.Println("Unexpected migration: ", migrated, res.Message)
+		t.FailNow()
+	}
+	checkVersions(map[string]int{"1": 4})
+
+	positions = checkPositions(t, stub, "query")
+	if len(positions) != 4 || positions[0].Quantity != 25 {
+		fmt.Println("Migration changed positions: ", positions)
+		t.FailNow()
+	}
+}
@@ -5,35 +5,85 @@ import (
 	"fmt"
 	"encoding/json"
 	"time"
+	"strconv"
 
 	"github.com/hyperledger/fabric/core/chaincode/shim"
 	pb "github.com/hyperledger/fabric/protos/peer"
 	"github.com/Altoros/nsd-commercial-paper-common"
-	"github.com/Altoros/nsd-commercial-paper-common/certificates"
 )
 
 var logger = shim.NewLogger("SecurityChaincode")
 
 const indexName = `Security`
 
+// indexes of values versioned by nsd schemas, see migrate
+var schemaIndexes = append([]string{indexName, nsd.CalendarIndex}, nsd.CommonSchemaIndexes...)
+
+func init() {
+	nsd.RegisterSchema(nsd.Schema{Index: indexName, Version: 1, Upgrades: map[int]nsd.Upgrade{0: nsd.Unversioned}})
+	// the only settlement calendar, the other chaincodes read it with "calendar" query
+	nsd.RegisterSchema(nsd.Schema{Index: nsd.CalendarIndex, Version: 1, Upgrades: map[int]nsd.Upgrade{0: nsd.Unversioned},
+		Singleton: true})
+	// the only record of the main organization, the other chaincodes read it from here
+	nsd.KeepMainOrg()
+}
+
 const EntryMaturedStatus = `MCAL`
 const SecurityMaturedStatus = `matured`
 
+const dateLayout = "2006-01-02"
+const defaultPageSize = 100
+const maxPageSize = 1000
+
+// instructions in these statuses don't prevent archival or deletion of their security
+var closedInstructionStatuses = map[string]bool{
+	nsd.InstructionExecuted:          true,
+	nsd.InstructionPartiallyExecuted: true,
+	nsd.InstructionDeclined:          true,
+	nsd.InstructionCanceled:          true,
+	nsd.InstructionRollbackDone:      true,
+	nsd.InstructionRollbackDeclined:  true,
+}
+
 // SecurityChaincode
 type SecurityChaincode struct {
 }
 
 type SecurityValue struct {
 	Status      	string 				`json:"status"`
+	Issuer			string				`json:"issuer"`
+	MaturityDate	string				`json:"maturityDate"`
 	Entries			[]CalendarEntries	`json:"entries"`
 	Redeem			nsd.Balance			`json:"redeem"`
+	Archived		bool				`json:"archived"`
 }
 
 type Security struct {
 	Security        string 				`json:"security"`
 	Status      	string 				`json:"status"`
+	Issuer			string				`json:"issuer"`
+	MaturityDate	string				`json:"maturityDate"`
 	Entries			[]CalendarEntries	`json:"entries"`
 	Redeem			nsd.Balance			`json:"redeem"`
+	Archived		bool				`json:"archived"`
+}
+
+// query criteria, empty fields match any security
+type SecurityFilter struct {
+	Status          string `json:"status"`
+	Issuer          string `json:"issuer"`
+	MaturityFrom    string `json:"maturityFrom"`
+	MaturityTo      string `json:"maturityTo"`
+	EntryCode       string `json:"entryCode"`
+	IncludeArchived bool   `json:"includeArchived"`
+	PageSize        int    `json:"pageSize"`
+	Bookmark        string `json:"bookmark"`
+}
+
+// filtered query result, bookmark is empty on the last page
+type SecurityPage struct {
+	Securities []Security `json:"securities"`
+	Bookmark   string     `json:"bookmark"`
 }
 
 type CalendarEntries struct {
@@ -55,11 +105,30 @@ func (t *SecurityChaincode) Init(stub shim.ChaincodeStubInterface) pb.Response
 
 	_, args := stub.GetFunctionAndParameters()
 
+	// securities, main organization, configuration
+	mainOrg, config := "", ""
+	if len(args) > 1 {
+		mainOrg = args[1]
+	}
+	if len(args) > 2 {
+		config = args[2]
+	}
+	if rs := nsd.InitConfig(stub, config); rs.Status != shim.OK {
+		return rs
+	}
+	if rs := nsd.InitMainOrg(stub, mainOrg); rs.Status != shim.OK {
+		return rs
+	}
+
+	// empty list is fine for an upgrade which only changes main organization
 	var securities []Security
-	if err := json.Unmarshal([]byte(args[0]), &securities); err == nil && len(securities) != 0 {
+	if err := json.Unmarshal([]byte(args[0]), &securities); err == nil {
 		for _, entry := range securities {
-			if rs := t.put(stub, []string{entry.Security, entry.Status, entry.Redeem.Account, entry.Redeem.Division});
-			   rs.Status >= 400 {
+			putArgs := []string{entry.Security, entry.Status, entry.Redeem.Account, entry.Redeem.Division}
+			if entry.Issuer != "" || entry.MaturityDate != "" {
+				putArgs = append(putArgs, entry.Issuer, entry.MaturityDate)
+			}
+			if rs := t.put(stub, putArgs); rs.Status >= 400 {
 				return rs
 			}
 		}
@@ -75,9 +144,11 @@ func (t *SecurityChaincode) Invoke(stub shim.ChaincodeStubInterface) pb.Response
 
 	function, args := stub.GetFunctionAndParameters()
 
-	if function == "put" {
-		return t.put(stub, args)
+	governed := nsd.Governed{"put": t.put, "setMainOrg": nsd.ChangeMainOrg, "setCalendar": t.setCalendar}
+	if rs, ok := governed.Invoke(stub, function, args); ok {
+		return rs
 	}
+
 	if function == "query" {
 		return t.query(stub, args)
 	}
@@ -87,29 +158,48 @@ func (t *SecurityChaincode) Invoke(stub shim.ChaincodeStubInterface) pb.Response
 	if function == "addEntry" {
 		return t.addCalendarEntry(stub, args)
 	}
+	if function == "calendar" {
+		return t.queryCalendar(stub)
+	}
 	if function == "find" {
 		return t.find(stub, args)
 	}
+	if function == "archive" {
+		return t.archive(stub, args)
+	}
+	if function == "delete" {
+		return t.delete(stub, args)
+	}
+	if function == "mainOrg" {
+		return nsd.QueryMainOrg(stub)
+	}
+	if function == "config" {
+		return nsd.QueryConfig(stub)
+	}
+	if function == "pendingMigration" {
+		return nsd.PendingMigration(stub, args, schemaIndexes...)
+	}
+	if function == "migrate" {
+		return nsd.Migrate(stub, args, schemaIndexes...)
+	}
+	if function == "schemaStatus" {
+		return nsd.SchemaStatus(stub, schemaIndexes...)
+	}
 
 	return shim.Error(fmt.Sprintf("Unknown function, check the first argument, must be one of: " +
-		"put, query, history, addEntry, find. But got: %v", function))
+		"query, history, addEntry, calendar, find, archive, delete, mainOrg, config, pendingMigration, migrate, schemaStatus, " +
+		"propose (put, setMainOrg, setCalendar), approve, pending, proposalHistory. But got: %v", function))
 }
 
-func (t *SecurityChaincode) put(stub shim.ChaincodeStubInterface, args []string) pb.Response {
-	rs := stub.InvokeChaincode("book", [][]byte{[]byte("mainOrg")}, "depository")
-	if rs.Status >= 400 {
-		return pb.Response{Status: 400, Message: "Unable to invoke \"book\": " + rs.Message}
-	}
 
-	mainOrg := string(rs.Payload)
-	if certificates.GetCreatorOrganization(stub) != mainOrg {
-		return pb.Response{Status: 403,
-			Message: "Insufficient privileges. Only " + mainOrg + " can change Securities information."}
+func (t *SecurityChaincode) put(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if rs := nsd.AuthorizeMainOrg(stub, "change Securities information"); rs.Status != shim.OK {
+		return rs
 	}
 
-	if len(args) != 4 {
+	if len(args) != 4 && len(args) != 6 {
 		return shim.Error("Incorrect number of arguments. " +
-			"Expecting security, status, Redeem Account, Redeem Division")
+			"Expecting security, status, Redeem Account, Redeem Division, optionally Issuer, Maturity Date")
 	}
 
 	s, err := t.findByKey(stub, args[0])
@@ -123,6 +213,16 @@ func (t *SecurityChaincode) put(stub shim.ChaincodeStubInterface, args []string)
 	s.Redeem.Account = args[2]
 	s.Redeem.Division = args[3]
 
+	if len(args) == 6 {
+		if args[5] != "" {
+			if _, err := time.Parse(dateLayout, args[5]); err != nil {
+				return pb.Response{Status: 400, Message: "Maturity date must be in format " + dateLayout + "."}
+			}
+		}
+		s.Issuer = args[4]
+		s.MaturityDate = args[5]
+	}
+
 	return t.save(stub, s)
 }
 
@@ -132,9 +232,12 @@ func (t *SecurityChaincode) save(stub shim.ChaincodeStubInterface, item Security
 		return shim.Error(err.Error())
 	}
 
-	value, err := json.Marshal(SecurityValue{Status: item.Status,
+	value, err := nsd.MarshalValue(indexName, SecurityValue{Status: item.Status,
+											Issuer: item.Issuer,
+											MaturityDate: item.MaturityDate,
 											Entries: item.Entries,
-											Redeem:nsd.Balance{Account:item.Redeem.Account, Division:item.Redeem.Division}})
+											Redeem:nsd.Balance{Account:item.Redeem.Account, Division:item.Redeem.Division},
+											Archived: item.Archived})
 	if err != nil {
 		return shim.Error(err.Error())
 	}
@@ -148,15 +251,8 @@ func (t *SecurityChaincode) save(stub shim.ChaincodeStubInterface, item Security
 }
 
 func (t *SecurityChaincode) addCalendarEntry(stub shim.ChaincodeStubInterface, args []string) pb.Response {
-	rs := stub.InvokeChaincode("book", [][]byte{[]byte("mainOrg")}, "depository")
-	if rs.Status >= 400 {
-		return pb.Response{Status: 400, Message: "Unable to invoke \"book\": " + rs.Message}
-	}
-
-	mainOrg := string(rs.Payload)
-	if certificates.GetCreatorOrganization(stub) != mainOrg {
-		return pb.Response{Status: 403,
-			Message: "Insufficient privileges. Only " + mainOrg + " can add Calendar Entry."}
+	if rs := nsd.AuthorizeMainOrg(stub, "add Calendar Entry"); rs.Status != shim.OK {
+		return rs
 	}
 
 	if len(args) != 5 {
@@ -186,6 +282,55 @@ func (t *SecurityChaincode) addCalendarEntry(stub shim.ChaincodeStubInterface, a
 	return shim.Success(nil)
 }
 
+// setCalendar replaces the settlement calendar, instructions matched after it settle by the new one
+func (t *SecurityChaincode) setCalendar(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if rs := nsd.AuthorizeMainOrg(stub, "change settlement calendar"); rs.Status != shim.OK {
+		return rs
+	}
+
+	if len(args) != 1 {
+		return pb.Response{Status: 400, Message: "Incorrect number of arguments. Expecting calendar as JSON"}
+	}
+	calendar, err := nsd.ParseCalendar(args[0])
+	if err != nil {
+		return pb.Response{Status: 400, Message: err.Error()}
+	}
+
+	data, err := nsd.MarshalValue(nsd.CalendarIndex, calendar)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if err := stub.PutState(nsd.CalendarIndex, data); err != nil {
+		return pb.Response{Status: 500, Message: "Persistence failure."}
+	}
+
+	if err := stub.SetEvent(nsd.CalendarIndex+".changed", data); err != nil {
+		return pb.Response{Status: 500, Message: "Event emission failure."}
+	}
+	return shim.Success(nil)
+}
+
+// queryCalendar returns the settlement calendar, T+0 without holidays until one is set
+func (t *SecurityChaincode) queryCalendar(stub shim.ChaincodeStubInterface) pb.Response {
+	calendar := nsd.Calendar{}
+
+	data, err := stub.GetState(nsd.CalendarIndex)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if len(data) != 0 {
+		if err := nsd.UnmarshalValue(nsd.CalendarIndex, data, &calendar); err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
+	result, err := json.Marshal(calendar)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(result)
+}
+
 func (t *SecurityChaincode) findByKey(stub shim.ChaincodeStubInterface, securityName string) (Security, error) {
 
 	key, err := stub.CreateCompositeKey(indexName, []string{securityName})
@@ -201,22 +346,27 @@ func (t *SecurityChaincode) findByKey(stub shim.ChaincodeStubInterface, security
 		return Security{}, fmt.Errorf("No security found for key: %v", key)
 	}
 	var value SecurityValue
-	err = json.Unmarshal(response, &value)
+	err = nsd.UnmarshalValue(indexName, response, &value)
 	if err != nil {
 		return Security{}, fmt.Errorf("Cannot Unmarshal security: %v", err)
 	}
 
-	security := Security {
+	return toSecurity(securityName, value), nil
+}
+
+func toSecurity(securityName string, value SecurityValue) Security {
+	return Security {
 		Security: securityName,
 		Status: value.Status,
+		Issuer: value.Issuer,
+		MaturityDate: value.MaturityDate,
 		Redeem: nsd.Balance{
 			Account: value.Redeem.Account,
 			Division: value.Redeem.Division,
 		},
 		Entries:value.Entries,
+		Archived:value.Archived,
 	}
-
-	return security, nil
 }
 
 func (t *SecurityChaincode) find(stub shim.ChaincodeStubInterface, args []string) pb.Response {
@@ -237,52 +387,167 @@ func (t *SecurityChaincode) find(stub shim.ChaincodeStubInterface, args []string
 	return shim.Success(result)
 }
 
+// query returns all non-archived securities when called without arguments
+// and all securities when called with "true".
+// Given a SecurityFilter JSON it returns a SecurityPage of matching securities instead.
 func (t *SecurityChaincode) query(stub shim.ChaincodeStubInterface, args []string) pb.Response {
-	it, err := stub.GetStateByPartialCompositeKey(indexName, []string{})
-	if err != nil {
-		return shim.Error(err.Error())
+	filter := SecurityFilter{}
+	paged := false
+
+	if len(args) > 0 {
+		if flag, err := strconv.ParseBool(args[0]); err == nil {
+			filter.IncludeArchived = flag
+		} else if err := json.Unmarshal([]byte(args[0]), &filter); err == nil {
+			paged = true
+		} else {
+			return pb.Response{Status: 400, Message: "Expecting either include archived flag or filter JSON."}
+		}
 	}
-	defer it.Close()
 
-	securities := []Security{}
-	for it.HasNext() {
-		responseRange, err := it.Next()
-		if err != nil {
-			return shim.Error(err.Error())
-		}
+	if err := filter.validate(); err != nil {
+		return pb.Response{Status: 400, Message: err.Error()}
+	}
+
+	pageSize := filter.PageSize
+	if !paged {
+		pageSize = 0
+	} else if pageSize == 0 {
+		pageSize = defaultPageSize
+	}
 
-		//account-division-security
-		_, compositeKeyParts, err := stub.SplitCompositeKey(responseRange.Key)
+	// keys are ordered by security name, so the bookmark is the name to resume from;
+	// the ledger is read from it in batches until the page is full
+	bookmark := ""
+	if filter.Bookmark != "" {
+		key, err := stub.CreateCompositeKey(indexName, []string{filter.Bookmark})
 		if err != nil {
 			return shim.Error(err.Error())
 		}
+		bookmark = key
+	}
+	batchSize := int32(pageSize)
+	if batchSize == 0 {
+		batchSize = maxPageSize
+	}
 
-		var value SecurityValue
-		err = json.Unmarshal(responseRange.Value, &value)
+	page := SecurityPage{Securities: []Security{}}
+	for full := false; !full; {
+		it, metadata, err := stub.GetStateByPartialCompositeKeyWithPagination(indexName, []string{}, batchSize, bookmark)
 		if err != nil {
 			return shim.Error(err.Error())
 		}
 
-		security := Security {
-			Security: compositeKeyParts[0],
-			Status: value.Status,
-			Redeem: nsd.Balance{
-				Account:  value.Redeem.Account,
-				Division: value.Redeem.Division,
-			},
-			Entries:value.Entries,
+		for it.HasNext() {
+			responseRange, err := it.Next()
+			if err != nil {
+				it.Close()
+				return shim.Error(err.Error())
+			}
+
+			_, compositeKeyParts, err := stub.SplitCompositeKey(responseRange.Key)
+			if err != nil {
+				it.Close()
+				return shim.Error(err.Error())
+			}
+
+			var value SecurityValue
+			err = nsd.UnmarshalValue(indexName, responseRange.Value, &value)
+			if err != nil {
+				it.Close()
+				return shim.Error(err.Error())
+			}
+
+			security := toSecurity(compositeKeyParts[0], value)
+			if !filter.matches(security) {
+				continue
+			}
+
+			if pageSize > 0 && len(page.Securities) == pageSize {
+				page.Bookmark = security.Security
+				full = true
+				break
+			}
+
+			page.Securities = append(page.Securities, security)
 		}
+		it.Close()
 
-		securities = append(securities, security)
+		if metadata.Bookmark == "" {
+			break
+		}
+		bookmark = metadata.Bookmark
 	}
 
-	result, err := json.Marshal(securities)
+	var result []byte
+	var err error
+	if paged {
+		result, err = json.Marshal(page)
+	} else {
+		result, err = json.Marshal(page.Securities)
+	}
 	if err != nil {
 		return shim.Error(err.Error())
 	}
 	return shim.Success(result)
 }
 
+func (f *SecurityFilter) validate() error {
+	if f.PageSize < 0 || f.PageSize > maxPageSize {
+		return fmt.Errorf("Page size must not be negative or exceed %d.", maxPageSize)
+	}
+
+	for _, date := range []string{f.MaturityFrom, f.MaturityTo} {
+		if date == "" {
+			continue
+		}
+		if _, err := time.Parse(dateLayout, date); err != nil {
+			return fmt.Errorf("Maturity dates must be in format %s.", dateLayout)
+		}
+	}
+
+	return nil
+}
+
+func (f *SecurityFilter) matches(security Security) bool {
+	if security.Archived && !f.IncludeArchived {
+		return false
+	}
+	if f.Status != "" && security.Status != f.Status {
+		return false
+	}
+	if f.Issuer != "" && security.Issuer != f.Issuer {
+		return false
+	}
+
+	// dates share the same layout, so they compare as strings
+	if f.MaturityFrom != "" || f.MaturityTo != "" {
+		if security.MaturityDate == "" {
+			return false
+		}
+		if f.MaturityFrom != "" && security.MaturityDate < f.MaturityFrom {
+			return false
+		}
+		if f.MaturityTo != "" && security.MaturityDate > f.MaturityTo {
+			return false
+		}
+	}
+
+	if f.EntryCode != "" {
+		found := false
+		for _, entry := range security.Entries {
+			if entry.Code == f.EntryCode {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
+
 func (t *SecurityChaincode) history(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 	if len(args) != 1 {
 		return shim.Error("Incorrect number of arguments. " +
@@ -319,9 +584,12 @@ func (t *SecurityChaincode) history(stub shim.ChaincodeStubInterface, args []str
 			entry.Timestamp = time.Unix(ts.Seconds, int64(ts.Nanos)).String()
 		}
 
-		err = json.Unmarshal(response.GetValue(), &entry.Value)
-		if err != nil {
-			return shim.Error(err.Error())
+		// deleted security leaves no value behind
+		if !entry.IsDelete {
+			err = nsd.UnmarshalValue(indexName, response.GetValue(), &entry.Value)
+			if err != nil {
+				return shim.Error(err.Error())
+			}
 		}
 
 		modifications = append(modifications, entry)
@@ -334,6 +602,110 @@ func (t *SecurityChaincode) history(stub shim.ChaincodeStubInterface, args []str
 	return shim.Success(result)
 }
 
+func (t *SecurityChaincode) archive(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if rs := nsd.AuthorizeMainOrg(stub, "archive Securities"); rs.Status != shim.OK {
+		return rs
+	}
+
+	if len(args) != 1 {
+		return pb.Response{Status: 400, Message: "Incorrect number of arguments. Expecting security"}
+	}
+
+	security, err := t.findByKey(stub, args[0])
+	if err != nil {
+		return pb.Response{Status: 404, Message: err.Error()}
+	}
+
+	if rs := checkUnreferenced(stub, security.Security); rs.Status != shim.OK {
+		return rs
+	}
+
+	if security.Archived {
+		return pb.Response{Status: 202, Message: "Already archived."}
+	}
+
+	security.Archived = true
+
+	return t.save(stub, security)
+}
+
+func (t *SecurityChaincode) delete(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if rs := nsd.AuthorizeMainOrg(stub, "delete Securities"); rs.Status != shim.OK {
+		return rs
+	}
+
+	if len(args) != 1 {
+		return pb.Response{Status: 400, Message: "Incorrect number of arguments. Expecting security"}
+	}
+
+	security, err := t.findByKey(stub, args[0])
+	if err != nil {
+		return pb.Response{Status: 404, Message: err.Error()}
+	}
+
+	if rs := checkUnreferenced(stub, security.Security); rs.Status != shim.OK {
+		return rs
+	}
+
+	key, err := stub.CreateCompositeKey(indexName, []string{security.Security})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if err = stub.DelState(key); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(nil)
+}
+
+// checks there are no non-zero positions in "book" chaincode and no open instructions
+// in "instruction" chaincode on each of instruction channels of the configuration referencing the security,
+// no channels are configured until organizations are registered
+func checkUnreferenced(stub shim.ChaincodeStubInterface, security string) pb.Response {
+	rs := nsd.InvokeBook(stub, "query", security)
+	if rs.Status >= 400 {
+		return pb.Response{Status: 400, Message: "Unable to invoke \"book\": " + rs.Message}
+	}
+
+	var positions []nsd.Position
+	if err := json.Unmarshal(rs.Payload, &positions); err != nil {
+		return shim.Error("Cannot unmarshal response: " + err.Error())
+	}
+
+	for _, position := range positions {
+		if position.Security == security && position.Quantity != 0 {
+			return pb.Response{Status: 409, Message: "Security has non-zero positions."}
+		}
+	}
+
+	config, err := nsd.GetConfig(stub)
+	if err != nil {
+		return pb.Response{Status: 500, Message: "Unable to get configuration: " + err.Error()}
+	}
+	for _, channel := range config.InstructionChannels {
+		rs := nsd.InvokeInstruction(stub, channel, "query")
+		if rs.Status >= 400 {
+			return pb.Response{Status: 400,
+				Message: "Unable to invoke \"instruction\" on " + channel + ": " + rs.Message}
+		}
+
+		var instructions []nsd.Instruction
+		if err := json.Unmarshal(rs.Payload, &instructions); err != nil {
+			return shim.Error("Cannot unmarshal response: " + err.Error())
+		}
+
+		for _, instruction := range instructions {
+			if instruction.Key.Security == security && !closedInstructionStatuses[instruction.Value.Status] {
+				return pb.Response{Status: 409,
+					Message: "Security is referenced by open instructions on " + channel + "."}
+			}
+		}
+	}
+
+	return shim.Success(nil)
+}
+
 func main() {
 	err := shim.Start(new(SecurityChaincode))
 	if err != nil {
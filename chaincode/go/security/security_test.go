@@ -4,12 +4,23 @@ import (
 	"fmt"
 	"testing"
 	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
 	"encoding/json"
+	"github.com/Altoros/nsd-commercial-paper-common"
 	"github.com/Altoros/nsd-commercial-paper-common/testutils"
 )
 
 const nsdName = "nsd.nsd.ru"
 
+func toByteArray(arr []string) [][]byte {
+	var res [][]byte
+	for _, entry := range arr {
+		res = append(res, []byte(entry))
+	}
+
+	return res
+}
+
 func getStub(t *testing.T) *testutils.TestStub{
 	scc := new(SecurityChaincode)
 	ts := testutils.NewTestStub("security", scc)
@@ -27,7 +38,7 @@ func getInitializedStub(t *testing.T) *testutils.TestStub{
 				"account":"AC0689654902",
 				"division":"87680000045800005"
 			}
-		}]`)})
+		}]`), []byte(nsdName), []byte(`{"instructionChannels": ["org1-org2"]}`)})
 	return stub
 }
 
@@ -54,6 +65,23 @@ func checkState(t *testing.T, stub *testutils.TestStub, expectedStatus int32,  a
 	return value
 }
 
+func checkStatus(t *testing.T, stub *testutils.TestStub, expectedStatus int32,  args [][]byte) {
+	res := stub.MockInvoke("1", args)
+	if res.Status != expectedStatus {
+		fmt.Println("Wrong status. Current value: ", res.Status,", Expected value: ", expectedStatus, ". ", res.Message)
+		t.FailNow()
+	}
+}
+
+// checkApproved runs a function requiring approval as proposed by one identity of nsd and approved by another
+func checkApproved(t *testing.T, stub *testutils.TestStub, expectedStatus int32, args [][]byte) {
+	res := stub.MockApprovedInvoke(args)
+	if res.Status != expectedStatus {
+		fmt.Println("Wrong status. Current value: ", res.Status,", Expected value: ", expectedStatus, ". ", res.Message)
+		t.FailNow()
+	}
+}
+
 func TestSecurity_Init(t *testing.T) {
 	checkInit(t, getStub(t), [][]byte{[]byte("init"), []byte(
 		`[{
@@ -63,7 +91,7 @@ func TestSecurity_Init(t *testing.T) {
 				"account":"AC0689654902",
 				"division":"87680000045800005"
 			}
-		}]`)})
+		}]`), []byte(nsdName)})
 }
 
 func TestSecurity_Query(t *testing.T) {
@@ -103,13 +131,14 @@ func TestSecurity_Query(t *testing.T) {
 
 func TestSecurity_Put(t *testing.T){
 	stub := getStub(t)
+	checkInit(t, stub, [][]byte{[]byte("init"), []byte("[]"), []byte(nsdName)})
 
 	securityName := "RU000ABC0002"
 	securityStatus:= "created"
 	redeemAccount := "AC0689654902"
 	redeemDivision:= "87680000045800005"
 
-	stub.MockInvoke("1", [][]byte{[]byte("put"), []byte(securityName), []byte(securityStatus), []byte(redeemAccount), []byte(redeemDivision)})
+	stub.MockApprovedInvoke([][]byte{[]byte("put"), []byte(securityName), []byte(securityStatus), []byte(redeemAccount), []byte(redeemDivision)})
 
 	securities := checkState(t, stub, 200, [][]byte{[]byte("query")})
 
@@ -242,7 +271,7 @@ func TestSecurity_Update(t *testing.T){
 	stub.MockInvoke("1", [][]byte{[]byte("addEntry"), []byte(securityName), []byte(code), []byte(date), []byte(text), []byte(reference)})
 
 
-	stub.MockInvoke("1", [][]byte{[]byte("put"), []byte(securityName), []byte(newStatus), []byte(redeemAccount), []byte(redeemDivision)})
+	stub.MockApprovedInvoke([][]byte{[]byte("put"), []byte(securityName), []byte(newStatus), []byte(redeemAccount), []byte(redeemDivision)})
 
 	securities := checkState(t, stub, 200, [][]byte{[]byte("query")})
 
@@ -272,4 +301,356 @@ func TestSecurity_Update(t *testing.T){
 		t.FailNow()
 	}
 
-}
\ No newline at end of file
+}
+
+// answers "book" and "instruction" calls made while archiving or deleting a security
+type referenceChaincode struct {
+	payload string
+}
+
+func (cc *referenceChaincode) Init(stub shim.ChaincodeStubInterface) pb.Response {
+	return shim.Success(nil)
+}
+
+func (cc *referenceChaincode) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
+	return shim.Success([]byte(cc.payload))
+}
+
+func getReferencedStub(t *testing.T, positions, instructions string) *testutils.TestStub {
+	stub := getInitializedStub(t)
+	stub.AddPeerChaincode("book", "depository", &referenceChaincode{payload: positions})
+	stub.AddPeerChaincode("instruction", "org1-org2", &referenceChaincode{payload: instructions})
+	return stub
+}
+
+func TestSecurity_Archive(t *testing.T) {
+	stub := getReferencedStub(t, `[{"balance":{"account":"AC0689654902","division":"87680000045800005"},
+		"security":"RU000ABC0001","quantity":0}]`, `[]`)
+
+	// only main organization can archive
+	stub.SetCaller("org1")
+	checkStatus(t, stub, 403, [][]byte{[]byte("archive"), []byte("RU000ABC0001")})
+
+	stub.SetCaller(nsdName)
+	checkStatus(t, stub, 404, [][]byte{[]byte("archive"), []byte("RU000ABC0009")})
+	checkStatus(t, stub, 200, [][]byte{[]byte("archive"), []byte("RU000ABC0001")})
+	checkStatus(t, stub, 202, [][]byte{[]byte("archive"), []byte("RU000ABC0001")})
+
+	securities := checkState(t, stub, 200, [][]byte{[]byte("query")})
+	if len(securities) != 0 {
+		fmt.Println("Archived security is returned by default query")
+		t.FailNow()
+	}
+
+	securities = checkState(t, stub, 200, [][]byte{[]byte("query"), []byte("true")})
+	if len(securities) != 1 || !securities[0].Archived {
+		fmt.Println("Archived security is not returned when asked for")
+		t.FailNow()
+	}
+}
+
+func TestSecurity_ArchiveReferenced(t *testing.T) {
+	stub := getReferencedStub(t, `[{"balance":{"account":"AC0689654902","division":"87680000045800005"},
+		"security":"RU000ABC0001","quantity":10}]`, `[]`)
+
+	checkStatus(t, stub, 409, [][]byte{[]byte("archive"), []byte("RU000ABC0001")})
+
+	stub = getReferencedStub(t, `[]`, `[{"key":{"security":"RU000ABC0001"},"value":{"status":"matched"}}]`)
+
+	checkStatus(t, stub, 409, [][]byte{[]byte("archive"), []byte("RU000ABC0001")})
+	checkStatus(t, stub, 409, [][]byte{[]byte("delete"), []byte("RU000ABC0001")})
+
+	stub = getReferencedStub(t, `[]`, `[{"key":{"security":"RU000ABC0001"},"value":{"status":"executed"}}]`)
+
+	checkStatus(t, stub, 200, [][]byte{[]byte("archive"), []byte("RU000ABC0001")})
+	// archived security is checked for references again like the one to be deleted
+	stub.AddPeerChaincode("instruction", "org1-org2",
+		&referenceChaincode{payload: `[{"key":{"security":"RU000ABC0001"},"value":{"status":"matched"}}]`})
+	checkStatus(t, stub, 409, [][]byte{[]byte("archive"), []byte("RU000ABC0001")})
+
+	// open instructions are looked for on the configured channels only, none before organizations are registered
+	stub = getReferencedStub(t, `[]`, `[{"key":{"security":"RU000ABC0001"},"value":{"status":"matched"}}]`)
+	checkInit(t, stub, [][]byte{[]byte("init"), []byte("[]"), []byte(nsdName), []byte(`{"instructionChannels": []}`)})
+	checkStatus(t, stub, 400, [][]byte{[]byte("archive"), []byte("RU000ABC0001"), []byte("org1-org2")})
+	checkStatus(t, stub, 200, [][]byte{[]byte("archive"), []byte("RU000ABC0001")})
+}
+
+func TestSecurity_Delete(t *testing.T) {
+	stub := getReferencedStub(t, `[]`, `[]`)
+
+	stub.SetCaller("org1")
+	checkStatus(t, stub, 403, [][]byte{[]byte("delete"), []byte("RU000ABC0001")})
+
+	stub.SetCaller(nsdName)
+	checkStatus(t, stub, 200, [][]byte{[]byte("delete"), []byte("RU000ABC0001")})
+	checkStatus(t, stub, 404, [][]byte{[]byte("delete"), []byte("RU000ABC0001")})
+
+	securities := checkState(t, stub, 200, [][]byte{[]byte("query"), []byte("true")})
+	if len(securities) != 0 {
+		fmt.Println("Deleted security is still returned by query")
+		t.FailNow()
+	}
+}
+
+func checkPage(t *testing.T, stub *testutils.TestStub, filter string) SecurityPage {
+	res := stub.MockInvoke("1", [][]byte{[]byte("query"), []byte(filter)})
+	if res.Status != 200 {
+		fmt.Println("Query failed: ", res.Message)
+		t.FailNow()
+	}
+	var page SecurityPage
+	if err := json.Unmarshal(res.Payload, &page); err != nil {
+		fmt.Println("Cannot unmarshal security page: ", err)
+		t.FailNow()
+	}
+	return page
+}
+
+func TestSecurity_QueryFilter(t *testing.T) {
+	stub := getInitializedStub(t)
+
+	put := func(args ...string) {
+		checkApproved(t, stub, 200, toByteArray(append([]string{"put"}, args...)))
+	}
+	put("RU000ABC0002", "active", "AC0689654902", "87680000045800005", "MINFIN", "2019-06-01")
+	put("RU000ABC0003", "active", "AC0689654902", "87680000045800005", "MINFIN", "2020-06-01")
+	put("RU000ABC0004", "matured", "AC0689654902", "87680000045800005", "SBER", "2018-06-01")
+	checkStatus(t, stub, 200, toByteArray([]string{"addEntry", "RU000ABC0003", "INTR", "2018-12-01", "Coupon", "#1"}))
+
+	if page := checkPage(t, stub, `{"issuer":"MINFIN"}`); len(page.Securities) != 2 || page.Bookmark != "" {
+		fmt.Println("Issuer filter returned wrong securities: ", page)
+		t.FailNow()
+	}
+	if page := checkPage(t, stub, `{"status":"matured"}`); len(page.Securities) != 1 ||
+		page.Securities[0].Security != "RU000ABC0004" {
+		fmt.Println("Status filter returned wrong securities: ", page)
+		t.FailNow()
+	}
+	if page := checkPage(t, stub, `{"maturityFrom":"2019-01-01","maturityTo":"2019-12-31"}`);
+		len(page.Securities) != 1 || page.Securities[0].Security != "RU000ABC0002" {
+		fmt.Println("Maturity filter returned wrong securities: ", page)
+		t.FailNow()
+	}
+	if page := checkPage(t, stub, `{"entryCode":"INTR"}`); len(page.Securities) != 1 ||
+		page.Securities[0].Security != "RU000ABC0003" {
+		fmt.Println("Entry code filter returned wrong securities: ", page)
+		t.FailNow()
+	}
+
+	checkStatus(t, stub, 400, [][]byte{[]byte("query"), []byte(`{"maturityFrom":"01/01/19"}`)})
+	checkApproved(t, stub, 400, [][]byte{[]byte("put"), []byte("RU000ABC0005"), []byte("active"),
+		[]byte("AC0689654902"), []byte("87680000045800005"), []byte("MINFIN"), []byte("June")})
+}
+
+func TestSecurity_QueryPagination(t *testing.T) {
+	stub := getInitializedStub(t)
+	for _, name := range []string{"RU000ABC0002", "RU000ABC0003", "RU000ABC0004", "RU000ABC0005"} {
+		checkApproved(t, stub, 200, toByteArray([]string{"put", name, "active", "AC0689654902", "87680000045800005"}))
+	}
+
+	var names []string
+	bookmark := ""
+	for pages := 0; pages < 5; pages++ {
+		page := checkPage(t, stub, `{"pageSize":2,"bookmark":"`+bookmark+`"}`)
+		if len(page.Securities) > 2 {
+			fmt.Println("Page is larger than requested: ", len(page.Securities))
+			t.FailNow()
+		}
+		for _, security := range page.Securities {
+			names = append(names, security.Security)
+		}
+		if bookmark = page.Bookmark; bookmark == "" {
+			break
+		}
+	}
+
+	if len(names) != 5 || names[0] != "RU000ABC0001" || names[4] != "RU000ABC0005" {
+		fmt.Println("Pages don't cover all securities in order: ", names)
+		t.FailNow()
+	}
+	// a page of filtered securities is filled from as many batches as it takes
+	checkApproved(t, stub, 200, toByteArray([]string{"put", "RU000ABC0006", "active", "AC0689654902",
+		"87680000045800005", "MINFIN", "2021-06-01"}))
+	if page := checkPage(t, stub, `{"pageSize":1,"issuer":"MINFIN","bookmark":"RU000ABC0002"}`);
+		len(page.Securities) != 1 || page.Securities[0].Security != "RU000ABC0006" || page.Bookmark != "" {
+		fmt.Println("Filtered page is not filled from later batches: ", page)
+		t.FailNow()
+	}
+}
+
+func TestSecurity_Config(t *testing.T) {
+	stub := getStub(t)
+	for _, config := range []string{`{"book": {"chaincode": "book", "channel": "Depository"}}`,
+		`{"peerCertificate": "peer.crt"}`, `{"instruction": {"chaincode": ""}}`,
+		`{"instructionChannels": ["Org1-org2"]}`} {
+		if res := stub.MockInit("1", [][]byte{[]byte("init"), []byte("[]"), []byte(nsdName), []byte(config)}); res.Status != 400 {
+			fmt.Println("Invalid configuration accepted: ", config)
+			t.FailNow()
+		}
+	}
+
+	checkInit(t, stub, [][]byte{[]byte("init"), []byte("[]"), []byte(nsdName),
+		[]byte(`{"book": {"chaincode": "ledger", "channel": "depository2"}}`)})
+
+	res := stub.MockInvoke("1", [][]byte{[]byte("config")})
+	var config nsd.Config
+	if err := json.Unmarshal(res.Payload, &config); err != nil {
+		fmt.Println("Cannot unmarshal configuration: ", err)
+		t.FailNow()
+	}
+	if config.Book.Chaincode != "ledger" || config.Book.Channel != "depository2" ||
+		config.Security.Channel != "common" || config.PeerCertificate == "" {
+		fmt.Println("Wrong configuration: ", config)
+		t.FailNow()
+	}
+
+	// book is called where configured
+	checkApproved(t, stub, 200, [][]byte{[]byte("put"), []byte("RU000ABC0003"), []byte("active"),
+		[]byte("AC0689654902"), []byte("87680000045800005")})
+	stub.AddPeerChaincode("book", "depository", &referenceChaincode{payload: `[]`})
+	stub.AddPeerChaincode("ledger", "depository2", &referenceChaincode{payload:
+		`[{"balance":{"account":"AC0689654902","division":"87680000045800005"},"security":"RU000ABC0003","quantity":10}]`})
+	checkStatus(t, stub, 409, [][]byte{[]byte("archive"), []byte("RU000ABC0003")})
+
+	// upgrade keeps configuration unless given a new one
+	checkInit(t, stub, [][]byte{[]byte("init"), []byte("[]")})
+	checkStatus(t, stub, 409, [][]byte{[]byte("archive"), []byte("RU000ABC0003")})
+}
+
+func TestSecurity_SetMainOrg(t *testing.T) {
+	stub := getInitializedStub(t)
+
+	// the only record of the main organization is changed with approval of a second identity
+	checkStatus(t, stub, 403, [][]byte{[]byte("setMainOrg"), []byte("org1")})
+	stub.SetCaller("org1")
+	checkApproved(t, stub, 403, [][]byte{[]byte("setMainOrg"), []byte("org1")})
+
+	stub.SetCaller(nsdName)
+	checkApproved(t, stub, 400, [][]byte{[]byte("setMainOrg")})
+	checkApproved(t, stub, 200, [][]byte{[]byte("setMainOrg"), []byte("org1")})
+
+	res := stub.MockInvoke("1", [][]byte{[]byte("mainOrg")})
+	if res.Status != shim.OK || string(res.Payload) != "org1" {
+		fmt.Println("Main organization was not changed: ", res.Status, string(res.Payload))
+		t.FailNow()
+	}
+	checkApproved(t, stub, 403, [][]byte{[]byte("put"), []byte("RU000ABC0003"), []byte("active"),
+		[]byte("AC0689654902"), []byte("87680000045800005")})
+
+	// upgrade keeps main organization unless given a new one
+	checkInit(t, stub, [][]byte{[]byte("init"), []byte("[]")})
+	res = stub.MockInvoke("1", [][]byte{[]byte("mainOrg")})
+	if string(res.Payload) != "org1" {
+		fmt.Println("Main organization was not kept: ", string(res.Payload))
+		t.FailNow()
+	}
+}
+
+func TestSecurity_Calendar(t *testing.T) {
+	stub := getInitializedStub(t)
+	calendar := func() nsd.Calendar {
+		res := stub.MockInvoke("1", [][]byte{[]byte("calendar")})
+		var calendar nsd.Calendar
+		if err := json.Unmarshal(res.Payload, &calendar); res.Status != shim.OK || err != nil {
+			fmt.Println("Cannot query calendar: ", res.Message, err)
+			t.FailNow()
+		}
+		return calendar
+	}
+	if calendar := calendar(); calendar.SettlementCycle != 0 || len(calendar.Holidays) != 0 {
+		fmt.Println("Wrong default calendar: ", calendar)
+		t.FailNow()
+	}
+
+	// the only settlement calendar of all chaincodes is changed by the main organization with approval
+	setCalendar := [][]byte{[]byte("setCalendar"), []byte(`{"settlementCycle": 1, "holidays": ["2018-04-02"]}`)}
+	checkStatus(t, stub, 403, setCalendar)
+	stub.SetCaller("org1")
+	checkApproved(t, stub, 403, setCalendar)
+	stub.SetCaller(nsdName)
+	checkApproved(t, stub, 400, [][]byte{[]byte("setCalendar"), []byte(`{"settlementCycle": -1}`)})
+	checkApproved(t, stub, 400, [][]byte{[]byte("setCalendar"), []byte(`{"holidays": ["02.04.2018"]}`)})
+	checkApproved(t, stub, 200, setCalendar)
+
+	if calendar := calendar(); calendar.SettlementCycle != 1 || len(calendar.Holidays) != 1 ||
+		calendar.Holidays[0] != "2018-04-02" {
+		fmt.Println("Calendar was not changed: ", calendar)
+		t.FailNow()
+	}
+
+	// upgrade keeps the calendar
+	checkInit(t, stub, [][]byte{[]byte("init"), []byte("[]")})
+	if calendar := calendar(); calendar.SettlementCycle != 1 {
+		fmt.Println("Calendar was not kept: ", calendar)
+		t.FailNow()
+	}
+}
+
+func TestSecurity_Migrate(t *testing.T) {
+	stub := getInitializedStub(t)
+
+	// values stored before versioning are not in envelope
+	stub.MockTransactionStart("legacy")
+	key, _ := stub.CreateCompositeKey(indexName, []string{"RU000ABC0002"})
+	stub.PutState(key, []byte(`{"status":"active","redeem":{"account":"AC0689654902","division":"87680000045800005"}}`))
+	stub.PutState(nsd.ConfigIndex, []byte(`{"book": {"chaincode": "ledger", "channel": "depository2"}}`))
+	stub.PutState(nsd.MainOrgIndex, []byte(nsdName))
+	stub.MockTransactionEnd("legacy")
+
+	checkVersions := func(expected map[string]string) {
+		res := stub.MockInvoke("1", [][]byte{[]byte("schemaStatus")})
+		var status []struct {
+			Index   string         `json:"index"`
+			Records map[string]int `json:"records"`
+		}
+		if err := json.Unmarshal(res.Payload, &status); err != nil || len(status) != len(schemaIndexes) {
+			fmt.Println("Unexpected schema status: ", string(res.Payload))
+			t.FailNow()
+		}
+		for _, s := range status {
+			if records, ok := expected[s.Index]; ok && fmt.Sprint(s.Records) != records {
+				fmt.Println("Unexpected schema status of ", s.Index, ": ", s.Records, ", expected: ", records)
+				t.FailNow()
+			}
+		}
+	}
+	checkVersions(map[string]string{indexName: "map[0:1 1:1]", nsd.ConfigIndex: "map[0:1]",
+		nsd.MainOrgIndex: "map[0:1]"})
+
+	// values are read in any version
+	if securities := checkState(t, stub, 200, [][]byte{[]byte("query")}); len(securities) != 2 {
+		fmt.Println("Legacy security is not read: ", securities)
+		t.FailNow()
+	}
+
+	stub.SetCaller("org1")
+	if _, res := stub.MockMigration(1); res.Status != 403 {
+		fmt.Println("Migration is allowed to another organization: ", res.Status)
+		t.FailNow()
+	}
+
+	// batches of one value continue from bookmarks across indexes and singletons
+	stub.SetCaller(nsdName)
+	if migrated, res := stub.MockMigration(1); res.Status != shim.OK || migrated != 3 {
+		fmt.Println("Unexpected migration: ", migrated, res.Message)
+		t.FailNow()
+	}
+	checkVersions(map[string]string{indexName: "map[1:2]", nsd.ConfigIndex: "map[1:1]",
+		nsd.MainOrgIndex: "map[1:1]"})
+
+	if securities := checkState(t, stub, 200, [][]byte{[]byte("query")}); len(securities) != 2 ||
+		securities[1].Redeem.Account != "AC0689654902" {
+		fmt.Println("Migration changed securities: ", securities)
+		t.FailNow()
+	}
+	var config nsd.Config
+	if err := json.Unmarshal(stub.MockInvoke("1", [][]byte{[]byte("config")}).Payload, &config); err != nil ||
+		config.Book.Chaincode != "ledger" {
+		fmt.Println("Migration changed configuration: ", config)
+		t.FailNow()
+	}
+	if res := stub.MockInvoke("1", [][]byte{[]byte("mainOrg")}); string(res.Payload) != nsdName {
+		fmt.Println("Migration changed main organization: ", string(res.Payload))
+		t.FailNow()
+	}
+}
@@ -0,0 +1,30 @@
+#!/usr/bin/env bash
+# #########################################################################
+# This script instantiates or upgrades chaincode instruction in trilateral channels
+# with their private data collections collections-<channel>.json generated by main-register-new-org.sh
+###########################################################################
+# usage: ./instruction-cc.sh instantiate|upgrade <version> "<channel> [<channel>...]" '<init args json>'
+
+mode=$1
+cc_version=$2
+channels=$3
+init=$4
+
+: ${ORDERER_CA:=crypto-config/ordererOrganizations/$DOMAIN/orderers/orderer.$DOMAIN/tls/ca.crt}
+
+f="dockercompose/docker-compose-$THIS_ORG.yaml"
+GID=$(id -g)
+
+# init args are passed in a file not to be mangled by quoting of the command
+echo "$init" > artifacts/instruction-init-args.json
+
+for channel in $channels; do
+  echo " >> ${mode} chaincode instruction ${cc_version} in channel ${channel} with collections-${channel}.json"
+  cp -f "collections-${channel}.json" artifacts/
+
+  c="peer chaincode ${mode} -o orderer.$DOMAIN:7050 --tls --cafile ${ORDERER_CA} -C ${channel} -n instruction -v ${cc_version} \
+    -c \"\$(cat instruction-init-args.json)\" --collections-config collections-${channel}.json && chown -R $UID:$GID ."
+  docker-compose --file ${f} run --rm "cli.$THIS_ORG.$DOMAIN" bash -c "${c}"
+done
+
+rm -f artifacts/instruction-init-args.json
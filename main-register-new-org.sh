@@ -18,9 +18,13 @@ ORGS=`echo ${ORGS} | tr -d '\r\n'` #remove windows-EOL
 # #########################################################################
 # Load chaincode init args
 ###########################################################################
+export MAIN_ORG_NAME=${MAIN_ORG_NAME:-$MAIN_ORG.$DOMAIN}
+CONFIG_JSON=$(cat ./config.json |tr -d '\n\r ' | sed 's/"/\\"/g' | envsubst )
+
 INSTRUCTION_INIT_JSON=$(cat ./instruction_init.json |tr -d '\n\r ' | sed 's/"/\\"/g' | envsubst )
-: ${INSTRUCTION_INIT:='{"Args":["init","'$INSTRUCTION_INIT_JSON'"]}'}
-: ${POSITION_INIT:='{"Args":["init"]}'}
+: ${INSTRUCTION_INIT:='{"Args":["init","'$INSTRUCTION_INIT_JSON'","'$CONFIG_JSON'"]}'}
+# position of the bilateral channel shows positions of balances registered to the new org in the book
+: ${POSITION_INIT:='{"Args":["init","'$CONFIG_JSON'","'$newOrg.$DOMAIN'"]}'}
 
 cp -f instruction_init.json www/artifacts/
 ###########################################################################
@@ -47,6 +51,8 @@ for org in ${ORGList[@]}; do
     network.sh -m update-sign-policy -o $THIS_ORG -k "$sortedChannelName"
     network.sh -m register-org-in-channel $MAIN_ORG "$sortedChannelName" ${org}
 #    network.sh -m instantiate-chaincode -o $THIS_ORG -k $sortedChannelName -n instruction -I "${INSTRUCTION_INIT}"
+    # DVP requisites of instructions are shared only by the counterparties and the main org
+    MAIN_ORG=$MAIN_ORG ORG1=$org ORG2=$newOrg envsubst < instruction_collections.json > "collections-${sortedChannelName%% }.json"
 
     #track trilateral channels list
     trilateralChannels="$trilateralChannels ${sortedChannelName}"
@@ -63,9 +69,11 @@ network.sh -m warmup-chaincode -o $THIS_ORG -k "$biChannel" -n position -I '{"Ar
 
 if [ -n "$trilateralChannels" ]; then
   echo " >> Instantiate chaincode instruction in trilateral channels: $trilateralChannels"
-  network.sh -m instantiate-chaincode -o $THIS_ORG -k "$trilateralChannels" -n instruction -I "${INSTRUCTION_INIT}"
+  ./instruction-cc.sh instantiate 1.0 "$trilateralChannels" "${INSTRUCTION_INIT}"
   network.sh -m warmup-chaincode -o $THIS_ORG -k "$trilateralChannels" -n instruction -I '{"Args":["query",""]}'
 fi
 
 export ORGS="$ORGS $newOrg"
-echo "export ORGS=\"$ORGS\"" > ./env-external-orgs-list
\ No newline at end of file
+echo "export ORGS=\"$ORGS\"" > ./env-external-orgs-list
+
+echo " >> Book and security chaincodes look for instructions on trilateral channels of $ORGS after they are upgraded with upgrade-cc.sh"
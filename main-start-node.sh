@@ -31,11 +31,14 @@ echo " >> Org $THIS_ORG is registered in channel common. Now chaincode 'security
 
 ./install-cc.sh
 
+export MAIN_ORG_NAME=${MAIN_ORG_NAME:-$MAIN_ORG.$DOMAIN}
+CONFIG_JSON=$(cat ./config.json |tr -d '\n\r ' | sed 's/"/\\"/g' | envsubst )
+
 BOOK_INIT_JSON=$(cat ./book_init.json |sed 's/"/\\"/g' |tr -d '\n\r ' | envsubst )
-: ${BOOK_INIT:='{"Args":["init","'$BOOK_INIT_JSON'"]}'}
+: ${BOOK_INIT:='{"Args":["init","'$BOOK_INIT_JSON'","'$CONFIG_JSON'"]}'}
 
 SECURITY_INIT_JSON=$(cat ./security_init.json |tr -d '\n\r ' | sed 's/"/\\"/g' | envsubst )
-: ${SECURITY_INIT:='{"Args":["init","'$SECURITY_INIT_JSON'"]}'}
+: ${SECURITY_INIT:='{"Args":["init","'$SECURITY_INIT_JSON'","'$MAIN_ORG_NAME'","'$CONFIG_JSON'"]}'}
 
 
 network.sh -m instantiate-chaincode -o $THIS_ORG -k depository -n book -I "${BOOK_INIT}"
@@ -14,6 +14,7 @@ module.exports = {
   position2string     : position2string,
   instructionFilename : instructionFilename,
   instructionArguments: instructionArguments,
+  instructionTransient: instructionTransient,
   normalizeInstruction: normalizeInstruction,
   // getRoleInInstruction: getRoleInInstruction,
   isBilateralChannel  : isBilateralChannel,
@@ -262,18 +263,30 @@ function instructionArguments(instruction) {
     ];
 
     if (instruction.type === 'dvp') {
-      args.push.apply(args, [
-        instruction.transfererRequisites.account,
-        instruction.transfererRequisites.bic,
-        instruction.receiverRequisites.account,
-        instruction.receiverRequisites.bic,
-        instruction.paymentAmount,
-        instruction.paymentCurrency
-      ]);
+      args.push(instruction.paymentCurrency);
     }
     return args;
 }
 
+/**
+ * return transient map with requisites and payment amount of DVP instruction, which are not in its arguments
+ * @static
+ * @return {object|undefined}
+ */
+function instructionTransient(instruction) {
+  if (instruction.type !== 'dvp') {
+    return undefined;
+  }
+  return {
+    'private': Buffer.from(JSON.stringify({
+      transfererRequisites : instruction.transfererRequisites,
+      receiverRequisites   : instruction.receiverRequisites,
+      paymentAmount        : instruction.paymentAmount,
+      salt                 : instruction.salt
+    }))
+  };
+}
+
 
 /**
  * @class ConfigHelper
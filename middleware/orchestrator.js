@@ -249,8 +249,9 @@ module.exports = function (require) {
 
     //
     var args = helper.instructionArguments(instruction);
+    var transient = helper.instructionTransient(instruction);
     var operation = instruction.status === INSTRUCTION_ROLLBACK_INITATED_STATUS ? 'rollback' : 'move';
-    return invoke.invokeChaincode([endorsePeerHost], 'depository', 'book', operation, args, USERNAME, ORG)
+    return invoke.invokeChaincode([endorsePeerHost], 'depository', 'book', operation, args, USERNAME, ORG, transient)
       .then(function (/*transactionId*/) {
         logger.info('Move book record success', helper.instruction2string(instruction));
       })
@@ -291,8 +292,9 @@ module.exports = function (require) {
 
     //
     var args = helper.instructionArguments(instruction);
+    var transient = helper.instructionTransient(instruction);
     args.push(status);
-    return invoke.invokeChaincode([endorsePeerHost], channel, 'instruction', 'status', args, USERNAME, ORG)
+    return invoke.invokeChaincode([endorsePeerHost], channel, 'instruction', 'status', args, USERNAME, ORG, transient)
       .then(function(/*transactionId*/) {
         logger.info('Update instruction status success', helper.instruction2string(instruction));
       })
@@ -302,7 +304,8 @@ module.exports = function (require) {
   }
 
   /**
-   * Copy balance from 'book' cc to 'position' cc, so it'll be visible for the owner, not only for nsd
+   * Copy balance from 'book' cc to 'position' cc, so it'll be visible for the owner, not only for nsd.
+   * Position chaincode reads the book itself and keeps only balances registered to the organization of its channel
    */
   function updatePositionsFromBook() {
     logger.debug('Query book to update all positions');
@@ -313,9 +316,9 @@ module.exports = function (require) {
       .then(function (result) {
         logger.debug('Query book success', JSON.stringify(result));
 
-        return chainPromise(result, position => {
-          logger.trace('Update position', JSON.stringify(position));
-
+        // bilateral channels of organizations owning positions
+        let channels = {};
+        result.forEach(position => {
           let org = configHelper.getOrgByAccount(position.balance.account, position.balance.division);
           if(!org) {
             logger.error('Cannot find org for position', JSON.stringify(position));
@@ -323,22 +326,18 @@ module.exports = function (require) {
           }
 
           //  TODO: rename this bilateral channel
-          let channel = 'nsd-' + org;
-          logger.debug(`invoking position on ${channel} to put ${position.quantity} of ${position.security} to ${position.balance.account}/${position.balance.division}`);
-
-          //
-          var args = [
-              position.balance.account,
-              position.balance.division,
-              position.security,
-              '' + position.quantity
-           ];
-          return invoke.invokeChaincode([endorsePeerHost], channel, 'position', 'put', args, USERNAME, ORG)
+          channels['nsd-' + org] = true;
+        });
+
+        return chainPromise(Object.keys(channels), channel => {
+          logger.debug(`invoking position on ${channel} to sync positions from book`);
+
+          return invoke.invokeChaincode([endorsePeerHost], channel, 'position', 'syncFromBook', [], USERNAME, ORG)
             .then(function (/*transactionId*/) {
-              logger.info('Put position success', helper.position2string(position));
+              logger.info('Sync positions success', channel);
             })
             .catch(function (e) {
-              logger.error('Put position error', helper.position2string(position), e);
+              logger.error('Sync positions error', channel, e);
               // throw e;
             });
 
@@ -5,19 +5,48 @@
 
 cc_version=$1
 
+###########################################################################
+# Load list of existing ORGS
+###########################################################################
+# ORGS variable
+if [[ -f ./env-external-orgs-list ]]; then
+  source ./env-external-orgs-list;
+else
+  ORGS=""
+fi
+ORGS=`echo ${ORGS} | tr -d '\r\n'` #remove windows-EOL
+
+ORGList=($ORGS)
+
+# trilateral channels of every pair of organizations, book and security look for instructions there
+instructionChannels=""
+subArrayStartIndex=1;
+for org in ${ORGList[@]}; do
+  for subOrg in ${ORGList[@]:subArrayStartIndex}; do
+    if [[ "$org" != "$subOrg" ]]; then
+      sortedChannelName=`echo "${org} ${subOrg}" | tr " " "\n" | sort | tr "\n" " " | sed 's/ /-/'`
+      instructionChannels="$instructionChannels,\"${sortedChannelName%% }\""
+    fi
+  done
+  subArrayStartIndex=$((subArrayStartIndex+1))
+done
+
 # #########################################################################
 # Load chaincode init args
 ###########################################################################
-INSTRUCTION_INIT_JSON=$(cat ./instruction_init.json |tr -d '\n\r ' | sed 's/"/\\"/g' | envsubst )
-: ${INSTRUCTION_INIT:='{"Args":["init","'$INSTRUCTION_INIT_JSON'"]}'}
+export MAIN_ORG_NAME=${MAIN_ORG_NAME:-$MAIN_ORG.$DOMAIN}
+CONFIG_JSON=$(cat ./config.json |tr -d '\n\r ' | sed "s/\"instructionChannels\":\[\]/\"instructionChannels\":[${instructionChannels#,}]/" \
+  | sed 's/"/\\"/g' | envsubst )
 
-: ${POSITION_INIT:='{"Args":["init"]}'}
+INSTRUCTION_INIT_JSON=$(cat ./instruction_init.json |tr -d '\n\r ' | sed 's/"/\\"/g' | envsubst )
+: ${INSTRUCTION_INIT:='{"Args":["init","'$INSTRUCTION_INIT_JSON'","'$CONFIG_JSON'"]}'}
 
 BOOK_INIT_JSON=$(cat ./book_init.json |sed 's/"/\\"/g' |tr -d '\n\r ' | envsubst )
-: ${BOOK_INIT:='{"Args":["init","'$BOOK_INIT_JSON'"]}'}
+: ${BOOK_INIT:='{"Args":["init","'$BOOK_INIT_JSON'","'$CONFIG_JSON'"]}'}
 
 SECURITY_INIT_JSON=$(cat ./security_init.json |tr -d '\n\r ' | sed 's/"/\\"/g' | envsubst )
-: ${SECURITY_INIT:='{"Args":["init","'$SECURITY_INIT_JSON'"]}'}
+# upgrade keeps the main organization, it is changed only by approved setMainOrg
+: ${SECURITY_INIT:='{"Args":["init","'$SECURITY_INIT_JSON'","","'$CONFIG_JSON'"]}'}
 
 
 
@@ -34,25 +63,13 @@ network.sh -m upgrade-chaincode -o $THIS_ORG -v ${cc_version} -k depository -n b
 sleep 1
 
 
-###########################################################################
-# Load list of existing ORGS
-###########################################################################
-# ORGS variable
-if [[ -f ./env-external-orgs-list ]]; then
-  source ./env-external-orgs-list;
-else
-  ORGS=""
-fi
-ORGS=`echo ${ORGS} | tr -d '\r\n'` #remove windows-EOL
-
-ORGList=($ORGS)
-
-
 #bilateral channel
 echo " >> Upgrade bilatral channels for orgs: $ORGS"
 
 for org in ${ORGList[@]}; do
   biChannel="${MAIN_ORG}-${org}"
+  # position of the bilateral channel shows positions of balances registered to the org in the book
+  POSITION_INIT='{"Args":["init","'$CONFIG_JSON'","'$org.$DOMAIN'"]}'
   network.sh -m upgrade-chaincode -o $THIS_ORG -v ${cc_version} -k "$biChannel" -n position -I "${POSITION_INIT}"
 done
 
@@ -68,7 +85,10 @@ for org in ${ORGList[@]}; do
       if [[ "$org" != "$subOrg" ]]; then
         sortedChannelName=`echo "${org} ${subOrg}" | tr " " "\n" | sort | tr "\n" " " | sed 's/ /-/'`
         echo " >> Upgrade on trilateral channel: $sortedChannelName"
-        network.sh -m upgrade-chaincode -o $THIS_ORG  -v ${cc_version} -k $sortedChannelName -n instruction -I "${INSTRUCTION_INIT}"
+        sortedChannelName=${sortedChannelName%% }
+        # collections of channels created before private data are generated here, the upgrade adds them
+        MAIN_ORG=$MAIN_ORG ORG1=$org ORG2=$subOrg envsubst < instruction_collections.json > "collections-${sortedChannelName}.json"
+        ./instruction-cc.sh upgrade ${cc_version} "$sortedChannelName" "${INSTRUCTION_INIT}"
       fi
   done
   subArrayStartIndex=$((subArrayStartIndex+1))
@@ -173,13 +173,17 @@ function ApiService($log, $http, env) {
    * @param {Array<string>} peers - peersId
    * @param {string} fcn
    * @param {Array} [args]
+   * @param {object} [transient] - transient data of the proposal, values are strings
    */
-  ApiService.sc.invoke = function(channelID, contractId, peers, fcn, args){
+  ApiService.sc.invoke = function(channelID, contractId, peers, fcn, args, transient){
     var payload = {
       peers : peers,
       fcn   : fcn,
       args  : ApiService.stringify(args || [])
     };
+    if (transient) {
+      payload.transient = transient;
+    }
     return $http.post(cfg.api+'/channels/'+channelID+'/chaincodes/'+contractId, payload)
       .then(function(response){ return response.data; });
   };
@@ -192,14 +196,18 @@ function ApiService($log, $http, env) {
    * @param {string} peer - peerId
    * @param {string} fcn
    * @param {Array} [args]
+   * @param {object} [transient] - transient data of the proposal, values are strings
    */
-  ApiService.sc.query = function(channelID, contractId, peer, fcn, args){
+  ApiService.sc.query = function(channelID, contractId, peer, fcn, args, transient){
     var params = {
       peer : peer,
       fcn  : fcn,
       // arg need to be a string here, because it's passed in url
       args : JSON.stringify(ApiService.stringify(args) || [])
     };
+    if (transient) {
+      params.transient = JSON.stringify(transient);
+    }
     return $http.get(cfg.api+'/channels/'+channelID+'/chaincodes/'+contractId, {params:params})
       .then(function(response){ return response.data; });
   };
@@ -95,8 +95,8 @@ function BookService(ApiService, ConfigLoader, UserService, InstructionService,
     var args = BookService._arguments(book);
     args.push(book.quantity);
 
-    // We can safely use here the result of _getQueryPeer() fn.
-    return ApiService.sc.invoke(channelID, chaincodeID, [peer], 'put', args);
+    // put takes effect once approved by another operator, see 'approve'
+    return ApiService.sc.invoke(channelID, chaincodeID, [peer], 'propose', ['put', JSON.stringify(args)]);
 
   };
 
@@ -112,8 +112,8 @@ function BookService(ApiService, ConfigLoader, UserService, InstructionService,
       JSON.stringify(redemption.reason||{})
     ];
 
-    // We can safely use here the result of _getQueryPeer() fn.
-    return ApiService.sc.invoke(channelID, chaincodeID, [peer], 'redeem', args);
+    // redeem takes effect once approved by another operator, see 'approve'
+    return ApiService.sc.invoke(channelID, chaincodeID, [peer], 'propose', ['redeem', JSON.stringify(args)]);
   };
 
 
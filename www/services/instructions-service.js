@@ -33,6 +33,7 @@
  *
  * @property {string} [paymentAmount]
  * @property {'RUB'}  [paymentCurrency]
+ * @property {string} [salt]
  *
  *
  * extra properties:
@@ -219,6 +220,7 @@ function InstructionService(ApiService, ConfigLoader, $q, $log) {
     var channelID   = InstructionService._getInstructionChannel(instruction);
     var peers       = InstructionService._getEndorsePeers(instruction);
     var args        = InstructionService._instructionArguments(instruction);
+    var transient   = InstructionService._instructionTransient(instruction);
 
     args.push(
       instruction.deponentFrom,
@@ -227,7 +229,7 @@ function InstructionService(ApiService, ConfigLoader, $q, $log) {
       JSON.stringify(instruction.reason||{})
     );
 
-    return ApiService.sc.invoke(channelID, chaincodeID, peers, 'transfer', args);
+    return ApiService.sc.invoke(channelID, chaincodeID, peers, 'transfer', args, transient);
   };
 
   /**
@@ -240,6 +242,7 @@ function InstructionService(ApiService, ConfigLoader, $q, $log) {
     var channelID   = InstructionService._getInstructionChannel(instruction);
     var peers       = InstructionService._getEndorsePeers(instruction);
     var args        = InstructionService._instructionArguments(instruction);
+    var transient   = InstructionService._instructionTransient(instruction);
 
     args.push(
       instruction.deponentFrom,
@@ -255,7 +258,7 @@ function InstructionService(ApiService, ConfigLoader, $q, $log) {
       );
     }
 
-    return ApiService.sc.invoke(channelID, chaincodeID, peers, 'receive', args);
+    return ApiService.sc.invoke(channelID, chaincodeID, peers, 'receive', args, transient);
   };
 
   /**
@@ -286,10 +289,11 @@ function InstructionService(ApiService, ConfigLoader, $q, $log) {
     var channelID   = InstructionService._getInstructionChannel(instruction);
     var peers       = InstructionService._getEndorsePeers(instruction);
     var args        = InstructionService._instructionArguments(instruction);
+    var transient   = InstructionService._instructionTransient(instruction);
 
     args.push(reason, status);
 
-    return ApiService.sc.invoke(channelID, chaincodeID, peers, 'status', args);
+    return ApiService.sc.invoke(channelID, chaincodeID, peers, 'status', args, transient);
   };
 
   /**
@@ -303,10 +307,11 @@ function InstructionService(ApiService, ConfigLoader, $q, $log) {
     var channelID   = InstructionService._getInstructionChannel(instruction);
     var peers       = InstructionService._getEndorsePeers(instruction);
     var args        = InstructionService._instructionArguments(instruction);
+    var transient   = InstructionService._instructionTransient(instruction);
 
     args.push(transfererOrReceiver);
 
-    return ApiService.sc.invoke(channelID, chaincodeID, peers, 'updateDownloadFlags', args);
+    return ApiService.sc.invoke(channelID, chaincodeID, peers, 'updateDownloadFlags', args, transient);
   };
 
 
@@ -323,10 +328,11 @@ function InstructionService(ApiService, ConfigLoader, $q, $log) {
     var channelID   = InstructionService._getInstructionChannel(instruction);
     var peers       = InstructionService._getEndorsePeers(instruction);
     var args        = InstructionService._instructionArguments(instruction);
+    var transient   = InstructionService._instructionTransient(instruction);
 
     args.push(signature);
 
-    return ApiService.sc.invoke(channelID, chaincodeID, peers, 'sign', args);
+    return ApiService.sc.invoke(channelID, chaincodeID, peers, 'sign', args, transient);
   };
 
 
@@ -342,9 +348,10 @@ function InstructionService(ApiService, ConfigLoader, $q, $log) {
     var channelID   = InstructionService._getInstructionChannel(instruction);
     var peer        = InstructionService._getQueryPeer();
     var args        = InstructionService._instructionArguments(instruction);
+    var transient   = InstructionService._instructionTransient(instruction);
     var instructionKey = InstructionService._instructionKey(instruction);
 
-    return ApiService.sc.query(channelID, chaincodeID, peer, 'history', args)
+    return ApiService.sc.query(channelID, chaincodeID, peer, 'history', args, transient)
       .then(function(result){ return result.result; })
       .then(function(result){
         // get pure value
@@ -386,18 +393,40 @@ function InstructionService(ApiService, ConfigLoader, $q, $log) {
     ];
 
     if (instruction.type === 'dvp') {
-      args.push.apply(args, [
-        instruction.transfererRequisites.account,
-        instruction.transfererRequisites.bic,
-        instruction.receiverRequisites.account,
-        instruction.receiverRequisites.bic,
-        instruction.paymentAmount,
-        instruction.paymentCurrency
-      ]);
+      args.push(instruction.paymentCurrency);
     }
     return args;
   };
 
+  /**
+   * requisites and payment amount of DVP instruction are passed in transient data, not in arguments
+   * @param {Instruction} instruction
+   * @return {object|undefined}
+   */
+  InstructionService._instructionTransient = function(instruction) {
+    if (instruction.type !== 'dvp') {
+      return undefined;
+    }
+    return {
+      'private': JSON.stringify({
+        transfererRequisites : instruction.transfererRequisites,
+        receiverRequisites   : instruction.receiverRequisites,
+        paymentAmount        : instruction.paymentAmount,
+        // the counterparty's salt is found by chaincode, this one is used if we submit first
+        salt                 : instruction.salt || _randomSalt()
+      })
+    };
+  };
+
+  /**
+   * @return {string} 32 random hex characters
+   */
+  function _randomSalt() {
+    var bytes = new Uint8Array(16);
+    window.crypto.getRandomValues(bytes);
+    return Array.prototype.map.call(bytes, function(b){ return ('0' + b.toString(16)).slice(-2); }).join('');
+  }
+
 
   /**
    * return basic fields for any instruction request
@@ -134,8 +134,8 @@ function SecurityService(ApiService, ConfigLoader, BookService, $q, $log) {
       security.redeem.division
     ];
 
-    // We can safely use here the result of _getQueryPeer() fn.
-    return ApiService.sc.invoke(channelID, chaincodeID, [peer], 'put', args);
+    // put takes effect once approved by another operator, see 'approve'
+    return ApiService.sc.invoke(channelID, chaincodeID, [peer], 'propose', ['put', JSON.stringify(args)]);
   };
 
 